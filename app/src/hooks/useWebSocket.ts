@@ -10,17 +10,31 @@ interface Params {
 export interface WSMessage {
     message_type: number;
     content?: string;
+    chat_id?: string;
+    request_id?: string;
+    node_id?: string;
 }
 
 export const PingMessage = 1
 export const PongMessage = 1
 export const CompletitionsMessage = 2
 export const CancelMessage = 3
+export const NewChatMessage = 4
+export const RegenerateMessage = 5
+export const EditMessage = 6
+export const SwitchBranchMessage = 7
+export const HistoryMessage = 8
+export const ContinueMessage = 9
 
 export const CompletitionsStart = 2
 export const CompletitionsNext = 3
 export const CompletitionsEnd = 4
 export const CompletitionsQueue = 5
+export const ErrorMessage = 6
+export const ChatCreated = 7
+export const History = 8
+export const CompletitionsCancelled = 9
+export const CompletitionsContext = 10
 
 export function useWebSocket({
     path,
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"github.com/soulnvkz/llm/worker"
+	"github.com/soulnvkz/mq"
+	"github.com/soulnvkz/server/app"
+)
+
+// main runs the server and the worker in one process with the in-process transport,
+// so both of them run without a broker
+func main() {
+	// ctx is done on SIGINT or SIGTERM, or when the server or the worker stops, so the other one is stopped with it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	transport := mq.NewInProc()
+	defer transport.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		defer cancel()
+		serverDone <- app.Run(ctx, transport)
+	}()
+
+	werr := worker.Run(ctx, transport)
+	cancel()
+	serr := <-serverDone
+
+	if err := errors.Join(werr, serr); err != nil {
+		log.Panicf("%s, dev command has stopped", err)
+	}
+}
@@ -0,0 +1,34 @@
+module github.com/soulnvkz/dev
+
+go 1.23.5
+
+replace github.com/soulnvkz/llm => ../llm
+
+replace github.com/soulnvkz/server => ../server
+
+replace github.com/soulnvkz/mq => ../pkg/mq
+
+replace github.com/soulnvkz/log => ../pkg/log
+
+require (
+	github.com/soulnvkz/llm v0.0.0-00010101000000-000000000000
+	github.com/soulnvkz/mq v0.0.0-00010101000000-000000000000
+	github.com/soulnvkz/server v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/nats-io/nats.go v1.48.0 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	github.com/redis/go-redis/v9 v9.9.0 // indirect
+	github.com/soulnvkz/log v0.0.0-00010101000000-000000000000 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -4,69 +4,97 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/soulnvkz/llm/internal/llama"
-	mqc "github.com/soulnvkz/llm/internal/mq"
+	"github.com/soulnvkz/llm/worker"
 	"github.com/soulnvkz/mq"
 )
 
-func Getenv(env string) (v string) {
-	v, f := os.LookupEnv(env)
-	if !f {
-		log.Fatalf("ENV %s should be specifed", env)
-	}
-	return
-}
-
-func main() {
-	model := Getenv("MODEL_PATH")
+// newTransport connects to the broker selected by MQ_TRANSPORT, it is RabbitMQ by default.
+// The returned function closes the transport and its connections
+func newTransport() (mq.Transport, func()) {
+	switch kind := os.Getenv("MQ_TRANSPORT"); kind {
+	case "", "rabbitmq":
+		mq_user := worker.Getenv("MQ_USER")
+		mq_password := worker.Getenv("MQ_PASSWORD")
+		mq_host := worker.Getenv("MQ_HOST")
+		mq_port := worker.Getenv("MQ_PORT")
 
-	mq_user := Getenv("MQ_USER")
-	mq_password := Getenv("MQ_PASSWORD")
-	mq_host := Getenv("MQ_HOST")
-	mq_port := Getenv("MQ_PORT")
+		mq_cancel_ex := worker.Getenv("MQ_CANCEL_EX")
 
-	mq_cancel_ex := Getenv("MQ_CANCEL_EX")
-	mq_llm_q := Getenv("MQ_LLM_Q")
+		qconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
+		if err != nil {
+			log.Panicf("%s, failed to connect to RabbitMQ", err)
+		}
+		pqconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
+		if err != nil {
+			log.Panicf("%s, failed to connect to RabbitMQ", err)
+		}
 
-	llm := llama.NewLLM(context.Background())
-	llm.Initilize(model)
-	defer llm.Clean()
+		transport, err := mq.NewRabbitMQ(qconn, pqconn, mq.RabbitMQConfig{
+			CancelEx: mq_cancel_ex,
+		})
+		if err != nil {
+			log.Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			pqconn.Close()
+			qconn.Close()
+		}
+	case "nats":
+		nc, err := mq.NATSConnect(worker.Getenv("NATS_URL"), 20)
+		if err != nil {
+			log.Panicf("%s, failed to connect to NATS", err)
+		}
 
-	qconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
-	if err != nil {
-		log.Panicf("%s, failed to connect to RabbitMQ", err)
-	}
-	defer qconn.Close()
+		transport, err := mq.NewNATS(nc, mq.NATSConfig{
+			Stream: worker.Getenv("NATS_STREAM"),
+			Prefix: worker.Getenv("NATS_PREFIX"),
+		})
+		if err != nil {
+			log.Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			nc.Close()
+		}
+	case "redis":
+		rdb, err := mq.RedisConnect(worker.Getenv("REDIS_URL"), 20)
+		if err != nil {
+			log.Panicf("%s, failed to connect to Redis", err)
+		}
 
-	pqconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
-	if err != nil {
-		log.Panicf("%s, failed to connect to RabbitMQ", err)
+		transport, err := mq.NewRedis(rdb, mq.RedisConfig{
+			Prefix: worker.Getenv("REDIS_PREFIX"),
+		})
+		if err != nil {
+			log.Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			rdb.Close()
+		}
+	case "inproc":
+		// the worker binary has no server to take the requests of the in-process transport
+		log.Panicf("in-process transport is served by the dev command, it runs the server and the worker in one process")
+		return nil, nil
+	default:
+		log.Panicf("unsupported transport %s", kind)
+		return nil, nil
 	}
-	defer pqconn.Close()
-
-	mqllm, err := mqc.NewMQllm(qconn, pqconn, mqc.MQConfig{
-		CancelExKey: mq_cancel_ex,
-		ReqQKey:     mq_llm_q,
-	})
-	if err != nil {
-		log.Panicf("%s, failed to initilize mq", err)
-	}
-	defer mqllm.Close()
+}
 
-	ctx := context.WithoutCancel(context.Background())
+func main() {
+	// ctx is done on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	pbuilder := llama.NewPromptBuilder(llm)
+	transport, closeTransport := newTransport()
+	defer closeTransport()
 
-	completionsDone, err := mqllm.ConsumeCompletionsRequests(ctx, pbuilder, llm)
-	if err != nil {
-		log.Panicf("%s, failed to start consume completions", err)
+	if err := worker.Run(ctx, transport); err != nil {
+		log.Panicf("%s, worker has stopped", err)
 	}
-	cancellationsDone, err := mqllm.ConsumeCancellations(ctx, llm)
-	if err != nil {
-		log.Panicf("%s, failed to start consume cancellations", err)
-	}
-
-	<-completionsDone
-	<-cancellationsDone
 }
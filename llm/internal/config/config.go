@@ -0,0 +1,294 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/soulnvkz/llm/internal/llama"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv is the env with the path of the optional config file
+const ConfigFileEnv = "LLM_CONFIG"
+
+// Config is the worker config. Every field is set by the env named after its json key in upper case,
+// or by the env tag, env overrides the config file
+type Config struct {
+	llama.Config
+
+	Model string `json:"model" env:"MODEL_PATH"`
+	// DraftModel enables speculative decoding
+	DraftModel string `json:"draft_model" env:"DRAFT_MODEL_PATH"`
+	DraftN     int    `json:"draft_n"`
+	// DraftNGPULayers and the draft threads are of the draft model, the main model settings are not used
+	DraftNGPULayers   int `json:"draft_n_gpu_layers"`
+	DraftThreads      int `json:"draft_threads"`
+	DraftThreadsBatch int `json:"draft_threads_batch"`
+
+	// ChatTemplate is the name of built-in template, ChatGoTemplate is go text/template file and
+	// ChatJinjaTemplate is jinja template file, they override the model chat template
+	ChatTemplate      string `json:"chat_template"`
+	ChatGoTemplate    string `json:"chat_go_template"`
+	ChatJinjaTemplate string `json:"chat_jinja_template"`
+
+	// LoraAdapters is the list of LoRA adapters: name=path,name=path
+	LoraAdapters string `json:"lora_adapters"`
+
+	// ShutdownTimeout is the number of seconds the current request can take to finish on shutdown
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// HealthAddr is the address of the health probes listener, it is disabled if empty
+	HealthAddr string `json:"health_addr"`
+}
+
+// Draft is the config of the draft model
+func (c Config) Draft() llama.DraftConfig {
+	return llama.DraftConfig{
+		NDraft:       c.DraftN,
+		NGPULayers:   c.DraftNGPULayers,
+		Threads:      c.DraftThreads,
+		ThreadsBatch: c.DraftThreadsBatch,
+	}
+}
+
+// Adapter is LoRA adapter of the model
+type Adapter struct {
+	Name string
+	Path string
+}
+
+// Adapters parses the list of LoRA adapters
+func (c Config) Adapters() ([]Adapter, error) {
+	adapters := make([]Adapter, 0)
+	names := make(map[string]bool)
+	for _, item := range strings.Split(c.LoraAdapters, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		name, path, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		path = strings.TrimSpace(path)
+		if !ok || len(name) == 0 || len(path) == 0 {
+			return nil, fmt.Errorf("adapter should be name=path, got %q", item)
+		}
+		if strings.ContainsAny(name, ". ") {
+			return nil, fmt.Errorf("adapter name %q should not contain dots and spaces", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("adapter %s is listed twice", name)
+		}
+		names[name] = true
+		adapters = append(adapters, Adapter{Name: name, Path: path})
+	}
+	return adapters, nil
+}
+
+func Default() Config {
+	return Config{
+		Config: llama.DefaultConfig(),
+		DraftN: llama.DefaultDraftTokens,
+
+		ShutdownTimeout: 30,
+		HealthAddr:      ":8081",
+	}
+}
+
+// Load reads the config file if it is set, then the env
+func Load() (Config, error) {
+	c := Default()
+
+	if path, ok := os.LookupEnv(ConfigFileEnv); ok {
+		if err := c.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := c.readEnv(); err != nil {
+		return Config{}, err
+	}
+
+	return c, c.Validate()
+}
+
+func (c Config) Validate() error {
+	if len(c.Model) == 0 {
+		return errors.New("model path should be specified")
+	}
+	templates := 0
+	for _, t := range []string{c.ChatTemplate, c.ChatGoTemplate, c.ChatJinjaTemplate} {
+		if len(t) > 0 {
+			templates++
+		}
+	}
+	if templates > 1 {
+		return errors.New("only one of chat_template, chat_go_template and chat_jinja_template can be specified")
+	}
+	if len(c.DraftModel) > 0 && c.DraftN <= 0 {
+		return errors.New("draft_n should be positive")
+	}
+	if c.DraftNGPULayers < 0 || c.DraftThreads < 0 || c.DraftThreadsBatch < 0 {
+		return errors.New("draft model parameters should not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout should not be negative")
+	}
+	if _, err := c.Adapters(); err != nil {
+		return err
+	}
+	return c.Config.Validate()
+}
+
+// readFile reads json file, other files are read as yaml with a flat mapping of keys
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(path) == ".json" {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		if err := d.Decode(c); err != nil {
+			return fmt.Errorf("%w, failed to read config %s", err, path)
+		}
+		return nil
+	}
+
+	values, err := parseYAML(data)
+	if err != nil {
+		return fmt.Errorf("%w, failed to read config %s", err, path)
+	}
+	fields := c.fields()
+	for key, value := range values {
+		f, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown config key %s", key)
+		}
+		if err := setValue(f.value, value); err != nil {
+			return fmt.Errorf("%w, invalid value of %s", err, key)
+		}
+	}
+	return nil
+}
+
+func (c *Config) readEnv() error {
+	for _, f := range c.fields() {
+		value, ok := os.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, value); err != nil {
+			return fmt.Errorf("%w, invalid value of %s", err, f.env)
+		}
+	}
+	return nil
+}
+
+type field struct {
+	env   string
+	value reflect.Value
+}
+
+// fields maps json keys to the config fields, embedded structs are flattened
+func (c *Config) fields() map[string]field {
+	fields := make(map[string]field)
+
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i))
+				continue
+			}
+
+			key, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+			if len(key) == 0 || key == "-" {
+				continue
+			}
+			env := sf.Tag.Get("env")
+			if len(env) == 0 {
+				env = strings.ToUpper(key)
+			}
+			fields[key] = field{env: env, value: v.Field(i)}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem())
+
+	return fields
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Float32:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Kind())
+	}
+	return nil
+}
+
+// parseYAML reads the mapping of the config keys to their values, the values are scalars
+func parseYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// the empty file has no document
+	if len(doc.Content) == 0 {
+		return values, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: mapping of the config keys expected", root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: nested values are not supported", key.Line)
+		}
+		if _, ok := values[key.Value]; ok {
+			return nil, fmt.Errorf("line %d: key %s is set twice", key.Line, key.Value)
+		}
+
+		// the key without value is empty
+		if value.Tag == "!!null" {
+			values[key.Value] = ""
+			continue
+		}
+		values[key.Value] = value.Value
+	}
+
+	return values, nil
+}
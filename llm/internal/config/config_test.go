@@ -0,0 +1,151 @@
+package config
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var parseYAMLTests = []struct {
+	name   string
+	data   string
+	values map[string]string
+	err    string
+}{
+	{
+		name:   "plain scalars",
+		data:   "model: /models/m.gguf\nn_ctx: 4096\nuse_mmap: true\nrope_freq_base: 0.5\n",
+		values: map[string]string{"model": "/models/m.gguf", "n_ctx": "4096", "use_mmap": "true", "rope_freq_base": "0.5"},
+	},
+	{
+		name:   "quoted scalars",
+		data:   "health_addr: \":8081\"\nchat_template: 'it''s'\nlora_adapters: \"a=/a.gguf\\tb\"\n",
+		values: map[string]string{"health_addr": ":8081", "chat_template": "it's", "lora_adapters": "a=/a.gguf\tb"},
+	},
+	{
+		name:   "comments",
+		data:   "# worker config\nmodel: /m.gguf # the model\nhealth_addr: \"# not a comment\"\n",
+		values: map[string]string{"model": "/m.gguf", "health_addr": "# not a comment"},
+	},
+	{
+		name:   "document marker",
+		data:   "---\nmodel: /m.gguf\n",
+		values: map[string]string{"model": "/m.gguf"},
+	},
+	{
+		name:   "key without value",
+		data:   "rope_scaling:\nchat_template: ~\n",
+		values: map[string]string{"rope_scaling": "", "chat_template": ""},
+	},
+	{
+		name:   "empty file",
+		data:   "# nothing is set\n",
+		values: map[string]string{},
+	},
+	{
+		name: "nested keys",
+		data: "model:\n  path: /m.gguf\n",
+		err:  "line 1: nested values are not supported",
+	},
+	{
+		name: "list",
+		data: "lora_adapters:\n  - a=/a.gguf\n",
+		err:  "line 1: nested values are not supported",
+	},
+	{
+		name: "flow list",
+		data: "lora_adapters: [a=/a.gguf]\n",
+		err:  "line 1: nested values are not supported",
+	},
+	{
+		name: "bad indentation",
+		data: "model: /m.gguf\n  n_ctx: 4096\n",
+		err:  "mapping values are not allowed",
+	},
+	{
+		name: "unterminated quote",
+		data: "model: \"/m.gguf\n",
+		err:  "found unexpected end of stream",
+	},
+	{
+		name: "not a mapping",
+		data: "- model\n",
+		err:  "line 1: mapping of the config keys expected",
+	},
+	{
+		name: "duplicate key",
+		data: "model: /a.gguf\nmodel: /b.gguf\n",
+		err:  "line 2: key model is set twice",
+	},
+}
+
+func TestParseYAML(t *testing.T) {
+	for _, tt := range parseYAMLTests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := parseYAML([]byte(tt.data))
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(values, tt.values) {
+				t.Errorf("values mismatch\ngot:  %v\nwant: %v", values, tt.values)
+			}
+		})
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "model: /file.gguf\nn_ctx: 2048\nn_batch: 256\nhealth_addr: \":9000\"\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ConfigFileEnv, path)
+	// the env tag and the upper case key are both read
+	t.Setenv("MODEL_PATH", "/env.gguf")
+	t.Setenv("N_CTX", "4096")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Model != "/env.gguf" || c.NCtx != 4096 {
+		t.Errorf("expected env to override the file, got model %s and n_ctx %d", c.Model, c.NCtx)
+	}
+	if c.NBatch != 256 || c.HealthAddr != ":9000" {
+		t.Errorf("expected the file to override the defaults, got n_batch %d and health_addr %s", c.NBatch, c.HealthAddr)
+	}
+	if c.ShutdownTimeout != Default().ShutdownTimeout {
+		t.Errorf("expected the default shutdown_timeout, got %d", c.ShutdownTimeout)
+	}
+}
+
+func TestLoadRejectsUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("model: /m.gguf\nn_ctxx: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ConfigFileEnv, path)
+
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "unknown config key n_ctxx") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestValidateRejectsSeveralTemplates(t *testing.T) {
+	c := Default()
+	c.Model = "/m.gguf"
+	c.ChatGoTemplate = "/t.tmpl"
+	c.ChatJinjaTemplate = "/t.jinja"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "only one of chat_template") {
+		t.Fatalf("expected template error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package health
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Check returns an error if the part of the worker does not work
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Report is the response of the probes
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+	// Details describe the worker, they do not affect the status
+	Details any `json:"details,omitempty"`
+}
+
+// Health serves the probes: /healthz fails if the worker should be restarted,
+// /readyz fails if the worker can't take the requests
+type Health struct {
+	live    []namedCheck
+	ready   []namedCheck
+	details func() any
+}
+
+func New(details func() any) *Health {
+	return &Health{
+		details: details,
+	}
+}
+
+// Live adds the check to both probes
+func (h *Health) Live(name string, check Check) *Health {
+	h.live = append(h.live, namedCheck{name: name, check: check})
+	return h.Ready(name, check)
+}
+
+// Ready adds the check to the readiness probe
+func (h *Health) Ready(name string, check Check) *Health {
+	h.ready = append(h.ready, namedCheck{name: name, check: check})
+	return h
+}
+
+func (h *Health) Handler() http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.probe(w, h.live)
+	})
+	router.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.probe(w, h.ready)
+	})
+	return router
+}
+
+func (h *Health) probe(w http.ResponseWriter, checks []namedCheck) {
+	report := Report{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+	}
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			report.Status = "fail"
+			report.Checks[c.name] = err.Error()
+			continue
+		}
+		report.Checks[c.name] = "ok"
+	}
+	if h.details != nil {
+		report.Details = h.details()
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("%s, failed to write health report", err)
+	}
+}
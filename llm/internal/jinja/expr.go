@@ -0,0 +1,982 @@
+package jinja
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	endToken tokenKind = iota
+	nameToken
+	stringToken
+	intToken
+	floatToken
+	opToken
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+}
+
+// keywords are the names of the operators, they are not variables
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "is": true, "if": true, "else": true,
+}
+
+// operators are matched longest first
+var operators = []string{
+	"==", "!=", "<=", ">=", "//", "**",
+	"(", ")", "[", "]", "{", "}", ".", ",", ":", "|", "~", "+", "-", "*", "/", "%", "<", ">", "=",
+}
+
+func tokenize(text string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(text) && (text[j] == '_' || isLetter(text[j]) || isDigit(text[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: nameToken, val: text[i:j]})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(text) && isDigit(text[j]) {
+				j++
+			}
+			kind := intToken
+			if j+1 < len(text) && text[j] == '.' && isDigit(text[j+1]) {
+				kind = floatToken
+				j++
+				for j < len(text) && isDigit(text[j]) {
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind: kind, val: text[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			s, n, err := unquote(text[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: stringToken, val: s})
+			i += n
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(text[i:], op) {
+					tokens = append(tokens, token{kind: opToken, val: op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// unquote reads the string literal with python escapes, returns the string and the length of the literal
+func unquote(text string) (string, int, error) {
+	quote := text[0]
+	var b strings.Builder
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(text):
+			i++
+			switch text[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '\'', '"':
+				b.WriteByte(text[i])
+			default:
+				// the unknown escape is kept as in python
+				b.WriteByte('\\')
+				b.WriteByte(text[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("string is not closed with %c", quote)
+}
+
+// exprParser parses the expressions of the tag
+type exprParser struct {
+	tokens []token
+	pos    int
+	line   int
+}
+
+func newExprParser(text string, line int) (*exprParser, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", line, err)
+	}
+	return &exprParser{tokens: tokens, line: line}, nil
+}
+
+func (p *exprParser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{kind: endToken}
+}
+
+func (p *exprParser) next() token {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+// accept takes the operator if it is next
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == opToken && t.val == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// acceptName takes the name if it is next
+func (p *exprParser) acceptName(name string) bool {
+	if t := p.peek(); t.kind == nameToken && t.val == name {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("%s expected", op)
+	}
+	return nil
+}
+
+// end checks nothing is left in the tag
+func (p *exprParser) end() error {
+	if t := p.peek(); t.kind != endToken {
+		return p.errorf("unexpected %s", t.val)
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// parseAll parses the expression which is the rest of the tag
+func (p *exprParser) parseAll() (expr, error) {
+	x, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return x, p.end()
+}
+
+// parseExpr parses the conditional expression, it is undefined if the condition is false without else
+func (p *exprParser) parseExpr() (expr, error) {
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("if") {
+		c := &condExpr{then: x}
+		c.cond, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.acceptName("else") {
+			c.orelse, err = p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+		}
+		x = c
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("or") {
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: "or", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("and") {
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: "and", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseNot() (expr, error) {
+	if p.acceptName("not") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "not", x: x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (expr, error) {
+	x, err := p.parseMath1()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		t := p.peek()
+		switch {
+		case t.kind == opToken && (t.val == "==" || t.val == "!=" || t.val == "<" || t.val == ">" || t.val == "<=" || t.val == ">="):
+			op = t.val
+			p.pos++
+		case t.kind == nameToken && t.val == "in":
+			op = "in"
+			p.pos++
+		case t.kind == nameToken && t.val == "not" && p.pos+1 < len(p.tokens) &&
+			p.tokens[p.pos+1].kind == nameToken && p.tokens[p.pos+1].val == "in":
+			op = "not in"
+			p.pos += 2
+		default:
+			return x, nil
+		}
+		y, err := p.parseMath1()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseMath1() (expr, error) {
+	x, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != opToken || (t.val != "+" && t.val != "-") {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: t.val, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseConcat() (expr, error) {
+	x, err := p.parseMath2()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("~") {
+		y, err := p.parseMath2()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: "~", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseMath2() (expr, error) {
+	x, err := p.parsePow()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != opToken || (t.val != "*" && t.val != "/" && t.val != "//" && t.val != "%") {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.parsePow()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: t.val, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parsePow() (expr, error) {
+	x, err := p.parseUnary(true)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("**") {
+		y, err := p.parseUnary(true)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: "**", x: x, y: y}
+	}
+	return x, nil
+}
+
+// parseUnary parses the sign, the operand and its filters, the filters of the signed operand
+// are applied to the signed value as in jinja
+func (p *exprParser) parseUnary(filters bool) (expr, error) {
+	var x expr
+	var err error
+	switch {
+	case p.accept("-"):
+		x, err = p.parseUnary(false)
+		x = &unaryExpr{op: "-", x: x}
+	case p.accept("+"):
+		x, err = p.parseUnary(false)
+		x = &unaryExpr{op: "+", x: x}
+	default:
+		x, err = p.parsePrimary()
+		if err == nil {
+			x, err = p.parsePostfix(x)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filters {
+		return p.parseFilters(x)
+	}
+	return x, nil
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case nameToken:
+		switch t.val {
+		case "true", "True":
+			return literal{v: true}, nil
+		case "false", "False":
+			return literal{v: false}, nil
+		case "none", "None":
+			return literal{v: nil}, nil
+		}
+		if keywords[t.val] {
+			return nil, p.errorf("unexpected %s", t.val)
+		}
+		return nameExpr(t.val), nil
+	case stringToken:
+		// the adjacent strings are joined
+		s := t.val
+		for p.peek().kind == stringToken {
+			s += p.next().val
+		}
+		return literal{v: s}, nil
+	case intToken:
+		n, err := strconv.Atoi(t.val)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		return literal{v: n}, nil
+	case floatToken:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		return literal{v: f}, nil
+	case opToken:
+		switch t.val {
+		case "(":
+			items, err := p.parseItems(")")
+			if err != nil {
+				return nil, err
+			}
+			// the parenthesized expression without comma is not a tuple
+			if len(items.items) == 1 && !items.tuple {
+				return items.items[0], nil
+			}
+			return &listExpr{items: items.items}, nil
+		case "[":
+			items, err := p.parseItems("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listExpr{items: items.items}, nil
+		case "{":
+			return p.parseDict()
+		}
+	case endToken:
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %s", t.val)
+}
+
+type items struct {
+	items []expr
+	// tuple is set if the items have a comma
+	tuple bool
+}
+
+// parseItems parses the expressions separated by commas until the closing
+func (p *exprParser) parseItems(closing string) (items, error) {
+	var list items
+	for !p.accept(closing) {
+		if len(list.items) > 0 {
+			if err := p.expect(","); err != nil {
+				return items{}, err
+			}
+			list.tuple = true
+			if p.accept(closing) {
+				break
+			}
+		}
+		x, err := p.parseExpr()
+		if err != nil {
+			return items{}, err
+		}
+		list.items = append(list.items, x)
+	}
+	return list, nil
+}
+
+func (p *exprParser) parseDict() (expr, error) {
+	d := &dictExpr{}
+	for !p.accept("}") {
+		if len(d.keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		k, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		d.keys = append(d.keys, k)
+		d.values = append(d.values, v)
+	}
+	return d, nil
+}
+
+// parsePostfix parses the attributes, the subscripts and the calls of the operand
+func (p *exprParser) parsePostfix(x expr) (expr, error) {
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != nameToken && t.kind != intToken {
+				return nil, p.errorf("attribute name expected")
+			}
+			x = &attrExpr{x: x, name: t.val}
+		case p.accept("["):
+			s, err := p.parseSubscript(x)
+			if err != nil {
+				return nil, err
+			}
+			x = s
+		case p.accept("("):
+			args, kwargs, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			x = &callExpr{fn: x, args: args, kwargs: kwargs}
+		default:
+			return x, nil
+		}
+	}
+}
+
+// parseSubscript parses the index or the slice after [
+func (p *exprParser) parseSubscript(x expr) (expr, error) {
+	var bounds [3]expr
+	n := 0
+	slice := false
+	for {
+		if t := p.peek(); !(t.kind == opToken && (t.val == ":" || t.val == "]")) {
+			b, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			bounds[n] = b
+		}
+		if p.accept("]") {
+			break
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		slice = true
+		n++
+		if n > 2 {
+			return nil, p.errorf("slice has too many bounds")
+		}
+	}
+
+	if !slice {
+		if bounds[0] == nil {
+			return nil, p.errorf("index expected")
+		}
+		return &indexExpr{x: x, index: bounds[0]}, nil
+	}
+	return &sliceExpr{x: x, start: bounds[0], stop: bounds[1], step: bounds[2]}, nil
+}
+
+// parseArgs parses the arguments of the call after (, the keyword arguments follow the positional ones
+func (p *exprParser) parseArgs() ([]expr, map[string]expr, error) {
+	args := make([]expr, 0)
+	kwargs := make(map[string]expr)
+	for !p.accept(")") {
+		if len(args)+len(kwargs) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, nil, err
+			}
+			if p.accept(")") {
+				break
+			}
+		}
+
+		t := p.peek()
+		if t.kind == nameToken && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == opToken && p.tokens[p.pos+1].val == "=" {
+			p.pos += 2
+			v, err := p.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs[t.val] = v
+			continue
+		}
+		if len(kwargs) > 0 {
+			return nil, nil, p.errorf("positional argument follows keyword argument")
+		}
+		v, err := p.parseExpr()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	return args, kwargs, nil
+}
+
+// parseFilters parses the filters and the tests of the operand
+func (p *exprParser) parseFilters(x expr) (expr, error) {
+	for {
+		switch {
+		case p.accept("|"):
+			name := p.next()
+			if name.kind != nameToken {
+				return nil, p.errorf("filter name expected")
+			}
+			if _, ok := filters[name.val]; !ok {
+				return nil, p.errorf("unsupported filter %s", name.val)
+			}
+			f := &filterExpr{x: x, name: name.val, kwargs: map[string]expr{}}
+			if p.accept("(") {
+				var err error
+				f.args, f.kwargs, err = p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+			}
+			x = f
+		case p.acceptName("is"):
+			t := &testExpr{x: x}
+			t.negate = p.acceptName("not")
+			name := p.next()
+			if name.kind != nameToken {
+				return nil, p.errorf("test name expected")
+			}
+			// none and true are the names of the tests as well
+			t.name = strings.ToLower(name.val)
+			if _, ok := tests[t.name]; !ok {
+				return nil, p.errorf("unsupported test %s", name.val)
+			}
+			if p.accept("(") {
+				var err error
+				var kwargs map[string]expr
+				t.args, kwargs, err = p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				if len(kwargs) > 0 {
+					return nil, p.errorf("test %s has no keyword arguments", name.val)
+				}
+			}
+			x = t
+		default:
+			return x, nil
+		}
+	}
+}
+
+type expr interface {
+	eval(s *scope) (any, error)
+}
+
+type literal struct {
+	v any
+}
+
+func (x literal) eval(s *scope) (any, error) {
+	return x.v, nil
+}
+
+type nameExpr string
+
+func (x nameExpr) eval(s *scope) (any, error) {
+	if v, ok := s.lookup(string(x)); ok {
+		return v, nil
+	}
+	if v, ok := globals[string(x)]; ok {
+		return v, nil
+	}
+	return undefined{name: string(x)}, nil
+}
+
+type attrExpr struct {
+	x    expr
+	name string
+}
+
+func (x *attrExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return getAttr(v, x.name), nil
+}
+
+type indexExpr struct {
+	x     expr
+	index expr
+}
+
+func (x *indexExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	i, err := x.index.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return getItem(v, i), nil
+}
+
+type sliceExpr struct {
+	x                 expr
+	start, stop, step expr
+}
+
+func (x *sliceExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	var bounds [3]*int
+	for i, b := range []expr{x.start, x.stop, x.step} {
+		if b == nil {
+			continue
+		}
+		bv, err := b.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		if bv == nil {
+			continue
+		}
+		n, ok := bv.(int)
+		if !ok {
+			return nil, fmt.Errorf("slice bound should be int, got %s", typeName(bv))
+		}
+		bounds[i] = &n
+	}
+	return slice(v, bounds[0], bounds[1], bounds[2])
+}
+
+type callExpr struct {
+	fn     expr
+	args   []expr
+	kwargs map[string]expr
+}
+
+func (x *callExpr) eval(s *scope) (any, error) {
+	args, kwargs, err := evalArgs(s, x.args, x.kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the attribute call is the method of the value
+	if a, ok := x.fn.(*attrExpr); ok {
+		v, err := a.x.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := getAttr(v, a.name).(function); ok {
+			return f(args, kwargs)
+		}
+		return callMethod(v, a.name, args, kwargs)
+	}
+
+	fn, err := x.fn.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fn.(function)
+	if !ok {
+		if u, ok := fn.(undefined); ok {
+			return nil, fmt.Errorf("%s is undefined", u.name)
+		}
+		return nil, fmt.Errorf("%s is not callable", typeName(fn))
+	}
+	return f(args, kwargs)
+}
+
+func evalArgs(s *scope, xargs []expr, xkwargs map[string]expr) ([]any, map[string]any, error) {
+	args := make([]any, 0, len(xargs))
+	for _, a := range xargs {
+		v, err := a.eval(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	kwargs := make(map[string]any, len(xkwargs))
+	for k, a := range xkwargs {
+		v, err := a.eval(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		kwargs[k] = v
+	}
+	return args, kwargs, nil
+}
+
+type filterExpr struct {
+	x      expr
+	name   string
+	args   []expr
+	kwargs map[string]expr
+}
+
+func (x *filterExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	args, kwargs, err := evalArgs(s, x.args, x.kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return filters[x.name](v, args, kwargs)
+}
+
+type testExpr struct {
+	x      expr
+	name   string
+	args   []expr
+	negate bool
+}
+
+func (x *testExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	args, _, err := evalArgs(s, x.args, nil)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tests[x.name](v, args)
+	if err != nil {
+		return nil, err
+	}
+	return ok != x.negate, nil
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+func (x *unaryExpr) eval(s *scope) (any, error) {
+	v, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "not":
+		return !truthy(v), nil
+	case "-":
+		return arithmetic("-", 0, v)
+	default:
+		return arithmetic("+", 0, v)
+	}
+}
+
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+func (x *binaryExpr) eval(s *scope) (any, error) {
+	a, err := x.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	// the logical operators return the operand which decides as in python
+	switch x.op {
+	case "and":
+		if !truthy(a) {
+			return a, nil
+		}
+		return x.y.eval(s)
+	case "or":
+		if truthy(a) {
+			return a, nil
+		}
+		return x.y.eval(s)
+	}
+
+	b, err := x.y.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return equal(a, b), nil
+	case "!=":
+		return !equal(a, b), nil
+	case "<", ">", "<=", ">=":
+		c, err := compare(a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "<":
+			return c < 0, nil
+		case ">":
+			return c > 0, nil
+		case "<=":
+			return c <= 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		return contains(b, a)
+	case "not in":
+		ok, err := contains(b, a)
+		return !ok, err
+	case "~":
+		return toString(a) + toString(b), nil
+	}
+	return arithmetic(x.op, a, b)
+}
+
+type condExpr struct {
+	then, cond, orelse expr
+}
+
+func (x *condExpr) eval(s *scope) (any, error) {
+	c, err := x.cond.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(c) {
+		return x.then.eval(s)
+	}
+	if x.orelse == nil {
+		return undefined{}, nil
+	}
+	return x.orelse.eval(s)
+}
+
+type listExpr struct {
+	items []expr
+}
+
+func (x *listExpr) eval(s *scope) (any, error) {
+	list := make([]any, 0, len(x.items))
+	for _, item := range x.items {
+		v, err := item.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type dictExpr struct {
+	keys, values []expr
+}
+
+func (x *dictExpr) eval(s *scope) (any, error) {
+	d := make(map[string]any, len(x.keys))
+	for i := range x.keys {
+		k, err := x.keys[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key should be string, got %s", typeName(k))
+		}
+		v, err := x.values[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		d[key] = v
+	}
+	return d, nil
+}
@@ -0,0 +1,220 @@
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scope is the variables of the template, every loop iteration has its own scope,
+// so the variables set in the loop are not seen after it as in jinja
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (any, bool) {
+	for c := s; c != nil; c = c.parent {
+		if v, ok := c.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type node interface {
+	render(b *strings.Builder, s *scope) error
+}
+
+func renderNodes(b *strings.Builder, nodes []node, s *scope) error {
+	for _, n := range nodes {
+		if err := n.render(b, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type textNode string
+
+func (n textNode) render(b *strings.Builder, s *scope) error {
+	b.WriteString(string(n))
+	return nil
+}
+
+type outputNode struct {
+	x    expr
+	line int
+}
+
+func (n *outputNode) render(b *strings.Builder, s *scope) error {
+	v, err := n.x.eval(s)
+	if err != nil {
+		return lineError(n.line, err)
+	}
+	b.WriteString(toString(v))
+	return nil
+}
+
+type ifNode struct {
+	conds  []expr
+	bodies [][]node
+	orelse []node
+	// lines are the lines of the conditions
+	lines []int
+}
+
+func (n *ifNode) render(b *strings.Builder, s *scope) error {
+	for i, cond := range n.conds {
+		v, err := cond.eval(s)
+		if err != nil {
+			return lineError(n.lines[i], err)
+		}
+		if truthy(v) {
+			return renderNodes(b, n.bodies[i], s)
+		}
+	}
+	return renderNodes(b, n.orelse, s)
+}
+
+type forNode struct {
+	targets []string
+	iter    expr
+	// filter skips the items, the loop variable counts only the items which are not skipped
+	filter expr
+	body   []node
+	orelse []node
+	line   int
+}
+
+func (n *forNode) render(b *strings.Builder, s *scope) error {
+	v, err := n.iter.eval(s)
+	if err != nil {
+		return lineError(n.line, err)
+	}
+	items, err := iterate(v)
+	if err != nil {
+		return lineError(n.line, err)
+	}
+
+	if n.filter != nil {
+		kept := make([]any, 0, len(items))
+		for _, item := range items {
+			is, err := n.bind(s, item)
+			if err != nil {
+				return err
+			}
+			ok, err := n.filter.eval(is)
+			if err != nil {
+				return lineError(n.line, err)
+			}
+			if truthy(ok) {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+
+	if len(items) == 0 {
+		return renderNodes(b, n.orelse, s)
+	}
+	for i, item := range items {
+		is, err := n.bind(s, item)
+		if err != nil {
+			return err
+		}
+		is.vars["loop"] = map[string]any{
+			"index":     i + 1,
+			"index0":    i,
+			"revindex":  len(items) - i,
+			"revindex0": len(items) - i - 1,
+			"first":     i == 0,
+			"last":      i == len(items)-1,
+			"length":    len(items),
+		}
+		if err := renderNodes(b, n.body, is); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bind makes the scope of the iteration with the loop variables, the item is unpacked to several of them
+func (n *forNode) bind(s *scope, item any) (*scope, error) {
+	is := &scope{vars: make(map[string]any), parent: s}
+	if len(n.targets) == 1 {
+		is.vars[n.targets[0]] = item
+		return is, nil
+	}
+
+	values, ok := item.([]any)
+	if !ok || len(values) != len(n.targets) {
+		return nil, fmt.Errorf("line %d: %s can't be unpacked to %d variables", n.line, typeName(item), len(n.targets))
+	}
+	for i, name := range n.targets {
+		is.vars[name] = values[i]
+	}
+	return is, nil
+}
+
+type setNode struct {
+	name string
+	// attr is set for the attribute of the namespace
+	attr string
+	x    expr
+	// body is the block of the block set
+	body []node
+	line int
+}
+
+func (n *setNode) render(b *strings.Builder, s *scope) error {
+	var v any
+	if n.body != nil {
+		var bb strings.Builder
+		if err := renderNodes(&bb, n.body, s); err != nil {
+			return err
+		}
+		v = bb.String()
+	} else {
+		var err error
+		v, err = n.x.eval(s)
+		if err != nil {
+			return lineError(n.line, err)
+		}
+	}
+
+	if len(n.attr) == 0 {
+		s.vars[n.name] = v
+		return nil
+	}
+	target, _ := s.lookup(n.name)
+	ns, ok := target.(*namespace)
+	if !ok {
+		return fmt.Errorf("line %d: attribute can be set only on namespace, %s is %s", n.line, n.name, typeName(target))
+	}
+	ns.vars[n.attr] = v
+	return nil
+}
+
+// blockNode renders the body of the block tag as is
+type blockNode []node
+
+func (n blockNode) render(b *strings.Builder, s *scope) error {
+	return renderNodes(b, n, s)
+}
+
+// exception is raised by the template, the message is not prefixed with the line
+type exception struct {
+	message string
+}
+
+func (e *exception) Error() string {
+	return e.message
+}
+
+// lineError prefixes the error of the expression with the line of its tag
+func lineError(line int, err error) error {
+	if _, ok := err.(*exception); ok {
+		return err
+	}
+	return fmt.Errorf("line %d: %w", line, err)
+}
@@ -0,0 +1,432 @@
+// Package jinja renders the subset of jinja the chat templates of the models use: output, if, for
+// and set tags, comments and whitespace control, the expressions with filters, tests and the methods
+// of strings and mappings, loop variables, namespace and raise_exception. The templates are parsed
+// with trim_blocks and lstrip_blocks as transformers parses the chat templates
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is the parsed template, it can be executed concurrently
+type Template struct {
+	nodes []node
+}
+
+// Parse parses the template text, the tags and the filters out of the subset are rejected
+func Parse(text string) (*Template, error) {
+	segments, err := split(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{segments: segments}
+	nodes, _, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+// Execute renders the template with the variables, the variables are not changed by set tags
+func (t *Template) Execute(vars map[string]any) (string, error) {
+	var b strings.Builder
+	s := &scope{
+		vars:   make(map[string]any),
+		parent: &scope{vars: vars},
+	}
+	if err := renderNodes(&b, t.nodes, s); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+type segmentKind int
+
+const (
+	textSegment segmentKind = iota
+	outputSegment
+	tagSegment
+	commentSegment
+)
+
+// segment is the text or the tag of the template
+type segment struct {
+	kind segmentKind
+	text string
+	line int
+	// trimLeft and trimRight are set by the - markers, the whitespace next to the tag is removed
+	trimLeft  bool
+	trimRight bool
+	// keepLeft and keepRight are set by the + markers, lstrip_blocks and trim_blocks are disabled
+	keepLeft  bool
+	keepRight bool
+}
+
+// split cuts the template into the texts and the tags and applies the whitespace control
+func split(text string) ([]segment, error) {
+	segments := make([]segment, 0)
+	pos, line := 0, 1
+	for pos < len(text) {
+		i := nextTag(text, pos)
+		if i < 0 {
+			segments = append(segments, segment{kind: textSegment, text: text[pos:], line: line})
+			break
+		}
+		if i > pos {
+			segments = append(segments, segment{kind: textSegment, text: text[pos:i], line: line})
+			line += strings.Count(text[pos:i], "\n")
+		}
+
+		s := segment{line: line}
+		closing := ""
+		switch text[i+1] {
+		case '{':
+			s.kind, closing = outputSegment, "}}"
+		case '%':
+			s.kind, closing = tagSegment, "%}"
+		case '#':
+			s.kind, closing = commentSegment, "#}"
+		}
+
+		start := i + 2
+		if start < len(text) {
+			switch text[start] {
+			case '-':
+				s.trimLeft = true
+				start++
+			case '+':
+				s.keepLeft = true
+				start++
+			}
+		}
+		end := closeTag(text, start, closing, s.kind != commentSegment)
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: tag is not closed with %s", line, closing)
+		}
+
+		content := text[start:end]
+		if strings.HasSuffix(content, "-") {
+			s.trimRight = true
+			content = content[:len(content)-1]
+		} else if strings.HasSuffix(content, "+") {
+			s.keepRight = true
+			content = content[:len(content)-1]
+		}
+		s.text = strings.TrimSpace(content)
+		segments = append(segments, s)
+
+		line += strings.Count(text[i:end+2], "\n")
+		pos = end + 2
+	}
+
+	stripWhitespace(segments)
+	return segments, nil
+}
+
+// nextTag is the position of the next tag or -1
+func nextTag(text string, pos int) int {
+	for {
+		i := strings.IndexByte(text[pos:], '{')
+		if i < 0 || pos+i+1 >= len(text) {
+			return -1
+		}
+		i += pos
+		switch text[i+1] {
+		case '{', '%', '#':
+			return i
+		}
+		pos = i + 1
+	}
+}
+
+// closeTag is the position of the closing of the tag, the strings of the expressions are skipped
+func closeTag(text string, pos int, closing string, quoted bool) int {
+	var quote byte
+	for i := pos; i+1 < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case quoted && (c == '\'' || c == '"'):
+			quote = c
+		case text[i:i+2] == closing:
+			return i
+		}
+	}
+	return -1
+}
+
+// stripWhitespace removes the whitespace around the tags. The texts before the tags are stripped first,
+// lstrip_blocks checks the line of the tag before trim_blocks removes the newline of the previous tag
+func stripWhitespace(segments []segment) {
+	for i := 1; i < len(segments); i++ {
+		s, prev := segments[i], &segments[i-1]
+		if s.kind == textSegment || prev.kind != textSegment {
+			continue
+		}
+		switch {
+		case s.trimLeft:
+			prev.text = strings.TrimRight(prev.text, " \t\r\n")
+		case s.kind != outputSegment && !s.keepLeft:
+			// the whitespace of the line is stripped if the tag starts the line
+			nl := strings.LastIndexByte(prev.text, '\n')
+			if nl < 0 && i-1 > 0 {
+				continue
+			}
+			if len(strings.Trim(prev.text[nl+1:], " \t")) == 0 {
+				prev.text = prev.text[:nl+1]
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(segments); i++ {
+		s, next := segments[i], &segments[i+1]
+		if s.kind == textSegment || next.kind != textSegment {
+			continue
+		}
+		switch {
+		case s.trimRight:
+			next.text = strings.TrimLeft(next.text, " \t\r\n")
+		case s.kind != outputSegment && !s.keepRight:
+			// the newline after the tag is removed
+			if strings.HasPrefix(next.text, "\r\n") {
+				next.text = next.text[2:]
+			} else if strings.HasPrefix(next.text, "\n") {
+				next.text = next.text[1:]
+			}
+		}
+	}
+}
+
+// tag is the parsed statement tag
+type tag struct {
+	keyword string
+	line    int
+	expr    *exprParser
+}
+
+type parser struct {
+	segments []segment
+	pos      int
+}
+
+// parseBody parses the nodes until one of the end tags, the end tag is returned.
+// The end of the template returns no tag
+func (p *parser) parseBody(ends ...string) ([]node, *tag, error) {
+	nodes := make([]node, 0)
+	for p.pos < len(p.segments) {
+		s := p.segments[p.pos]
+		p.pos++
+
+		switch s.kind {
+		case textSegment:
+			if len(s.text) > 0 {
+				nodes = append(nodes, textNode(s.text))
+			}
+		case commentSegment:
+		case outputSegment:
+			e, err := newExprParser(s.text, s.line)
+			if err != nil {
+				return nil, nil, err
+			}
+			x, err := e.parseAll()
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, &outputNode{x: x, line: s.line})
+		case tagSegment:
+			e, err := newExprParser(s.text, s.line)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyword := e.next()
+			if keyword.kind != nameToken {
+				return nil, nil, fmt.Errorf("line %d: tag name expected", s.line)
+			}
+			t := &tag{keyword: keyword.val, line: s.line, expr: e}
+			for _, end := range ends {
+				if t.keyword == end {
+					return nodes, t, nil
+				}
+			}
+
+			n, err := p.parseTag(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil, nil
+}
+
+// parseBlock parses the body of the block tag, the block has to be closed with one of the end tags
+func (p *parser) parseBlock(start *tag, ends ...string) ([]node, *tag, error) {
+	nodes, end, err := p.parseBody(ends...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if end == nil {
+		return nil, nil, fmt.Errorf("line %d: %s is not closed with %s", start.line, start.keyword, ends[len(ends)-1])
+	}
+	if err := end.expr.end(); err != nil {
+		return nil, nil, err
+	}
+	return nodes, end, nil
+}
+
+func (p *parser) parseTag(t *tag) (node, error) {
+	switch t.keyword {
+	case "if":
+		return p.parseIf(t)
+	case "for":
+		return p.parseFor(t)
+	case "set":
+		return p.parseSet(t)
+	case "generation":
+		// the generation block of transformers marks the assistant tokens, it is rendered as is
+		if err := t.expr.end(); err != nil {
+			return nil, err
+		}
+		body, _, err := p.parseBlock(t, "endgeneration")
+		if err != nil {
+			return nil, err
+		}
+		return blockNode(body), nil
+	case "elif", "else", "endif", "endfor", "endset", "endgeneration":
+		return nil, fmt.Errorf("line %d: unexpected tag %s", t.line, t.keyword)
+	}
+	return nil, fmt.Errorf("line %d: unsupported tag %s", t.line, t.keyword)
+}
+
+func (p *parser) parseIf(t *tag) (node, error) {
+	n := &ifNode{}
+	for {
+		cond, err := t.expr.parseAll()
+		if err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseBody("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			return nil, fmt.Errorf("line %d: if is not closed with endif", t.line)
+		}
+		n.conds = append(n.conds, cond)
+		n.bodies = append(n.bodies, body)
+		n.lines = append(n.lines, t.line)
+
+		switch end.keyword {
+		case "elif":
+			t = end
+			continue
+		case "else":
+			if err := end.expr.end(); err != nil {
+				return nil, err
+			}
+			n.orelse, _, err = p.parseBlock(end, "endif")
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if err := end.expr.end(); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+}
+
+func (p *parser) parseFor(t *tag) (node, error) {
+	n := &forNode{line: t.line}
+	for {
+		name := t.expr.next()
+		if name.kind != nameToken || keywords[name.val] {
+			return nil, fmt.Errorf("line %d: loop variable expected", t.line)
+		}
+		n.targets = append(n.targets, name.val)
+		if !t.expr.accept(",") {
+			break
+		}
+	}
+	if !t.expr.acceptName("in") {
+		return nil, fmt.Errorf("line %d: in expected", t.line)
+	}
+
+	var err error
+	// the condition of the loop follows the iterable, so the iterable is not a conditional expression
+	n.iter, err = t.expr.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t.expr.acceptName("if") {
+		n.filter, err = t.expr.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := t.expr.end(); err != nil {
+		return nil, err
+	}
+
+	body, end, err := p.parseBody("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	if end == nil {
+		return nil, fmt.Errorf("line %d: for is not closed with endfor", t.line)
+	}
+	if err := end.expr.end(); err != nil {
+		return nil, err
+	}
+	n.body = body
+	if end.keyword == "else" {
+		n.orelse, _, err = p.parseBlock(end, "endfor")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) parseSet(t *tag) (node, error) {
+	n := &setNode{line: t.line}
+	name := t.expr.next()
+	if name.kind != nameToken || keywords[name.val] {
+		return nil, fmt.Errorf("line %d: variable name expected", t.line)
+	}
+	n.name = name.val
+	if t.expr.accept(".") {
+		attr := t.expr.next()
+		if attr.kind != nameToken {
+			return nil, fmt.Errorf("line %d: attribute name expected", t.line)
+		}
+		n.attr = attr.val
+	}
+
+	// the block set takes the rendered body
+	if !t.expr.accept("=") {
+		if err := t.expr.end(); err != nil {
+			return nil, err
+		}
+		body, _, err := p.parseBlock(t, "endset")
+		if err != nil {
+			return nil, err
+		}
+		n.body = body
+		return n, nil
+	}
+
+	var err error
+	n.x, err = t.expr.parseAll()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
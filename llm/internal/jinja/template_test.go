@@ -0,0 +1,307 @@
+package jinja
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const chatmlTemplate = `{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}`
+
+const llama3Template = `{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>
+
+'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>
+
+' }}{% endif %}`
+
+const gemmaTemplate = `{{ bos_token }}{% if messages[0]['role'] == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if (message['role'] == 'assistant') %}{% set role = 'model' %}{% else %}{% set role = message['role'] %}{% endif %}{{ '<start_of_turn>' + role + '
+' + message['content'] | trim + '<end_of_turn>
+' }}{% endfor %}{% if add_generation_prompt %}{{'<start_of_turn>model
+'}}{% endif %}`
+
+const mistralTemplate = `{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}`
+
+// qwenTemplate is the tool part of the qwen2.5 template, it is indented and uses the - markers
+const qwenTemplate = `{%- if messages[0]['role'] == 'system' %}
+    {{- '<|im_start|>system\n' + messages[0]['content'] + '<|im_end|>\n' }}
+{%- else %}
+    {{- '<|im_start|>system\nYou are a helpful assistant.<|im_end|>\n' }}
+{%- endif %}
+{%- for message in messages %}
+    {%- if (message.role == "user") or (message.role == "system" and not loop.first) %}
+        {{- '<|im_start|>' + message.role + '\n' + message.content + '<|im_end|>' + '\n' }}
+    {%- elif message.role == "assistant" %}
+        {{- '<|im_start|>' + message.role }}
+        {%- if message.content %}
+            {{- '\n' + message.content }}
+        {%- endif %}
+        {%- for tool_call in message.tool_calls %}
+            {%- if tool_call.function is defined %}
+                {%- set tool_call = tool_call.function %}
+            {%- endif %}
+            {{- '\n<tool_call>\n{"name": "' }}
+            {{- tool_call.name }}
+            {{- '", "arguments": ' }}
+            {{- tool_call.arguments | tojson }}
+            {{- '}\n</tool_call>' }}
+        {%- endfor %}
+        {{- '<|im_end|>\n' }}
+    {%- elif message.role == "tool" %}
+        {%- if (loop.index0 == 0) or (messages[loop.index0 - 1].role != "tool") %}
+            {{- '<|im_start|>user' }}
+        {%- endif %}
+        {{- '\n<tool_response>\n' }}
+        {{- message.content }}
+        {{- '\n</tool_response>' }}
+        {%- if loop.last or (messages[loop.index0 + 1].role != "tool") %}
+            {{- '<|im_end|>\n' }}
+        {%- endif %}
+    {%- endif %}
+{%- endfor %}
+{%- if add_generation_prompt %}
+    {{- '<|im_start|>assistant\n' }}
+{%- endif %}
+`
+
+func chat(roles ...string) map[string]any {
+	messages := make([]any, 0, len(roles))
+	for i, role := range roles {
+		messages = append(messages, map[string]any{"role": role, "content": " " + role + string(rune('0'+i)) + " "})
+	}
+	return map[string]any{
+		"messages":              messages,
+		"bos_token":             "<s>",
+		"eos_token":             "</s>",
+		"add_generation_prompt": true,
+	}
+}
+
+func toolChat() map[string]any {
+	var args any
+	d := json.NewDecoder(strings.NewReader(`{"city": "Paris", "days": 2, "units": null}`))
+	d.UseNumber()
+	if err := d.Decode(&args); err != nil {
+		panic(err)
+	}
+	return map[string]any{
+		"messages": []any{
+			map[string]any{"role": "user", "content": "weather?"},
+			map[string]any{"role": "assistant", "content": "", "tool_calls": []any{
+				map[string]any{"type": "function", "function": map[string]any{"name": "forecast", "arguments": args}},
+			}},
+			map[string]any{"role": "tool", "content": "sunny"},
+			map[string]any{"role": "tool", "content": "warm"},
+		},
+		"add_generation_prompt": true,
+	}
+}
+
+var templateTests = []struct {
+	name     string
+	template string
+	vars     map[string]any
+	output   string
+	err      string
+}{
+	{
+		name:     "chatml",
+		template: chatmlTemplate,
+		vars:     chat("system", "user"),
+		output:   "<|im_start|>system\n system0 <|im_end|>\n<|im_start|>user\n user1 <|im_end|>\n<|im_start|>assistant\n",
+	},
+	{
+		name:     "llama3",
+		template: llama3Template,
+		vars:     chat("system", "user"),
+		output: "<s><|start_header_id|>system<|end_header_id|>\n\nsystem0<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\nuser1<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n",
+	},
+	{
+		name:     "gemma",
+		template: gemmaTemplate,
+		vars:     chat("user", "assistant", "user"),
+		output: "<s><start_of_turn>user\nuser0<end_of_turn>\n<start_of_turn>model\nassistant1<end_of_turn>\n" +
+			"<start_of_turn>user\nuser2<end_of_turn>\n<start_of_turn>model\n",
+	},
+	{
+		name:     "gemma rejects system",
+		template: gemmaTemplate,
+		vars:     chat("system", "user"),
+		err:      "System role not supported",
+	},
+	{
+		name:     "mistral",
+		template: mistralTemplate,
+		vars:     chat("user", "assistant", "user"),
+		output:   "<s>[INST]  user0  [/INST] assistant1 </s>[INST]  user2  [/INST]",
+	},
+	{
+		name:     "mistral rejects roles out of order",
+		template: mistralTemplate,
+		vars:     chat("user", "user"),
+		err:      "Conversation roles must alternate user/assistant/user/assistant/...",
+	},
+	{
+		name:     "qwen tool calls",
+		template: qwenTemplate,
+		vars:     toolChat(),
+		output: "<|im_start|>system\nYou are a helpful assistant.<|im_end|>\n<|im_start|>user\nweather?<|im_end|>\n" +
+			"<|im_start|>assistant\n<tool_call>\n{\"name\": \"forecast\", \"arguments\": {\"city\": \"Paris\", \"days\": 2, \"units\": null}}\n</tool_call><|im_end|>\n" +
+			"<|im_start|>user\n<tool_response>\nsunny\n</tool_response>\n<tool_response>\nwarm\n</tool_response><|im_end|>\n" +
+			"<|im_start|>assistant\n",
+	},
+	{
+		name:     "namespace is set in the loop",
+		template: "{%- set ns = namespace(last_user=-1) %}\n{%- for m in messages %}\n  {%- if m.role == 'user' %}{% set ns.last_user = loop.index0 %}{% endif %}\n{%- endfor %}\n{{- ns.last_user }}",
+		vars:     chat("user", "assistant", "user", "assistant"),
+		output:   "2",
+	},
+	{
+		name:     "variable set in the loop is not seen after it",
+		template: "{% set x = 1 %}{% for i in [1, 2] %}{% set x = i %}{{ x }}{% endfor %}{{ x }}",
+		output:   "121",
+	},
+	{
+		name:     "trim_blocks and lstrip_blocks",
+		template: "<ul>\n  {% for x in xs %}\n  <li>{{ x }}</li>\n  {% endfor %}\n</ul>",
+		vars:     map[string]any{"xs": []any{1, 2}},
+		output:   "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>",
+	},
+	{
+		name:     "plus marker keeps the indent",
+		template: "  {%+ if true %}x{% endif %}\n  {# comment #}\ny",
+		output:   "  xy",
+	},
+	{
+		name:     "tag after text on the line",
+		template: "a {% if true %}b{% endif %} c",
+		output:   "a b c",
+	},
+	{
+		name:     "loop filter, index and else",
+		template: "{% for x in [1, 2, 3] if x is odd %}{{ loop.index }}:{{ x }}{% if not loop.last %},{% endif %}{% endfor %}|{% for x in [] %}x{% else %}empty{% endfor %}",
+		output:   "1:1,2:3|empty",
+	},
+	{
+		name:     "unpacked items",
+		template: "{% for k, v in {'b': 2, 'a': 1}.items() %}{{ k }}={{ v }};{% endfor %}",
+		output:   "a=1;b=2;",
+	},
+	{
+		name:     "arithmetic",
+		template: "{{ 7 // 2 }}|{{ -7 // 2 }}|{{ -7 % 3 }}|{{ 7 / 2 }}|{{ 2 ** 10 }}|{{ 1 + 2 * 3 }}|{{ 'ab' * 2 }}|{{ n + 1 }}",
+		vars:     map[string]any{"n": json.Number("2")},
+		output:   "3|-4|2|3.5|1024|7|abab|3",
+	},
+	{
+		name:     "strings",
+		template: "{{ 'a' ~ 1 ~ none }}|{{ '  hi  '.strip() }}|{{ 'a,b,c'.split(',') | join('-') }}|{{ 'Hello'.startswith('He') }}|{{ 'hello'[::-1] }}|{{ 'hi' | upper }}|{{ 'x y'.title() }}",
+		output:   "a1None|hi|a-b-c|True|olleh|HI|X Y",
+	},
+	{
+		name:     "lists and tests",
+		template: "{{ [1, 2, 3][1:] }}|{{ [1, 2, 3][-1] }}|{{ [1, 'a'] | length }}|{{ 'a' in 'cat' }}|{{ 'role' not in {'role': 1} }}|{{ x is defined }}|{{ none is none }}|{{ 1 is number }}",
+		output:   "[2, 3]|3|2|True|False|False|True|True",
+	},
+	{
+		name:     "conditional expression and default",
+		template: "[{{ 'x' if false }}]|{{ 'y' if true else 'z' }}|{{ missing | default('d') }}|{{ '' | default('e', true) }}",
+		output:   "[]|y|d|e",
+	},
+	{
+		name:     "tojson",
+		template: "{{ {'b': 1, 'a': [true, none, 'q\"', 1.0]} | tojson }}|{{ {'a': [1]} | tojson(indent=2) }}|{{ 'é\n' | tojson }}",
+		output:   "{\"a\": [true, null, \"q\\\"\", 1.0], \"b\": 1}|{\n  \"a\": [\n    1\n  ]\n}|\"é\\n\"",
+	},
+	{
+		name:     "block set",
+		template: "{% set x %}block{% endset %}{{ x | upper }}",
+		output:   "BLOCK",
+	},
+	{
+		name:     "unsupported tag",
+		template: "{% macro f() %}{% endmacro %}",
+		err:      "line 1: unsupported tag macro",
+	},
+	{
+		name:     "unsupported filter",
+		template: "{{ x | wordcount }}",
+		err:      "line 1: unsupported filter wordcount",
+	},
+	{
+		name:     "unclosed block",
+		template: "\n{% if true %}",
+		err:      "line 2: if is not closed with endif",
+	},
+	{
+		name:     "unclosed tag",
+		template: "{{ x",
+		err:      "line 1: tag is not closed with }}",
+	},
+	{
+		name:     "unexpected end tag",
+		template: "{% endfor %}",
+		err:      "line 1: unexpected tag endfor",
+	},
+	{
+		name:     "operand error",
+		template: "a\n{{ 1 + 'a' }}",
+		err:      "line 2: unsupported operand types for +: int and string",
+	},
+	{
+		name:     "loop over none",
+		template: "{% for x in none %}{% endfor %}",
+		err:      "line 1: none is not iterable",
+	},
+}
+
+func TestTemplate(t *testing.T) {
+	for _, tt := range templateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output string
+			tmpl, err := Parse(tt.template)
+			if err == nil {
+				output, err = tmpl.Execute(tt.vars)
+			}
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != tt.output {
+				t.Errorf("output mismatch\ngot:  %q\nwant: %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestRaiseExceptionHasNoLine(t *testing.T) {
+	tmpl, err := Parse("\n{{ raise_exception('bad ' ~ 1) }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl.Execute(nil); err == nil || err.Error() != "bad 1" {
+		t.Fatalf("expected error %q, got %v", "bad 1", err)
+	}
+}
+
+func TestExecuteKeepsVars(t *testing.T) {
+	tmpl, err := Parse("{% set bos_token = 'x' %}{{ bos_token }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]any{"bos_token": "<s>"}
+	for range 2 {
+		output, err := tmpl.Execute(vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "x" || vars["bos_token"] != "<s>" {
+			t.Fatalf("expected the set variable to be local, got %q and %v", output, vars["bos_token"])
+		}
+	}
+}
@@ -0,0 +1,1000 @@
+package jinja
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The values of the templates are nil, bool, int, float64, string, []any, map[string]any and the types below.
+// json.Number of the decoded arguments is read as int or float64
+
+// undefined is the missing variable or attribute, it renders as the empty string
+type undefined struct {
+	name string
+}
+
+// function is the global function or the method bound to its value
+type function func(args []any, kwargs map[string]any) (any, error)
+
+// namespace is the object of namespace(), its attributes can be set in the loops
+type namespace struct {
+	vars map[string]any
+}
+
+// normalize converts the numbers to int or float64
+func normalize(v any) any {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := strconv.Atoi(n.String()); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+		return n.String()
+	case int64:
+		return int(n)
+	case int32:
+		return int(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+func typeName(v any) string {
+	switch normalize(v).(type) {
+	case undefined:
+		return "undefined"
+	case nil:
+		return "none"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "dict"
+	case *namespace:
+		return "namespace"
+	case function:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func truthy(v any) bool {
+	switch v := normalize(v).(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return len(v) > 0
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// toString renders the value as python str does
+func toString(v any) string {
+	switch v := normalize(v).(type) {
+	case undefined:
+		return ""
+	case string:
+		return v
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return formatFloat(v)
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, repr(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]any:
+		items := make([]string, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			items = append(items, repr(k)+": "+repr(v[k]))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case *namespace:
+		return "<Namespace>"
+	case function:
+		return "<function>"
+	}
+	return fmt.Sprint(v)
+}
+
+// repr renders the item of the list or the mapping, the strings are quoted
+func repr(v any) string {
+	s, ok := v.(string)
+	if !ok {
+		return toString(v)
+	}
+	quote := "'"
+	if strings.Contains(s, "'") && !strings.Contains(s, "\"") {
+		quote = "\""
+	}
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	s = strings.ReplaceAll(s, quote, "\\"+quote)
+	return quote + s + quote
+}
+
+// formatFloat keeps the fraction of the whole floats as python does
+func formatFloat(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e16 {
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys are the keys of the mapping in order, the mappings are iterated in it
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// iterate is the items of the loop, the mapping is iterated by its keys
+func iterate(v any) ([]any, error) {
+	switch v := normalize(v).(type) {
+	case undefined:
+		return nil, nil
+	case []any:
+		return v, nil
+	case string:
+		items := make([]any, 0, len(v))
+		for _, r := range v {
+			items = append(items, string(r))
+		}
+		return items, nil
+	case map[string]any:
+		items := make([]any, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			items = append(items, k)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", typeName(v))
+}
+
+func getAttr(v any, name string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if item, ok := v[name]; ok {
+			return item
+		}
+	case *namespace:
+		if item, ok := v.vars[name]; ok {
+			return item
+		}
+	case []any:
+		if i, err := strconv.Atoi(name); err == nil {
+			return getItem(v, i)
+		}
+	}
+	return undefined{name: name}
+}
+
+func getItem(v any, key any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if k, ok := key.(string); ok {
+			if item, ok := v[k]; ok {
+				return item
+			}
+			return undefined{name: k}
+		}
+	case *namespace:
+		if k, ok := key.(string); ok {
+			return getAttr(v, k)
+		}
+	case []any:
+		if i, ok := normalize(key).(int); ok {
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				return v[i]
+			}
+		}
+	case string:
+		if i, ok := normalize(key).(int); ok {
+			runes := []rune(v)
+			if i < 0 {
+				i += len(runes)
+			}
+			if i >= 0 && i < len(runes) {
+				return string(runes[i])
+			}
+		}
+	}
+	return undefined{name: toString(key)}
+}
+
+// slice cuts the list or the string as python slices do
+func slice(v any, start, stop, step *int) (any, error) {
+	var items []any
+	_, isString := v.(string)
+	switch v := v.(type) {
+	case []any:
+		items = v
+	case string:
+		for _, r := range v {
+			items = append(items, string(r))
+		}
+	default:
+		return nil, fmt.Errorf("%s can't be sliced", typeName(v))
+	}
+
+	n := len(items)
+	st := 1
+	if step != nil {
+		st = *step
+	}
+	if st == 0 {
+		return nil, errors.New("slice step can't be zero")
+	}
+	bound := func(b *int, def, low, high int) int {
+		if b == nil {
+			return def
+		}
+		i := *b
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, low), high)
+	}
+
+	result := make([]any, 0)
+	if st > 0 {
+		for i := bound(start, 0, 0, n); i < bound(stop, n, 0, n); i += st {
+			result = append(result, items[i])
+		}
+	} else {
+		for i := bound(start, n-1, -1, n-1); i > bound(stop, -1, -1, n-1); i += st {
+			result = append(result, items[i])
+		}
+	}
+
+	if isString {
+		var b strings.Builder
+		for _, r := range result {
+			b.WriteString(r.(string))
+		}
+		return b.String(), nil
+	}
+	return result, nil
+}
+
+func equal(a, b any) bool {
+	a, b = normalize(a), normalize(b)
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case undefined:
+		_, ok := b.(undefined)
+		return ok
+	case bool:
+		y, ok := b.(bool)
+		return ok && a == y
+	case string:
+		y, ok := b.(string)
+		return ok && a == y
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(a) != len(y) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(a) != len(y) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := y[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case *namespace:
+		y, ok := b.(*namespace)
+		return ok && a == y
+	}
+	return false
+}
+
+// toFloat reads the number, the bools are not numbers here
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func compare(a, b any) (int, error) {
+	a, b = normalize(a), normalize(b)
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("%s and %s can't be compared", typeName(a), typeName(b))
+}
+
+// contains checks the item is in the container, the mapping contains its keys
+func contains(container, item any) (bool, error) {
+	switch c := normalize(container).(type) {
+	case undefined:
+		return false, nil
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("%s can't be in string", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	case []any:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		k, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[k]
+		return found, nil
+	}
+	return false, fmt.Errorf("%s is not a container", typeName(container))
+}
+
+func arithmetic(op string, a, b any) (any, error) {
+	a, b = normalize(a), normalize(b)
+	x, xi := a.(int)
+	y, yi := b.(int)
+	if xi && yi {
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "//", "%":
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			q, r := x/y, x%y
+			// python rounds the division down, the remainder has the sign of the divisor
+			if r != 0 && (r < 0) != (y < 0) {
+				q, r = q-1, r+y
+			}
+			if op == "//" {
+				return q, nil
+			}
+			return r, nil
+		case "**":
+			if y >= 0 {
+				p := 1
+				for range y {
+					p *= x
+				}
+				return p, nil
+			}
+		}
+	}
+
+	if fx, ok := toFloat(a); ok {
+		if fy, ok := toFloat(b); ok {
+			switch op {
+			case "+":
+				return fx + fy, nil
+			case "-":
+				return fx - fy, nil
+			case "*":
+				return fx * fy, nil
+			case "/", "//", "%":
+				if fy == 0 {
+					return nil, errors.New("division by zero")
+				}
+				switch op {
+				case "/":
+					return fx / fy, nil
+				case "//":
+					return math.Floor(fx / fy), nil
+				}
+				return fx - math.Floor(fx/fy)*fy, nil
+			case "**":
+				return math.Pow(fx, fy), nil
+			}
+		}
+	}
+
+	switch op {
+	case "+":
+		if x, ok := a.(string); ok {
+			if y, ok := b.(string); ok {
+				return x + y, nil
+			}
+		}
+		if x, ok := a.([]any); ok {
+			if y, ok := b.([]any); ok {
+				return append(slices.Clip(x), y...), nil
+			}
+		}
+	case "*":
+		if yi {
+			if x, ok := a.(string); ok {
+				return strings.Repeat(x, max(y, 0)), nil
+			}
+			if x, ok := a.([]any); ok {
+				list := make([]any, 0, len(x)*max(y, 0))
+				for range y {
+					list = append(list, x...)
+				}
+				return list, nil
+			}
+		}
+		if xi {
+			if y, ok := b.(string); ok {
+				return strings.Repeat(y, max(x, 0)), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, typeName(a), typeName(b))
+}
+
+// arg is the positional or the keyword argument of the filter or the method
+func arg(args []any, kwargs map[string]any, i int, name string, def any) any {
+	if i < len(args) {
+		return args[i]
+	}
+	if v, ok := kwargs[name]; ok {
+		return v
+	}
+	return def
+}
+
+func toInt(v any, def int) int {
+	switch v := normalize(v).(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return int(f)
+		}
+	}
+	return def
+}
+
+func capitalize(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + strings.ToLower(s[n:])
+}
+
+// title upper cases the letters which start the words as python does
+func title(s string) string {
+	var b strings.Builder
+	prev := false
+	for _, r := range s {
+		if prev {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = unicode.IsLetter(r)
+	}
+	return b.String()
+}
+
+type filter func(v any, args []any, kwargs map[string]any) (any, error)
+
+var filters = map[string]filter{
+	"trim": func(v any, args []any, kwargs map[string]any) (any, error) {
+		chars := arg(args, kwargs, 0, "chars", nil)
+		if chars == nil {
+			return strings.TrimSpace(toString(v)), nil
+		}
+		return strings.Trim(toString(v), toString(chars)), nil
+	},
+	"length": length,
+	"count":  length,
+	"upper": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return strings.ToUpper(toString(v)), nil
+	},
+	"lower": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return strings.ToLower(toString(v)), nil
+	},
+	"capitalize": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return capitalize(toString(v)), nil
+	},
+	"title": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return title(toString(v)), nil
+	},
+	"default": defaultFilter,
+	"d":       defaultFilter,
+	"tojson": func(v any, args []any, kwargs map[string]any) (any, error) {
+		indent := arg(args, kwargs, 0, "indent", nil)
+		var b strings.Builder
+		if err := writeJSON(&b, v, toInt(indent, 0), indent != nil, 0); err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+	},
+	"first": func(v any, args []any, kwargs map[string]any) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return undefined{name: "first"}, nil
+		}
+		return items[0], nil
+	},
+	"last": func(v any, args []any, kwargs map[string]any) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return undefined{name: "last"}, nil
+		}
+		return items[len(items)-1], nil
+	},
+	"join": func(v any, args []any, kwargs map[string]any) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		attribute := arg(args, kwargs, 1, "attribute", nil)
+		parts := make([]string, 0, len(items))
+		for _, item := range items {
+			if attribute != nil {
+				item = getItem(item, attribute)
+			}
+			parts = append(parts, toString(item))
+		}
+		return strings.Join(parts, toString(arg(args, kwargs, 0, "d", ""))), nil
+	},
+	"string": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return toString(v), nil
+	},
+	"int": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return toInt(v, toInt(arg(args, kwargs, 0, "default", 0), 0)), nil
+	},
+	"list": func(v any, args []any, kwargs map[string]any) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Clone(items), nil
+	},
+	"reverse": func(v any, args []any, kwargs map[string]any) (any, error) {
+		step := -1
+		return slice(v, nil, nil, &step)
+	},
+	"items": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return callMethod(v, "items", nil, nil)
+	},
+	"replace": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return callMethod(toString(v), "replace", args, kwargs)
+	},
+	"safe": func(v any, args []any, kwargs map[string]any) (any, error) {
+		return v, nil
+	},
+}
+
+func length(v any, args []any, kwargs map[string]any) (any, error) {
+	switch v := normalize(v).(type) {
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []any:
+		return len(v), nil
+	case map[string]any:
+		return len(v), nil
+	case undefined:
+		return 0, nil
+	}
+	return nil, fmt.Errorf("%s has no length", typeName(v))
+}
+
+// defaultFilter replaces the undefined value, or the false one if boolean is set
+func defaultFilter(v any, args []any, kwargs map[string]any) (any, error) {
+	_, missing := v.(undefined)
+	if missing || (truthy(arg(args, kwargs, 1, "boolean", false)) && !truthy(v)) {
+		return arg(args, kwargs, 0, "default_value", ""), nil
+	}
+	return v, nil
+}
+
+// writeJSON writes the value as json.dumps of transformers does: the keys are sorted, the text is not escaped
+// and the separators have spaces unless the value is indented
+func writeJSON(b *strings.Builder, v any, indent int, indented bool, depth int) error {
+	newline := func(depth int) {
+		if indented {
+			b.WriteByte('\n')
+			b.WriteString(strings.Repeat(" ", indent*depth))
+		}
+	}
+	separator := ", "
+	if indented {
+		separator = ","
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		b.WriteString(x.String())
+		return nil
+	}
+	switch x := normalize(v).(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(x))
+	case int:
+		b.WriteString(strconv.Itoa(x))
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			return fmt.Errorf("%v is not JSON serializable", x)
+		}
+		b.WriteString(formatFloat(x))
+	case string:
+		writeJSONString(b, x)
+	case []any:
+		if len(x) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+		b.WriteByte('[')
+		for i, item := range x {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			if err := writeJSON(b, item, indent, indented, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteByte(']')
+	case map[string]any:
+		if len(x) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+		b.WriteByte('{')
+		for i, k := range sortedKeys(x) {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			writeJSONString(b, k)
+			b.WriteString(": ")
+			if err := writeJSON(b, x[k], indent, indented, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteByte('}')
+	default:
+		return fmt.Errorf("%s is not JSON serializable", typeName(v))
+	}
+	return nil
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+type test func(v any, args []any) (bool, error)
+
+var tests = map[string]test{
+	"defined": func(v any, args []any) (bool, error) {
+		_, ok := v.(undefined)
+		return !ok, nil
+	},
+	"undefined": func(v any, args []any) (bool, error) {
+		_, ok := v.(undefined)
+		return ok, nil
+	},
+	"none": func(v any, args []any) (bool, error) {
+		return v == nil, nil
+	},
+	"string": func(v any, args []any) (bool, error) {
+		_, ok := v.(string)
+		return ok, nil
+	},
+	"number": func(v any, args []any) (bool, error) {
+		_, ok := toFloat(normalize(v))
+		return ok, nil
+	},
+	"integer": func(v any, args []any) (bool, error) {
+		_, ok := normalize(v).(int)
+		return ok, nil
+	},
+	"float": func(v any, args []any) (bool, error) {
+		_, ok := normalize(v).(float64)
+		return ok, nil
+	},
+	"boolean": func(v any, args []any) (bool, error) {
+		_, ok := v.(bool)
+		return ok, nil
+	},
+	"true": func(v any, args []any) (bool, error) {
+		return v == true, nil
+	},
+	"false": func(v any, args []any) (bool, error) {
+		return v == false, nil
+	},
+	"mapping": func(v any, args []any) (bool, error) {
+		_, ok := v.(map[string]any)
+		return ok, nil
+	},
+	"iterable": func(v any, args []any) (bool, error) {
+		switch v.(type) {
+		case string, []any, map[string]any:
+			return true, nil
+		}
+		return false, nil
+	},
+	"sequence": func(v any, args []any) (bool, error) {
+		switch v.(type) {
+		case string, []any, map[string]any:
+			return true, nil
+		}
+		return false, nil
+	},
+	"even": func(v any, args []any) (bool, error) {
+		i, ok := normalize(v).(int)
+		return ok && i%2 == 0, nil
+	},
+	"odd": func(v any, args []any) (bool, error) {
+		i, ok := normalize(v).(int)
+		return ok && i%2 != 0, nil
+	},
+	"eq":      equalTest,
+	"equalto": equalTest,
+}
+
+func equalTest(v any, args []any) (bool, error) {
+	if len(args) != 1 {
+		return false, errors.New("test eq takes one argument")
+	}
+	return equal(v, args[0]), nil
+}
+
+// callMethod calls the method of the string or the mapping
+func callMethod(v any, name string, args []any, kwargs map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		switch name {
+		case "strip", "lstrip", "rstrip":
+			chars := arg(args, kwargs, 0, "chars", nil)
+			cutset := " \t\n\r\v\f"
+			if chars != nil {
+				cutset = toString(chars)
+			}
+			switch name {
+			case "lstrip":
+				return strings.TrimLeft(v, cutset), nil
+			case "rstrip":
+				return strings.TrimRight(v, cutset), nil
+			}
+			return strings.Trim(v, cutset), nil
+		case "startswith", "endswith":
+			affixes := []any{arg(args, kwargs, 0, "prefix", "")}
+			if list, ok := affixes[0].([]any); ok {
+				affixes = list
+			}
+			for _, a := range affixes {
+				s, ok := a.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s takes strings, got %s", name, typeName(a))
+				}
+				if (name == "startswith" && strings.HasPrefix(v, s)) || (name == "endswith" && strings.HasSuffix(v, s)) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case "upper":
+			return strings.ToUpper(v), nil
+		case "lower":
+			return strings.ToLower(v), nil
+		case "title":
+			return title(v), nil
+		case "capitalize":
+			return capitalize(v), nil
+		case "split":
+			sep := arg(args, kwargs, 0, "sep", nil)
+			n := toInt(arg(args, kwargs, 1, "maxsplit", -1), -1)
+			if sep == nil {
+				if n >= 0 {
+					return nil, errors.New("split takes maxsplit with a separator only")
+				}
+				return toList(strings.Fields(v)), nil
+			}
+			if n >= 0 {
+				n++
+			}
+			return toList(strings.SplitN(v, toString(sep), n)), nil
+		case "replace":
+			n := toInt(arg(args, kwargs, 2, "count", -1), -1)
+			return strings.Replace(v, toString(arg(args, kwargs, 0, "old", "")), toString(arg(args, kwargs, 1, "new", "")), n), nil
+		}
+	case map[string]any:
+		switch name {
+		case "items":
+			items := make([]any, 0, len(v))
+			for _, k := range sortedKeys(v) {
+				items = append(items, []any{k, v[k]})
+			}
+			return items, nil
+		case "keys":
+			keys, _ := iterate(v)
+			return keys, nil
+		case "values":
+			values := make([]any, 0, len(v))
+			for _, k := range sortedKeys(v) {
+				values = append(values, v[k])
+			}
+			return values, nil
+		case "get":
+			if item, ok := v[toString(arg(args, kwargs, 0, "key", ""))]; ok {
+				return item, nil
+			}
+			return arg(args, kwargs, 1, "default", nil), nil
+		}
+	case undefined:
+		return nil, fmt.Errorf("%s is undefined", v.name)
+	}
+	return nil, fmt.Errorf("%s has no method %s", typeName(v), name)
+}
+
+func toList(s []string) []any {
+	list := make([]any, 0, len(s))
+	for _, item := range s {
+		list = append(list, item)
+	}
+	return list
+}
+
+var globals = map[string]any{
+	"raise_exception": function(func(args []any, kwargs map[string]any) (any, error) {
+		return nil, &exception{message: toString(arg(args, kwargs, 0, "message", ""))}
+	}),
+	"namespace": function(func(args []any, kwargs map[string]any) (any, error) {
+		ns := &namespace{vars: make(map[string]any, len(kwargs))}
+		for k, v := range kwargs {
+			ns.vars[k] = v
+		}
+		return ns, nil
+	}),
+	"range": function(func(args []any, kwargs map[string]any) (any, error) {
+		bounds := make([]int, 0, len(args))
+		for _, a := range args {
+			i, ok := normalize(a).(int)
+			if !ok {
+				return nil, fmt.Errorf("range takes int, got %s", typeName(a))
+			}
+			bounds = append(bounds, i)
+		}
+		start, stop, step := 0, 0, 1
+		switch len(bounds) {
+		case 1:
+			stop = bounds[0]
+		case 2:
+			start, stop = bounds[0], bounds[1]
+		case 3:
+			start, stop, step = bounds[0], bounds[1], bounds[2]
+		default:
+			return nil, errors.New("range takes from 1 to 3 arguments")
+		}
+		if step == 0 {
+			return nil, errors.New("range step can't be zero")
+		}
+		list := make([]any, 0)
+		for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+			list = append(list, i)
+		}
+		return list, nil
+	}),
+}
@@ -0,0 +1,50 @@
+package llama
+
+/*
+#include "llama.h"
+*/
+import "C"
+
+import "unsafe"
+
+// batch is llama_batch of a single sequence with explicit positions,
+// it is used when logits of several tokens of the batch are needed
+type batch struct {
+	b    C.struct_llama_batch
+	size int
+}
+
+func newBatch(size int) *batch {
+	return &batch{
+		b:    C.llama_batch_init(C.int32_t(size), 0, 1),
+		size: size,
+	}
+}
+
+func (b *batch) clear() {
+	b.b.n_tokens = 0
+}
+
+func (b *batch) len() int {
+	return int(b.b.n_tokens)
+}
+
+func (b *batch) add(token C.llama_token, pos int, logits bool) {
+	i := int(b.b.n_tokens)
+
+	unsafe.Slice(b.b.token, b.size)[i] = token
+	unsafe.Slice(b.b.pos, b.size)[i] = C.llama_pos(pos)
+	unsafe.Slice(b.b.n_seq_id, b.size)[i] = 1
+	unsafe.Slice(unsafe.Slice(b.b.seq_id, b.size)[i], 1)[0] = 0
+	if logits {
+		unsafe.Slice(b.b.logits, b.size)[i] = 1
+	} else {
+		unsafe.Slice(b.b.logits, b.size)[i] = 0
+	}
+
+	b.b.n_tokens++
+}
+
+func (b *batch) free() {
+	C.llama_batch_free(b.b)
+}
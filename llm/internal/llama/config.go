@@ -0,0 +1,90 @@
+package llama
+
+import (
+	"errors"
+	"fmt"
+)
+
+// rope scaling types of the config
+const (
+	RopeScalingNone   = "none"
+	RopeScalingLinear = "linear"
+	RopeScalingYarn   = "yarn"
+)
+
+// Config holds the model and context parameters
+type Config struct {
+	// NCtx is the context size, the trained context of the model is used if it is 0
+	NCtx int `json:"n_ctx"`
+	// NBatch is the max number of tokens decoded at once, longer prompts are evaluated by chunks
+	NBatch int `json:"n_batch"`
+	// NPredict is the max number of generated tokens
+	NPredict   int `json:"n_predict"`
+	NGPULayers int `json:"n_gpu_layers"`
+
+	// Threads and ThreadsBatch are the number of threads of generation and prompt evaluation,
+	// llama.cpp chooses them if they are 0
+	Threads      int `json:"threads"`
+	ThreadsBatch int `json:"threads_batch"`
+
+	UseMmap  bool `json:"use_mmap"`
+	UseMlock bool `json:"use_mlock"`
+
+	// RopeScaling is none, linear or yarn, the model setting is used if it is empty
+	RopeScaling   string  `json:"rope_scaling"`
+	RopeFreqBase  float32 `json:"rope_freq_base"`
+	RopeFreqScale float32 `json:"rope_freq_scale"`
+
+	FlashAttn bool `json:"flash_attn"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		NCtx:     2048,
+		NBatch:   512,
+		NPredict: 512,
+		UseMmap:  true,
+	}
+}
+
+// Validate checks the parameters which do not depend on the model
+func (c Config) Validate() error {
+	if c.NCtx < 0 {
+		return errors.New("n_ctx should not be negative")
+	}
+	if c.NBatch <= 0 {
+		return errors.New("n_batch should be positive")
+	}
+	if c.NPredict <= 0 {
+		return errors.New("n_predict should be positive")
+	}
+	if c.NCtx > 0 && c.NPredict >= c.NCtx {
+		return fmt.Errorf("n_predict %d should be less than n_ctx %d", c.NPredict, c.NCtx)
+	}
+	if c.Threads < 0 || c.ThreadsBatch < 0 {
+		return errors.New("number of threads should not be negative")
+	}
+	if c.RopeFreqBase < 0 || c.RopeFreqScale < 0 {
+		return errors.New("rope frequency should not be negative")
+	}
+
+	switch c.RopeScaling {
+	case "", RopeScalingNone, RopeScalingLinear, RopeScalingYarn:
+	default:
+		return fmt.Errorf("unsupported rope scaling %q", c.RopeScaling)
+	}
+
+	return nil
+}
+
+// validateTrained checks the context size against the trained context of the model,
+// the longer context needs rope scaling
+func (c Config) validateTrained(n_ctx_train int) error {
+	if c.NCtx <= n_ctx_train {
+		return nil
+	}
+	if c.RopeScaling == RopeScalingLinear || c.RopeScaling == RopeScalingYarn || c.RopeFreqScale > 0 {
+		return nil
+	}
+	return fmt.Errorf("n_ctx %d exceeds the trained context %d of the model, rope scaling should be set", c.NCtx, n_ctx_train)
+}
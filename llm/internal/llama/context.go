@@ -0,0 +1,267 @@
+package llama
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+const (
+	// summaryPredict is the max number of tokens of the chat summary
+	summaryPredict = 256
+
+	summaryInstruction = "Summarize the conversation below into a short note. " +
+		"Keep names, facts, decisions and open questions, skip greetings and small talk. " +
+		"Answer with the summary only."
+)
+
+// ContextStrategy fits the chat history into the context window
+type ContextStrategy interface {
+	Fit(ctx context.Context, w *contextWindow) (Prompt, error)
+}
+
+func NewContextStrategy(o *domain.ContextOptions) (ContextStrategy, error) {
+	if o == nil {
+		return slidingWindow{}, nil
+	}
+
+	switch o.Strategy {
+	case "", domain.ContextSlidingWindow:
+		return slidingWindow{}, nil
+	case domain.ContextKeepFirst:
+		return keepFirst{n: o.KeepFirst}, nil
+	case domain.ContextSummarize:
+		return summarize{summary: o.Summary, summarized: o.Summarized}, nil
+	default:
+		return nil, fmt.Errorf("unsupported context strategy %q", o.Strategy)
+	}
+}
+
+// contextWindow is the prompt being fitted into the context, history messages can be dropped,
+// prefix messages like tools description, tail messages and prefill are always in the prompt
+type contextWindow struct {
+	b       LLMPromptBuilder
+	prefix  []domain.ChatMessage
+	history []domain.ChatMessage
+	tail    []domain.ChatMessage
+	prefill string
+	// preview does not generate, so the messages to summarize are dropped
+	preview bool
+}
+
+// span is the indices of the history messages from i to j
+func span(i, j int) []int {
+	indices := make([]int, 0, j-i)
+	for ; i < j; i++ {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+func (w *contextWindow) render(head, history []domain.ChatMessage, limit int) (string, bool, error) {
+	messages := make([]domain.ChatMessage, 0, len(w.prefix)+len(head)+len(history)+len(w.tail))
+	messages = append(messages, w.prefix...)
+	messages = append(messages, head...)
+	messages = append(messages, history...)
+	messages = append(messages, w.tail...)
+
+	p, l, err := w.b.render(messages, w.prefill)
+	if err != nil {
+		return "", false, err
+	}
+	return p, l <= limit, nil
+}
+
+// fitFrom finds the min i, so the prompt of head and history[i:] fits into the limit
+func (w *contextWindow) fitFrom(head, history []domain.ChatMessage, limit int) (int, string, error) {
+	// the shortest prompt is checked first, if it does not fit nothing does
+	p, ok, err := w.render(head, nil, limit)
+	if err != nil {
+		return 0, "", err
+	}
+	if !ok {
+		return 0, "", ErrPromptTooLong
+	}
+
+	lo, hi := 0, len(history)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		mp, ok, err := w.render(head, history[mid:], limit)
+		if err != nil {
+			return 0, "", err
+		}
+		if ok {
+			hi = mid
+			p = mp
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	return hi, p, nil
+}
+
+// slidingWindow drops the oldest messages
+type slidingWindow struct{}
+
+func (slidingWindow) Fit(ctx context.Context, w *contextWindow) (Prompt, error) {
+	i, p, err := w.fitFrom(nil, w.history, w.b.limit())
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	return Prompt{
+		Text: p,
+		Context: domain.ContextReport{
+			Strategy: domain.ContextSlidingWindow,
+			Dropped:  i,
+		},
+		Dropped: span(0, i),
+	}, nil
+}
+
+// keepFirst keeps the first n messages, usually it is the system prompt
+// and the task description, and drops the oldest messages after them
+type keepFirst struct {
+	n int
+}
+
+func (s keepFirst) Fit(ctx context.Context, w *contextWindow) (Prompt, error) {
+	n := min(s.n, len(w.history))
+
+	i, p, err := w.fitFrom(w.history[:n], w.history[n:], w.b.limit())
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	return Prompt{
+		Text: p,
+		Context: domain.ContextReport{
+			Strategy: domain.ContextKeepFirst,
+			Dropped:  i,
+		},
+		Dropped: span(n, n+i),
+	}, nil
+}
+
+// summarize replaces the dropped messages with their summary. The summary
+// of the previous requests is extended with the newly dropped messages
+type summarize struct {
+	summary    string
+	summarized int
+}
+
+func summaryNote(summary string) []domain.ChatMessage {
+	if len(summary) == 0 {
+		return nil
+	}
+	return []domain.ChatMessage{{
+		Role:    "system",
+		Content: "Summary of the earlier conversation: " + summary,
+	}}
+}
+
+func (s summarize) Fit(ctx context.Context, w *contextWindow) (Prompt, error) {
+	covered := min(s.summarized, len(w.history))
+	if len(s.summary) == 0 {
+		covered = 0
+	}
+	rest := w.history[covered:]
+
+	p, ok, err := w.render(summaryNote(s.summary), rest, w.b.limit())
+	if err != nil {
+		return Prompt{}, err
+	}
+	if ok {
+		return Prompt{
+			Text: p,
+			Context: domain.ContextReport{
+				Strategy: domain.ContextSummarize,
+				Dropped:  covered,
+			},
+			Dropped: span(0, covered),
+		}, nil
+	}
+
+	if w.preview {
+		i, p, err := w.fitFrom(summaryNote(s.summary), rest, w.b.limit())
+		if err != nil {
+			return Prompt{}, err
+		}
+		return Prompt{
+			Text: p,
+			Context: domain.ContextReport{
+				Strategy:   domain.ContextSummarize,
+				Dropped:    covered + i,
+				Summary:    s.summary,
+				Summarized: covered,
+			},
+			Dropped: span(0, covered+i),
+		}, nil
+	}
+
+	// leave room for the new summary and find the messages to summarize
+	i, _, err := w.fitFrom(summaryNote(s.summary), rest, w.b.limit()-summaryPredict)
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	summary, err := w.b.summarize(ctx, s.summary, rest[:i])
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	// the summary can be a bit longer than expected, so the rest is fitted again
+	j, p, err := w.fitFrom(summaryNote(summary), rest[i:], w.b.limit())
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	return Prompt{
+		Text: p,
+		Context: domain.ContextReport{
+			Strategy:   domain.ContextSummarize,
+			Dropped:    covered + i + j,
+			Summary:    summary,
+			Summarized: covered + i,
+		},
+		Dropped: span(0, covered+i+j),
+	}, nil
+}
+
+// summarize generates the summary of the messages, which continues the previous summary
+func (b LLMPromptBuilder) summarize(ctx context.Context, previous string, messages []domain.ChatMessage) (string, error) {
+	for {
+		var transcript strings.Builder
+		if len(previous) > 0 {
+			fmt.Fprintf(&transcript, "Summary of the earlier conversation: %s\n\n", previous)
+		}
+		for _, m := range messages {
+			fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+		}
+
+		p, l, err := b.render([]domain.ChatMessage{
+			{Role: "system", Content: summaryInstruction},
+			{Role: "user", Content: transcript.String()},
+		}, "")
+		if err != nil {
+			return "", err
+		}
+
+		if l <= b.llm.n_ctx-summaryPredict {
+			summary, err := b.llm.Generate(ctx, p, summaryPredict)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(summary), nil
+		}
+
+		// the oldest messages are lost if the transcript is too long to summarize at once
+		if len(messages) == 0 {
+			return "", ErrPromptTooLong
+		}
+		messages = messages[1:]
+	}
+}
@@ -0,0 +1,514 @@
+package llama
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// JSONGrammar matches any JSON value
+const JSONGrammar = `root ::= value
+` + grammarPrimitives + grammarValue
+
+const grammarPrimitives = `space ::= | " " | "\n" [ \t]{0,20}
+boolean ::= ("true" | "false") space
+null ::= "null" space
+char ::= [^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})
+string ::= "\"" char* "\"" space
+integral-part ::= [0] | [1-9] [0-9]{0,15}
+decimal-part ::= [0-9]{1,16}
+integer ::= ("-"? integral-part) space
+number ::= ("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space
+`
+
+const grammarValue = `value ::= object | array | string | number | boolean | null
+object ::= "{" space ( string ":" space value ("," space string ":" space value)* )? "}" space
+array ::= "[" space ( value ("," space value)* )? "]" space
+`
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// schemaConverter converts JSON schema to GBNF grammar,
+// the supported subset is the same as in the llama.cpp converter without patterns and formats
+type schemaConverter struct {
+	root  json.RawMessage
+	rules map[string]string
+	refs  map[string]string
+	// reserved are the names of the refs which are being visited, they are not shared with other rules
+	reserved map[string]bool
+}
+
+// SchemaToGrammar converts JSON schema to GBNF grammar for the llama grammar sampler
+func SchemaToGrammar(schema json.RawMessage) (string, error) {
+	c := &schemaConverter{
+		root:     schema,
+		rules:    make(map[string]string),
+		refs:     make(map[string]string),
+		reserved: make(map[string]bool),
+	}
+
+	root, err := c.visit(schema, "root")
+	if err != nil {
+		return "", err
+	}
+	if root != "root" {
+		c.rules["root"] = root
+	}
+
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		if name != "root" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var g strings.Builder
+	fmt.Fprintf(&g, "root ::= %s\n", c.rules["root"])
+	for _, name := range names {
+		fmt.Fprintf(&g, "%s ::= %s\n", name, c.rules[name])
+	}
+	g.WriteString(grammarPrimitives)
+	g.WriteString(grammarValue)
+
+	return g.String(), nil
+}
+
+// addRule adds the rule and returns its name, the name is changed if
+// there is a different rule with the same name already
+func (c *schemaConverter) addRule(name string, rule string) string {
+	key := c.ruleName(name, func(existing string) bool { return existing == rule })
+	c.rules[key] = rule
+	return key
+}
+
+// reserveRule reserves the name of the rule which is set after its definition is visited,
+// the name is not given to other rules until the reservation is released
+func (c *schemaConverter) reserveRule(name string) string {
+	key := c.ruleName(name, func(string) bool { return false })
+	c.reserved[key] = true
+	return key
+}
+
+// ruleName is the valid name of the rule which is free or whose rule can be reused
+func (c *schemaConverter) ruleName(name string, reuse func(existing string) bool) string {
+	name = strings.Trim(invalidRuleChars.ReplaceAllString(name, "-"), "-")
+	if len(name) == 0 {
+		name = "rule"
+	}
+
+	key := name
+	for i := 1; ; i++ {
+		existing, ok := c.rules[key]
+		if !c.reserved[key] && (!ok || reuse(existing)) {
+			return key
+		}
+		key = fmt.Sprintf("%s%d", name, i)
+	}
+}
+
+// visit converts the schema to a rule and returns the rule reference
+func (c *schemaConverter) visit(raw json.RawMessage, name string) (string, error) {
+	var schema map[string]json.RawMessage
+	if len(bytes.TrimSpace(raw)) == 0 || string(bytes.TrimSpace(raw)) == "true" {
+		return "value", nil
+	}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return "", fmt.Errorf("invalid json schema, %w", err)
+	}
+
+	if ref, ok := schema["$ref"]; ok {
+		return c.visitRef(ref)
+	}
+
+	if v, ok := schema["const"]; ok {
+		lit, err := jsonLiteral(v)
+		if err != nil {
+			return "", err
+		}
+		return c.addRule(name, lit+" space"), nil
+	}
+
+	if v, ok := schema["enum"]; ok {
+		var values []json.RawMessage
+		if err := json.Unmarshal(v, &values); err != nil {
+			return "", fmt.Errorf("invalid enum, %w", err)
+		}
+		alts := make([]string, 0, len(values))
+		for _, value := range values {
+			lit, err := jsonLiteral(value)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, lit)
+		}
+		return c.addRule(name, "("+strings.Join(alts, " | ")+") space"), nil
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if v, ok := schema[key]; ok {
+			var variants []json.RawMessage
+			if err := json.Unmarshal(v, &variants); err != nil {
+				return "", fmt.Errorf("invalid %s, %w", key, err)
+			}
+			return c.visitAlternatives(variants, name)
+		}
+	}
+
+	if _, ok := schema["allOf"]; ok {
+		return "", errors.New("allOf is not supported in json schema")
+	}
+
+	t, ok := schema["type"]
+	if !ok {
+		if _, ok := schema["properties"]; ok {
+			return c.visitObject(schema, name)
+		}
+		return "value", nil
+	}
+
+	var types []string
+	if err := json.Unmarshal(t, &types); err != nil {
+		var single string
+		if err := json.Unmarshal(t, &single); err != nil {
+			return "", fmt.Errorf("invalid type, %w", err)
+		}
+		types = []string{single}
+	}
+	if len(types) > 1 {
+		alts := make([]string, 0, len(types))
+		for _, t := range types {
+			ref, err := c.visitType(schema, t, name+"-"+t)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, ref)
+		}
+		return c.addRule(name, strings.Join(alts, " | ")), nil
+	}
+
+	return c.visitType(schema, types[0], name)
+}
+
+func (c *schemaConverter) visitType(schema map[string]json.RawMessage, t string, name string) (string, error) {
+	switch t {
+	case "object":
+		return c.visitObject(schema, name)
+	case "array":
+		return c.visitArray(schema, name)
+	case "string":
+		return c.visitString(schema, name)
+	case "integer", "number", "boolean", "null":
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported type %q in json schema", t)
+	}
+}
+
+func (c *schemaConverter) visitAlternatives(variants []json.RawMessage, name string) (string, error) {
+	alts := make([]string, 0, len(variants))
+	for i, v := range variants {
+		ref, err := c.visit(v, fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			return "", err
+		}
+		alts = append(alts, ref)
+	}
+	return c.addRule(name, strings.Join(alts, " | ")), nil
+}
+
+// visitRef resolves local references like #/$defs/name and #/definitions/name
+func (c *schemaConverter) visitRef(raw json.RawMessage) (string, error) {
+	var ref string
+	if err := json.Unmarshal(raw, &ref); err != nil {
+		return "", fmt.Errorf("invalid $ref, %w", err)
+	}
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return "", fmt.Errorf("only local $ref are supported, got %q", ref)
+	}
+
+	target := c.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(target, &m); err != nil {
+			return "", fmt.Errorf("can't resolve $ref %q", ref)
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		v, ok := m[part]
+		if !ok {
+			return "", fmt.Errorf("can't resolve $ref %q", ref)
+		}
+		target = v
+	}
+
+	// the name is reserved before visiting, so recursive schemas refer to it
+	name := c.reserveRule("ref-" + ref[strings.LastIndex(ref, "/")+1:])
+	c.refs[ref] = name
+
+	rule, err := c.visit(target, name+"-def")
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = rule
+	delete(c.reserved, name)
+	return name, nil
+}
+
+func (c *schemaConverter) visitObject(schema map[string]json.RawMessage, name string) (string, error) {
+	props, ok := schema["properties"]
+	if !ok {
+		return "object", nil
+	}
+
+	keys, values, err := orderedObject(props)
+	if err != nil {
+		return "", fmt.Errorf("invalid properties, %w", err)
+	}
+
+	required := make(map[string]bool)
+	if r, ok := schema["required"]; ok {
+		var names []string
+		if err := json.Unmarshal(r, &names); err != nil {
+			return "", fmt.Errorf("invalid required, %w", err)
+		}
+		for _, n := range names {
+			required[n] = true
+		}
+	}
+
+	kvs := make(map[string]string, len(keys))
+	requiredKeys := make([]string, 0, len(keys))
+	optionalKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ref, err := c.visit(values[key], name+"-"+key)
+		if err != nil {
+			return "", err
+		}
+		keyLit, err := marshalJSON(key)
+		if err != nil {
+			return "", err
+		}
+		kvs[key] = c.addRule(name+"-"+key+"-kv", fmt.Sprintf(`%s space ":" space %s`, gbnfLiteral(keyLit), ref))
+
+		if required[key] {
+			requiredKeys = append(requiredKeys, key)
+		} else {
+			optionalKeys = append(optionalKeys, key)
+		}
+	}
+
+	// optional properties keep their order, any of them can be skipped
+	var rest func(keys []string, firstOptional bool) string
+	rest = func(keys []string, firstOptional bool) string {
+		if len(keys) == 0 {
+			return ""
+		}
+		kv := kvs[keys[0]]
+		var r string
+		if firstOptional {
+			r = fmt.Sprintf(`( "," space %s )?`, kv)
+		} else {
+			r = kv
+		}
+		if len(keys) > 1 {
+			r += " " + c.addRule(name+"-"+keys[0]+"-rest", rest(keys[1:], true))
+		}
+		return r
+	}
+
+	var rule strings.Builder
+	rule.WriteString(`"{" space `)
+	for i, key := range requiredKeys {
+		if i > 0 {
+			rule.WriteString(` "," space `)
+		}
+		rule.WriteString(kvs[key])
+	}
+	if len(optionalKeys) > 0 {
+		rule.WriteString(" (")
+		if len(requiredKeys) > 0 {
+			rule.WriteString(` "," space (`)
+		}
+		alts := make([]string, 0, len(optionalKeys))
+		for i := range optionalKeys {
+			alts = append(alts, rest(optionalKeys[i:], false))
+		}
+		rule.WriteString(" " + strings.Join(alts, " | ") + " ")
+		if len(requiredKeys) > 0 {
+			rule.WriteString(")")
+		}
+		rule.WriteString(" )?")
+	}
+	rule.WriteString(` "}" space`)
+
+	return c.addRule(name, rule.String()), nil
+}
+
+func (c *schemaConverter) visitArray(schema map[string]json.RawMessage, name string) (string, error) {
+	item := "value"
+	if items, ok := schema["items"]; ok {
+		var err error
+		item, err = c.visit(items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	minItems, maxItems, err := bounds(schema, "minItems", "maxItems")
+	if err != nil {
+		return "", err
+	}
+
+	// the first item is followed by the rest items with leading commas
+	list := item
+	if maxItems < 0 || maxItems > 1 {
+		list += fmt.Sprintf(` ("," space %s)%s`, item, repetition(max(minItems-1, 0), maxItems-1))
+	}
+	if minItems == 0 {
+		list = "( " + list + " )?"
+	}
+	if maxItems == 0 {
+		list = ""
+	}
+
+	return c.addRule(name, fmt.Sprintf(`"[" space %s "]" space`, list)), nil
+}
+
+func (c *schemaConverter) visitString(schema map[string]json.RawMessage, name string) (string, error) {
+	min, max, err := bounds(schema, "minLength", "maxLength")
+	if err != nil {
+		return "", err
+	}
+	if min == 0 && max < 0 {
+		return "string", nil
+	}
+
+	return c.addRule(name, fmt.Sprintf(`"\"" char%s "\"" space`, repetition(min, max))), nil
+}
+
+// bounds reads min and max constraints, max is -1 if it is not set
+func bounds(schema map[string]json.RawMessage, minKey, maxKey string) (int, int, error) {
+	min, max := 0, -1
+	if v, ok := schema[minKey]; ok {
+		if err := json.Unmarshal(v, &min); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s, %w", minKey, err)
+		}
+	}
+	if v, ok := schema[maxKey]; ok {
+		if err := json.Unmarshal(v, &max); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s, %w", maxKey, err)
+		}
+	}
+	if max >= 0 && min > max {
+		return 0, 0, fmt.Errorf("%s is greater than %s", minKey, maxKey)
+	}
+	return min, max, nil
+}
+
+// repetition makes GBNF repetition suffix, max < 0 means unbounded
+func repetition(min, max int) string {
+	switch {
+	case min == 0 && max < 0:
+		return "*"
+	case min == 1 && max < 0:
+		return "+"
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	default:
+		return fmt.Sprintf("{%d,%d}", min, max)
+	}
+}
+
+// orderedObject decodes the JSON object keeping the order of its keys
+func orderedObject(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	t, err := d.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '{' {
+		return nil, nil, errors.New("object is expected")
+	}
+
+	keys := make([]string, 0)
+	values := make(map[string]json.RawMessage)
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := t.(string)
+
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = v
+	}
+
+	return keys, values, nil
+}
+
+// jsonLiteral makes the rule matching exactly the JSON value
+func jsonLiteral(v json.RawMessage) (string, error) {
+	var value any
+	if err := json.Unmarshal(v, &value); err != nil {
+		return "", err
+	}
+	compact, err := marshalJSON(value)
+	if err != nil {
+		return "", err
+	}
+	return gbnfLiteral(compact), nil
+}
+
+// marshalJSON encodes the value as the model writes it, json.Marshal escapes <, > and & for HTML
+func marshalJSON(v any) (string, error) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// gbnfLiteral quotes the text as GBNF string literal
+func gbnfLiteral(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\x%02X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
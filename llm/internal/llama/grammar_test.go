@@ -0,0 +1,158 @@
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+var schemaGrammarTests = []struct {
+	name   string
+	schema string
+	// rules are the rules of the schema, the primitives follow them
+	rules string
+	err   string
+}{
+	{
+		name:   "required and optional properties",
+		schema: `{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"},"email":{"type":"string"}},"required":["name"]}`,
+		rules: `root ::= "{" space root-name-kv ( "," space ( root-age-kv root-age-rest | root-email-kv ) )? "}" space
+root-age-kv ::= "\"age\"" space ":" space integer
+root-age-rest ::= ( "," space root-email-kv )?
+root-email-kv ::= "\"email\"" space ":" space string
+root-name-kv ::= "\"name\"" space ":" space string
+`,
+	},
+	{
+		name:   "enum",
+		schema: `{"enum":["red","green",1,null]}`,
+		rules: `root ::= ("\"red\"" | "\"green\"" | "1" | "null") space
+`,
+	},
+	{
+		name:   "const",
+		schema: `{"const":"fixed"}`,
+		rules: `root ::= "\"fixed\"" space
+`,
+	},
+	{
+		name:   "array with min and max items",
+		schema: `{"type":"array","items":{"type":"number"},"minItems":1,"maxItems":3}`,
+		rules: `root ::= "[" space number ("," space number){0,2} "]" space
+`,
+	},
+	{
+		name:   "optional array",
+		schema: `{"type":"array","items":{"type":"string"}}`,
+		rules: `root ::= "[" space ( string ("," space string)* )? "]" space
+`,
+	},
+	{
+		name:   "nested ref",
+		schema: `{"$defs":{"point":{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"}},"required":["x","y"]}},"type":"object","properties":{"from":{"$ref":"#/$defs/point"},"to":{"$ref":"#/$defs/point"}},"required":["from","to"]}`,
+		rules: `root ::= "{" space root-from-kv "," space root-to-kv "}" space
+ref-point ::= ref-point-def
+ref-point-def ::= "{" space ref-point-def-x-kv "," space ref-point-def-y-kv "}" space
+ref-point-def-x-kv ::= "\"x\"" space ":" space number
+ref-point-def-y-kv ::= "\"y\"" space ":" space number
+root-from-kv ::= "\"from\"" space ":" space ref-point
+root-to-kv ::= "\"to\"" space ":" space ref-point
+`,
+	},
+	{
+		// the refs have the same rule name and are visited one inside the other
+		name:   "recursive refs with the same name",
+		schema: `{"$defs":{"a":{"item":{"type":"object","properties":{"b":{"$ref":"#/$defs/b/item"}},"required":["b"]}},"b":{"item":{"type":"array","items":{"$ref":"#/$defs/a/item"},"maxItems":1}}},"$ref":"#/$defs/a/item"}`,
+		rules: `root ::= ref-item
+ref-item ::= ref-item-def
+ref-item-def ::= "{" space ref-item-def-b-kv "}" space
+ref-item-def-b-kv ::= "\"b\"" space ":" space ref-item1
+ref-item1 ::= ref-item1-def
+ref-item1-def ::= "[" space ( ref-item )? "]" space
+`,
+	},
+	{
+		// response_format json_object is mapped to this schema by the server
+		name:   "json object",
+		schema: `{"type":"object"}`,
+		rules: `root ::= object
+`,
+	},
+	{
+		name:   "html characters in keys",
+		schema: `{"type":"object","properties":{"a<b&c>":{"type":"boolean"}},"required":["a<b&c>"]}`,
+		rules: `root ::= "{" space root-a-b-c--kv "}" space
+root-a-b-c--kv ::= "\"a<b&c>\"" space ":" space boolean
+`,
+	},
+	{
+		name:   "allOf",
+		schema: `{"allOf":[{"type":"string"}]}`,
+		err:    "allOf is not supported",
+	},
+	{
+		name:   "remote ref",
+		schema: `{"$ref":"https://example.com/schema.json"}`,
+		err:    "only local $ref are supported",
+	},
+	{
+		name:   "min items greater than max items",
+		schema: `{"type":"array","minItems":3,"maxItems":1}`,
+		err:    "minItems is greater than maxItems",
+	},
+}
+
+func TestSchemaToGrammar(t *testing.T) {
+	for _, tt := range schemaGrammarTests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := SchemaToGrammar(json.RawMessage(tt.schema))
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.rules + grammarPrimitives + grammarValue
+			if g != want {
+				t.Errorf("grammar mismatch\ngot:\n%s\nwant:\n%s", g, want)
+			}
+		})
+	}
+}
+
+// TestSchemaGrammarParses loads the grammars into the llama grammar sampler,
+// the model is set by LLAMA_TEST_MODEL
+func TestSchemaGrammarParses(t *testing.T) {
+	model, ok := os.LookupEnv("LLAMA_TEST_MODEL")
+	if !ok {
+		t.Skip("LLAMA_TEST_MODEL is not set")
+	}
+
+	llm := NewLLM(context.Background(), DefaultConfig())
+	if err := llm.Initilize(model); err != nil {
+		t.Fatal(err)
+	}
+	defer llm.Clean()
+
+	if err := llm.parseGrammar(JSONGrammar); err != nil {
+		t.Fatalf("json grammar, %s", err)
+	}
+	for _, tt := range schemaGrammarTests {
+		if len(tt.err) > 0 {
+			continue
+		}
+		g, err := SchemaToGrammar(json.RawMessage(tt.schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := llm.parseGrammar(g); err != nil {
+			t.Errorf("%s, %s", tt.name, err)
+		}
+	}
+}
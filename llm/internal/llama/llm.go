@@ -14,7 +14,9 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -22,45 +24,99 @@ import (
 	"github.com/soulnvkz/mq/domain"
 )
 
+var loadBackends sync.Once
+
 type Consumer interface {
 	OnNext([]byte) error
 }
 
 type LLM struct {
-	app_ctx context.Context
-	mu      sync.Mutex
+	mu sync.Mutex
+	// running are the generations in progress, the model is freed after they are stopped
+	running sync.WaitGroup
+	// loaded and last_decode are read by the health checks
+	loaded      atomic.Bool
+	last_decode atomic.Int64
 
-	cancel_list *utils.CancellationTokensCache
+	// requests are cancelled by ID in any state, even before they are taken by the worker
+	requests *utils.CancellationRegistry
 
 	model *C.struct_llama_model
 	vocab *C.struct_llama_vocab
 	ctx   *C.struct_llama_context
 
-	model_chat_template string
+	// template is the model chat template unless other template is configured
+	template    ChatTemplate
+	tool_format ToolFormat
+
+	// draft is set if speculative decoding is enabled
+	draft       *draftModel
+	speculative speculativeStats
+	// adapters are LoRA adapters by name
+	adapters map[string]*C.struct_llama_adapter_lora
 
+	config Config
+	// n_ctx is resolved when the model is loaded
 	n_predict int
 	n_ctx     int
 	n_batch   int
 }
 
-func NewLLM(ctx context.Context) *LLM {
-	cl := utils.NewCancellationTokensCache(
+func NewLLM(ctx context.Context, config Config) *LLM {
+	requests := utils.NewCancellationRegistry(
 		ctx,
 		30*time.Minute,
-		5*time.Minute)
+		time.Minute)
 
 	return &LLM{
-		app_ctx: ctx,
+		config:    config,
+		n_predict: config.NPredict,
+		n_ctx:     config.NCtx,
+		n_batch:   config.NBatch,
 
-		n_predict: 512,
-		// TODO: now n_batch should be not less that n_ctx
-		// but should be possible to it in other way
-		n_ctx:   2048,
-		n_batch: 2048,
+		mu:       sync.Mutex{},
+		requests: requests,
+	}
+}
 
-		mu:          sync.Mutex{},
-		cancel_list: cl,
+func (llm *LLM) modelParams() C.struct_llama_model_params {
+	model_params := C.llama_model_default_params()
+	model_params.n_gpu_layers = C.int32_t(llm.config.NGPULayers)
+	model_params.use_mmap = C.bool(llm.config.UseMmap)
+	model_params.use_mlock = C.bool(llm.config.UseMlock)
+	return model_params
+}
+
+func (llm *LLM) contextParams() C.struct_llama_context_params {
+	ctx_params := C.llama_context_default_params()
+	// n_ctx is the context size
+	ctx_params.n_ctx = C.uint32_t(llm.n_ctx)
+	// n_batch is the maximum number of tokens that can be processed in a single call to llama_decode
+	ctx_params.n_batch = C.uint32_t(llm.n_batch)
+	if llm.config.Threads > 0 {
+		ctx_params.n_threads = C.int32_t(llm.config.Threads)
+	}
+	if llm.config.ThreadsBatch > 0 {
+		ctx_params.n_threads_batch = C.int32_t(llm.config.ThreadsBatch)
 	}
+
+	switch llm.config.RopeScaling {
+	case RopeScalingNone:
+		ctx_params.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_NONE
+	case RopeScalingLinear:
+		ctx_params.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_LINEAR
+	case RopeScalingYarn:
+		ctx_params.rope_scaling_type = C.LLAMA_ROPE_SCALING_TYPE_YARN
+	}
+	// 0 means the value of the model
+	ctx_params.rope_freq_base = C.float(llm.config.RopeFreqBase)
+	ctx_params.rope_freq_scale = C.float(llm.config.RopeFreqScale)
+
+	ctx_params.flash_attn = C.bool(llm.config.FlashAttn)
+	// enable performance counters
+	ctx_params.no_perf = false
+
+	return ctx_params
 }
 
 func (llm *LLM) loadModel(model_path string) error {
@@ -71,10 +127,9 @@ func (llm *LLM) loadModel(model_path string) error {
 		return fmt.Errorf("model has initilized already")
 	}
 
-	model_params := C.llama_model_default_params()
-	model_params.n_gpu_layers = 0
-
-	model := C.llama_model_load_from_file(C.CString(model_path), model_params)
+	path := C.CString(model_path)
+	model := C.llama_model_load_from_file(path, llm.modelParams())
+	C.free(unsafe.Pointer(path))
 	if model == nil {
 		return fmt.Errorf("can't initilize the model")
 	}
@@ -88,24 +143,96 @@ func (llm *LLM) loadModel(model_path string) error {
 
 	template := C.llama_model_chat_template(model, nil)
 	if template != nil {
-		llm.model_chat_template = C.GoString(template)
+		llm.setChatTemplate(llamaTemplate{
+			llm:      llm,
+			name:     "model",
+			template: C.GoString(template),
+		})
+	} else {
+		llm.setChatTemplate(defaultTemplate{})
 	}
 
 	return nil
 }
 
-func (llm *LLM) initilizeContext() (*C.struct_llama_context, error) {
-	// initialize the context
+func (llm *LLM) setChatTemplate(t ChatTemplate) {
+	llm.template = t
+	llm.tool_format = NewToolFormat(templateProbe(t))
+}
 
-	ctx_params := C.llama_context_default_params()
-	// n_ctx is the context size
-	ctx_params.n_ctx = C.uint32_t(llm.n_ctx)
-	// n_batch is the maximum number of tokens that can be processed in a single call to llama_decode
-	ctx_params.n_batch = C.uint32_t(llm.n_batch)
-	// enable performance counters
-	ctx_params.no_perf = false
+// builtinTemplates lists the names of templates supported by llama.cpp
+func (llm *LLM) builtinTemplates() []string {
+	n := int(C.llama_chat_builtin_templates(nil, 0))
+	if n <= 0 {
+		return nil
+	}
+	names_c := make([]*C.char, n)
+	C.llama_chat_builtin_templates(&names_c[0], C.size_t(n))
+
+	names := make([]string, 0, n)
+	for _, name := range names_c {
+		names = append(names, C.GoString(name))
+	}
+	return names
+}
+
+// UseChatTemplate overrides the model template with the built-in template by name
+func (llm *LLM) UseChatTemplate(name string) error {
+	if alias, ok := templateAliases[name]; ok {
+		name = alias
+	}
+
+	builtin := llm.builtinTemplates()
+	for _, b := range builtin {
+		if b == name {
+			llm.setChatTemplate(llamaTemplate{
+				llm:      llm,
+				name:     name,
+				template: name,
+			})
+			return nil
+		}
+	}
 
-	ctx := C.llama_init_from_model(llm.model, ctx_params)
+	return fmt.Errorf("unknown chat template %s, supported templates: %s", name, strings.Join(builtin, ", "))
+}
+
+// LoadGoTemplate overrides the model template with go template file
+func (llm *LLM) LoadGoTemplate(path string) error {
+	t, err := loadGoTemplate(path)
+	if err != nil {
+		return err
+	}
+	llm.setChatTemplate(t)
+	return nil
+}
+
+// LoadJinjaTemplate overrides the model template with jinja template file,
+// bos_token and eos_token of the template are the texts of the model tokens
+func (llm *LLM) LoadJinjaTemplate(path string) error {
+	t, err := loadJinjaTemplate(path, llm.tokenText(C.llama_vocab_bos(llm.vocab)), llm.tokenText(C.llama_vocab_eos(llm.vocab)))
+	if err != nil {
+		return err
+	}
+	llm.setChatTemplate(t)
+	return nil
+}
+
+// tokenText is the text of the special token, it is empty if the model has no such token
+func (llm *LLM) tokenText(token C.llama_token) string {
+	if token < 0 {
+		return ""
+	}
+	return C.GoString(C.llama_vocab_get_text(llm.vocab, token))
+}
+
+// ChatTemplate is the name of the template the prompt is rendered with
+func (llm *LLM) ChatTemplate() string {
+	return llm.template.Name()
+}
+
+func (llm *LLM) initilizeContext() (*C.struct_llama_context, error) {
+	ctx := C.llama_init_from_model(llm.model, llm.contextParams())
 	if ctx == nil {
 		return nil, fmt.Errorf("can't initiliize context")
 	}
@@ -113,7 +240,36 @@ func (llm *LLM) initilizeContext() (*C.struct_llama_context, error) {
 	return ctx, nil
 }
 
-func (llm *LLM) initilizeSampler() (*C.struct_llama_sampler, error) {
+// resolveContext sets the context size and checks it against the model
+func (llm *LLM) resolveContext() error {
+	n_ctx_train := int(C.llama_model_n_ctx_train(llm.model))
+	llm.n_ctx = llm.config.NCtx
+	if llm.n_ctx == 0 {
+		llm.n_ctx = n_ctx_train
+	}
+	if err := llm.config.validateTrained(n_ctx_train); err != nil {
+		return err
+	}
+	if llm.n_predict >= llm.n_ctx {
+		return fmt.Errorf("n_predict %d should be less than n_ctx %d", llm.n_predict, llm.n_ctx)
+	}
+	llm.n_batch = min(llm.config.NBatch, llm.n_ctx)
+
+	return nil
+}
+
+// decodeTokens evaluates the tokens by chunks of n_batch, logits are computed for the last token only
+func decodeTokens(ctx *C.struct_llama_context, tokens []C.llama_token, n_batch int) error {
+	for i := 0; i < len(tokens); i += n_batch {
+		n := min(n_batch, len(tokens)-i)
+		if C.llama_decode(ctx, C.llama_batch_get_one(&tokens[i], C.int32_t(n))) != 0 {
+			return errors.New("failed to eval prompt")
+		}
+	}
+	return nil
+}
+
+func (llm *LLM) initilizeSampler(s Sampling) (*C.struct_llama_sampler, error) {
 	sparams := C.llama_sampler_chain_default_params()
 	sparams.no_perf = false
 
@@ -122,71 +278,197 @@ func (llm *LLM) initilizeSampler() (*C.struct_llama_sampler, error) {
 		return nil, fmt.Errorf("can't initiliize sampler")
 	}
 
+	// grammar goes first, so the next samplers choose only from the tokens allowed by it
+	if len(s.Grammar) > 0 {
+		g, err := llm.grammarSampler(s.Grammar)
+		if err != nil {
+			C.llama_sampler_free(smpl)
+			return nil, err
+		}
+		C.llama_sampler_chain_add(smpl, g)
+	}
+
 	seed := rand.Uint32()
 	// C.llama_sampler_chain_add(smpl, C.llama_sampler_init_greedy())
-	C.llama_sampler_chain_add(smpl, C.llama_sampler_init_temp(C.float(0.8)))
-	C.llama_sampler_chain_add(smpl, C.llama_sampler_init_min_p(C.float(0.05), C.size_t(1)))
+	C.llama_sampler_chain_add(smpl, C.llama_sampler_init_temp(C.float(s.Temperature)))
+	C.llama_sampler_chain_add(smpl, C.llama_sampler_init_min_p(C.float(s.MinP), C.size_t(1)))
 	C.llama_sampler_chain_add(smpl, C.llama_sampler_init_dist(C.uint32_t(seed)))
 
 	return smpl, nil
 }
 
+// grammarSampler parses GBNF grammar starting at root rule
+func (llm *LLM) grammarSampler(grammar string) (*C.struct_llama_sampler, error) {
+	g := C.CString(grammar)
+	root := C.CString("root")
+	defer C.free(unsafe.Pointer(g))
+	defer C.free(unsafe.Pointer(root))
+
+	smpl := C.llama_sampler_init_grammar(llm.vocab, g, root)
+	if smpl == nil {
+		return nil, fmt.Errorf("can't parse grammar")
+	}
+	return smpl, nil
+}
+
+// parseGrammar checks the grammar is accepted by the grammar sampler of the model
+func (llm *LLM) parseGrammar(grammar string) error {
+	smpl, err := llm.grammarSampler(grammar)
+	if err != nil {
+		return err
+	}
+	C.llama_sampler_free(smpl)
+	return nil
+}
+
 func (llm *LLM) tokenizePrompt(prompt string) (int, []C.llama_token, error) {
-	// find the number of tokens in the prompt
-	n_prompt := int(-C.llama_tokenize(llm.vocab, C.CString(prompt), C.int(len(prompt)), nil, 0, true, true))
-	prompt_tokens := make([]C.llama_token, n_prompt)
-	if C.llama_tokenize(llm.vocab, C.CString(prompt), C.int(len(prompt)), &prompt_tokens[0], C.int(len(prompt)), true, true) < 0 {
+	prompt_c := C.CString(prompt)
+	defer C.free(unsafe.Pointer(prompt_c))
+
+	// a token is at least one byte, the special tokens are added to them
+	prompt_tokens := make([]C.llama_token, len(prompt)+2)
+	n_prompt := C.llama_tokenize(llm.vocab, prompt_c, C.int(len(prompt)), &prompt_tokens[0], C.int(len(prompt_tokens)), true, true)
+	if n_prompt < 0 {
+		// the negative count is the number of tokens which do not fit
+		prompt_tokens = make([]C.llama_token, -n_prompt)
+		n_prompt = C.llama_tokenize(llm.vocab, prompt_c, C.int(len(prompt)), &prompt_tokens[0], C.int(len(prompt_tokens)), true, true)
+	}
+	if n_prompt < 0 {
 		return 0, nil, fmt.Errorf("prompt tokenize failed")
 	}
+	// the last token of the prompt is decoded by the generation, so there should be one
+	if n_prompt == 0 {
+		return 0, nil, errors.New("prompt is empty")
+	}
+
+	return int(n_prompt), prompt_tokens[:n_prompt], nil
+}
+
+func (llm *LLM) tokenToPiece(token C.llama_token) ([]byte, error) {
+	buf := make([]C.char, 128)
+
+	n := C.llama_token_to_piece(llm.vocab, token, &buf[0], C.int(len(buf)), 0, true)
+	if n < 0 {
+		return nil, fmt.Errorf("failed to convert token to piece")
+	}
+	return C.GoBytes(unsafe.Pointer(&buf[0]), n), nil
+}
+
+// logprob reads the logits of the last decoded token, so it should be called before the next decode
+func (llm *LLM) logprob(token C.llama_token, idx C.int32_t, top int) *domain.TokenLogprob {
+	n_vocab := int(C.llama_vocab_n_tokens(llm.vocab))
+	logits := unsafe.Slice((*float32)(unsafe.Pointer(C.llama_get_logits_ith(llm.ctx, idx))), n_vocab)
 
-	return n_prompt, prompt_tokens, nil
+	return tokenLogprob(logits, int32(token), top, func(id int32) string {
+		piece, err := llm.tokenToPiece(C.llama_token(id))
+		if err != nil {
+			return ""
+		}
+		return string(piece)
+	})
 }
 
 func (llm *LLM) Initilize(model string) error {
-	// init backend
-	C.ggml_backend_load_all()
+	// init backend, the backends are loaded once as the model can be swapped
+	loadBackends.Do(func() {
+		C.ggml_backend_load_all()
+	})
 	err := llm.loadModel(model)
 	if err != nil {
 		return err
 	}
+	if err := llm.resolveContext(); err != nil {
+		llm.Clean()
+		return err
+	}
 	ctx, err := llm.initilizeContext()
 	if err != nil {
+		llm.Clean()
 		return err
 	}
 	llm.ctx = ctx
+	llm.loaded.Store(true)
+	log.Printf("context: n_ctx %d, n_batch %d, n_predict %d", llm.n_ctx, llm.n_batch, llm.n_predict)
 
 	return nil
 }
 
+// Loaded reports whether the model is ready for the requests, it is not while the model is swapped
+func (llm *LLM) Loaded() bool {
+	return llm.loaded.Load()
+}
+
+func (llm *LLM) decoded() {
+	llm.last_decode.Store(time.Now().UnixNano())
+}
+
+// LastDecode is the time of the last successful decode, it is zero if nothing is decoded yet
+func (llm *LLM) LastDecode() time.Time {
+	n := llm.last_decode.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Clean waits for the running generations and frees the model, the other model can be initilized then
 func (llm *LLM) Clean() error {
+	llm.running.Wait()
+	llm.loaded.Store(false)
+
+	if llm.draft != nil {
+		llm.speculative.enabled.Store(false)
+		llm.draft.free()
+		llm.draft = nil
+	}
+	llm.freeAdapters()
 	C.llama_free(llm.ctx)
 	C.llama_model_free(llm.model)
 
 	llm.ctx = nil
 	llm.model = nil
+	llm.vocab = nil
 
 	return nil
 }
 
+// Accept registers the request taken by the worker, it fails with utils.ErrRequestCancelled
+// if the request is cancelled before
+func (llm *LLM) Accept(req_id string) error {
+	return llm.requests.Accept(req_id)
+}
+
+// Finish ends the accepted request which is not proccessed
+func (llm *LLM) Finish(req_id string) {
+	llm.requests.Finish(req_id)
+}
+
+// Cancel stops the request, the request which is not taken yet is not started later
 func (llm *LLM) Cancel(req_id string) {
-	c, ok := llm.cancel_list.Get(req_id)
-	if !ok {
-		log.Printf("Cancel: adding ctx for %s", req_id)
-		ctx, cancel := context.WithCancel(llm.app_ctx)
-
-		llm.cancel_list.Put(req_id, &utils.CancelToken{
-			Ctx:    &ctx,
-			Cancel: &cancel,
-		})
-		return
+	prev := llm.requests.Cancel(req_id)
+	switch prev {
+	case utils.RequestUnknown:
+		log.Printf("Cancel: %s is cancelled before it is taken", req_id)
+	case utils.RequestPending, utils.RequestRunning:
+		log.Printf("Cancel: %s is cancelled, it was %s", req_id, prev)
+	default:
+		log.Printf("Cancel: %s is %s already", req_id, prev)
 	}
+}
+
+// RequestState is the state of the request, the stopped request is cancelled or finished
+func (llm *LLM) RequestState(req_id string) utils.RequestState {
+	return llm.requests.State(req_id)
+}
 
-	log.Printf("Cancel: ctx %s already exists, call cancel", req_id)
-	(*c.Cancel)()
+// end finishes the request, then the stream is stopped
+func (llm *LLM) end(req_id string, stop chan bool) {
+	llm.requests.Finish(req_id)
+	stop <- true
 }
 
-func (llm *LLM) Proccess(ctx context.Context, prompt string, req string) (chan []byte, chan bool, error) {
-	smpl, err := llm.initilizeSampler()
+func (llm *LLM) Proccess(ctx context.Context, prompt string, req string, s Sampling) (chan Token, chan bool, error) {
+	smpl, err := llm.initilizeSampler(s)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -197,56 +479,66 @@ func (llm *LLM) Proccess(ctx context.Context, prompt string, req string) (chan [
 		return nil, nil, err
 	}
 
+	if err := llm.applyAdapter(s); err != nil {
+		C.llama_sampler_free(smpl)
+		return nil, nil, err
+	}
+
 	C.llama_kv_cache_clear(llm.ctx)
 
-	_, ok := llm.cancel_list.Get(req)
-	var req_ctx context.Context
-	var cancel context.CancelFunc
-	if !ok {
-		log.Printf("ProccessNext: adding ctx for %s", req)
-		req_ctx, cancel = context.WithCancel(llm.app_ctx)
-		llm.cancel_list.Put(req, &utils.CancelToken{
-			Ctx:    &ctx,
-			Cancel: &cancel,
-		})
-	} else {
-		log.Printf("ProccessNext: ctx %s already exists", req)
+	req_ctx, err := llm.requests.Start(ctx, req)
+	if err != nil {
+		log.Printf("Proccess: %s, %s", req, err)
 		C.llama_sampler_free(smpl)
-		return nil, nil, errors.New("request has canceled already")
+		return nil, nil, err
 	}
 
-	batch := C.llama_batch_get_one(&prompt_tokens[0], C.int(len(prompt_tokens)))
+	// stop is buffered, so the generation ends even if the reader has gone
+	stop := make(chan bool, 1)
+	next := make(chan Token)
+
+	llm.running.Add(1)
+	if llm.draft != nil {
+		go llm.speculate(req_ctx, req, prompt_tokens, s, smpl, next, stop)
+		return next, stop, nil
+	}
+
+	// the prompt is evaluated by chunks of n_batch, the last chunk is decoded by the generation loop
+	last := (len(prompt_tokens) - 1) / llm.n_batch * llm.n_batch
+	batch := C.llama_batch_get_one(&prompt_tokens[last], C.int(len(prompt_tokens)-last))
 	n_decode := 0
 	new_token_id := C.llama_token(0)
 
-	n_pos := 0
-	stop := make(chan bool)
-	next := make(chan []byte)
+	n_pos := last
 
 	go func(smpl *C.struct_llama_sampler) {
 		defer func() {
 			C.llama_sampler_free(smpl)
+			llm.running.Done()
 		}()
+		if err := decodeTokens(llm.ctx, prompt_tokens[:last], llm.n_batch); err != nil {
+			log.Printf("%s", err)
+			llm.end(req, stop)
+			return
+		}
 	loop:
 		for {
 			select {
 			case <-req_ctx.Done():
-				stop <- true
-				break loop
-			case <-ctx.Done():
-				stop <- true
+				llm.end(req, stop)
 				break loop
 			default:
 				if n_pos+int(batch.n_tokens) >= int(n_prompt)+llm.n_predict {
-					stop <- true
+					llm.end(req, stop)
 					break loop
 				}
 				// evaluate the current batch with the transformer model
 				if C.llama_decode(llm.ctx, batch) > 0 {
 					log.Printf("failed to eval current batch")
-					stop <- true
+					llm.end(req, stop)
 					break loop
 				}
+				llm.decoded()
 
 				n_pos += int(batch.n_tokens)
 
@@ -255,20 +547,26 @@ func (llm *LLM) Proccess(ctx context.Context, prompt string, req string) (chan [
 
 				// is it an end of generation?
 				if C.llama_vocab_is_eog(llm.vocab, new_token_id) {
-					stop <- true
+					llm.end(req, stop)
 					break loop
 				}
 
-				buf := make([]C.char, 128)
-
-				n := C.llama_token_to_piece(llm.vocab, new_token_id, &buf[0], C.int(len(buf)), 0, true)
-				if n < 0 {
-					log.Printf("failed to convert token to piece")
-					stop <- true
+				piece, err := llm.tokenToPiece(new_token_id)
+				if err != nil {
+					log.Printf("%s", err)
+					llm.end(req, stop)
+					break loop
+				}
+				t := Token{Piece: piece}
+				if s.Logprobs {
+					t.Logprob = llm.logprob(new_token_id, -1, s.TopLogprobs)
+				}
+				select {
+				case next <- t:
+				case <-req_ctx.Done():
+					llm.end(req, stop)
 					break loop
 				}
-				cstr := (*C.char)(unsafe.Pointer(&buf[0])) // Get pointer to the first element
-				next <- []byte(C.GoString(cstr))
 				// prepare the next batch with the sampled token
 				batch = C.llama_batch_get_one(&new_token_id, 1)
 				n_decode += 1
@@ -280,9 +578,64 @@ func (llm *LLM) Proccess(ctx context.Context, prompt string, req string) (chan [
 	return next, stop, nil
 }
 
-func (llm *LLM) ApplyChatTemplate(messages []domain.ChatMessage) (string, error) {
+// Generate completes the prompt and waits for the whole result,
+// it is used by the worker itself, for example to summarize the chat history
+func (llm *LLM) Generate(ctx context.Context, prompt string, n_predict int) (string, error) {
+	smpl, err := llm.initilizeSampler(Sampling{})
+	if err != nil {
+		return "", err
+	}
+	defer C.llama_sampler_free(smpl)
+
+	_, prompt_tokens, err := llm.tokenizePrompt(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	// the worker itself uses the base model
+	if err := llm.applyAdapter(Sampling{}); err != nil {
+		return "", err
+	}
+
+	C.llama_kv_cache_clear(llm.ctx)
+
+	last := (len(prompt_tokens) - 1) / llm.n_batch * llm.n_batch
+	if err := decodeTokens(llm.ctx, prompt_tokens[:last], llm.n_batch); err != nil {
+		return "", err
+	}
+	batch := C.llama_batch_get_one(&prompt_tokens[last], C.int(len(prompt_tokens)-last))
+	new_token_id := C.llama_token(0)
+	result := make([]byte, 0, n_predict*4)
+
+	for i := 0; i < n_predict; i++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if C.llama_decode(llm.ctx, batch) != 0 {
+			return "", errors.New("failed to eval current batch")
+		}
+		llm.decoded()
+
+		new_token_id = C.llama_sampler_sample(smpl, llm.ctx, -1)
+		if C.llama_vocab_is_eog(llm.vocab, new_token_id) {
+			break
+		}
+
+		piece, err := llm.tokenToPiece(new_token_id)
+		if err != nil {
+			return "", err
+		}
+		result = append(result, piece...)
+
+		batch = C.llama_batch_get_one(&new_token_id, 1)
+	}
+
+	return string(result), nil
+}
+
+func (llm *LLM) applyChatTemplate(template string, messages []domain.ChatMessage) (string, error) {
 	llama_messages := make([]C.llama_chat_message, len(messages))
-	modelTemplateC := C.CString(llm.model_chat_template)
+	modelTemplateC := C.CString(template)
 
 	defer func() {
 		for _, lm := range llama_messages {
@@ -301,7 +654,10 @@ func (llm *LLM) ApplyChatTemplate(messages []domain.ChatMessage) (string, error)
 
 	buff := make([]C.char, llm.n_ctx*2)
 
-	llama_messages_ptr := (*C.llama_chat_message)(unsafe.Pointer(&llama_messages[0]))
+	var llama_messages_ptr *C.llama_chat_message
+	if len(llama_messages) > 0 {
+		llama_messages_ptr = (*C.llama_chat_message)(unsafe.Pointer(&llama_messages[0]))
+	}
 	buff_ptr := (*C.char)(unsafe.Pointer(&buff[0]))
 
 	new_len := C.llama_chat_apply_template(
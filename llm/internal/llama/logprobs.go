@@ -0,0 +1,89 @@
+package llama
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+// Token is the generated token, Logprob is set if it is requested
+type Token struct {
+	Piece   []byte
+	Logprob *domain.TokenLogprob
+}
+
+type candidate struct {
+	id    int32
+	logit float32
+}
+
+// candidates is min-heap by logit, so it keeps the top logits while scanning the vocab
+type candidates []candidate
+
+func (c candidates) Len() int           { return len(c) }
+func (c candidates) Less(i, j int) bool { return c[i].logit < c[j].logit }
+func (c candidates) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c *candidates) Push(x any)        { *c = append(*c, x.(candidate)) }
+func (c *candidates) Pop() any {
+	old := *c
+	x := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return x
+}
+
+// logSoftmax returns log of the softmax denominator of the logits
+func logSoftmax(logits []float32) float64 {
+	max := float32(math.Inf(-1))
+	for _, l := range logits {
+		if l > max {
+			max = l
+		}
+	}
+
+	sum := 0.0
+	for _, l := range logits {
+		sum += math.Exp(float64(l - max))
+	}
+	return float64(max) + math.Log(sum)
+}
+
+// topLogits returns n most likely tokens ordered from the most likely one
+func topLogits(logits []float32, n int) []candidate {
+	h := make(candidates, 0, n+1)
+	for id, l := range logits {
+		if len(h) < n {
+			heap.Push(&h, candidate{id: int32(id), logit: l})
+		} else if n > 0 && l > h[0].logit {
+			h[0] = candidate{id: int32(id), logit: l}
+			heap.Fix(&h, 0)
+		}
+	}
+
+	top := make([]candidate, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(candidate)
+	}
+	return top
+}
+
+// tokenLogprob computes log-probabilities of the token and its alternatives from the model logits,
+// piece converts token ID to its text
+func tokenLogprob(logits []float32, id int32, top int, piece func(int32) string) *domain.TokenLogprob {
+	z := logSoftmax(logits)
+
+	lp := &domain.TokenLogprob{
+		Token:   piece(id),
+		ID:      id,
+		Logprob: float32(float64(logits[id]) - z),
+	}
+
+	for _, c := range topLogits(logits, min(top, domain.MaxTopLogprobs)) {
+		lp.TopLogprobs = append(lp.TopLogprobs, domain.TopLogprob{
+			Token:   piece(c.id),
+			ID:      c.id,
+			Logprob: float32(float64(c.logit) - z),
+		})
+	}
+	return lp
+}
@@ -0,0 +1,75 @@
+package llama
+
+/*
+#include "llama.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// LoadAdapter loads LoRA adapter of the model, the adapter is applied to the requests which select it by name
+func (llm *LLM) LoadAdapter(name string, path string) error {
+	if llm.model == nil {
+		return errors.New("model should be loaded before the adapters")
+	}
+	if _, ok := llm.adapters[name]; ok {
+		return fmt.Errorf("adapter %s has loaded already", name)
+	}
+
+	path_c := C.CString(path)
+	adapter := C.llama_adapter_lora_init(llm.model, path_c)
+	C.free(unsafe.Pointer(path_c))
+	if adapter == nil {
+		return fmt.Errorf("can't load adapter %s from %s", name, path)
+	}
+
+	if llm.adapters == nil {
+		llm.adapters = make(map[string]*C.struct_llama_adapter_lora)
+	}
+	llm.adapters[name] = adapter
+
+	return nil
+}
+
+// Adapters are the names of the loaded adapters
+func (llm *LLM) Adapters() []string {
+	names := make([]string, 0, len(llm.adapters))
+	for name := range llm.adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyAdapter sets the adapter of the request to the context, the previous adapter is removed
+func (llm *LLM) applyAdapter(s Sampling) error {
+	C.llama_clear_adapter_lora(llm.ctx)
+	if len(s.Adapter) == 0 {
+		return nil
+	}
+
+	adapter, ok := llm.adapters[s.Adapter]
+	if !ok {
+		return fmt.Errorf("adapter %s is not loaded", s.Adapter)
+	}
+	if C.llama_set_adapter_lora(llm.ctx, adapter, C.float(s.AdapterScale)) != 0 {
+		return fmt.Errorf("can't apply adapter %s", s.Adapter)
+	}
+	return nil
+}
+
+func (llm *LLM) freeAdapters() {
+	if llm.ctx != nil {
+		C.llama_clear_adapter_lora(llm.ctx)
+	}
+	for _, adapter := range llm.adapters {
+		C.llama_adapter_lora_free(adapter)
+	}
+	llm.adapters = nil
+}
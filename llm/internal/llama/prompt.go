@@ -1,14 +1,30 @@
 package llama
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/soulnvkz/mq/domain"
 )
 
+var ErrPromptTooLong = errors.New("prompt does not fit into the context window")
+
 type PromptBuilder interface {
-	Build(messages []domain.ChatMessage, next string) (string, error)
+	Build(ctx context.Context, r domain.CompletionsRequest) (Prompt, error)
+	// Preview builds the prompt without generation, the summary of the dropped messages is not made
+	Preview(ctx context.Context, r domain.CompletionsRequest, s Sampling) (domain.PromptPreview, error)
+}
+
+// Prompt is the text for the model with details of how it was built
+type Prompt struct {
+	Text    string
+	Context domain.ContextReport
+	// Dropped are the indices of the history messages which are not in the prompt
+	Dropped []int
+	// Tools is the format of tool calls in the output, it is nil if the model is not offered tools
+	Tools ToolFormat
 }
 
 type LLMPromptBuilder struct {
@@ -21,71 +37,154 @@ func NewPromptBuilder(llm *LLM) LLMPromptBuilder {
 	}
 }
 
-func (b LLMPromptBuilder) promptFromModelChatTemplate(messages []domain.ChatMessage) (string, error) {
-	i := 0
-	for {
-		p, err := b.llm.ApplyChatTemplate(messages)
-		if err != nil {
-			return "", err
-		}
-		l, _, err := b.llm.tokenizePrompt(p)
-		if err != nil {
-			return "", err
-		}
-		if l <= (b.llm.n_ctx - b.llm.n_predict) {
-			return p, nil
-		}
+func promptFromDefaultTemplate(messages []domain.ChatMessage) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "<|start_header_id|>%s<|end_header_id|>%s<|eot_id|>\n", m.Role, m.Content)
+	}
+	b.WriteString("<|start_header_id|>assistant<|end_header_id|>")
 
-		i++
-		if len(messages) == 0 {
-			return "", errors.New("")
-		}
+	return b.String()
+}
+
+// render applies the chat template to the messages and opens the assistant turn with the prefill.
+// Returns the prompt and its length in tokens
+func (b LLMPromptBuilder) render(messages []domain.ChatMessage, prefill string) (string, int, error) {
+	p, err := b.llm.template.Apply(messages)
+	if err != nil {
+		return "", 0, err
+	}
+	p += prefill
 
-		messages = messages[1:]
+	l, _, err := b.llm.tokenizePrompt(p)
+	if err != nil {
+		return "", 0, err
 	}
+
+	return p, l, nil
 }
 
-func (b LLMPromptBuilder) promptFromDefaultTemplate(messages []domain.ChatMessage) (string, error) {
-	assistant := "<|start_header_id|>assistant<|end_header_id|>"
-	buff := make([]byte, len(assistant))
-	copy(buff, []byte(assistant))
-
-	for i := len(messages) - 1; i >= 0; i-- {
-		var m string
-		switch {
-		case messages[i].Role == "user":
-			m = fmt.Sprintf("<|start_header_id|>user<|end_header_id|>%s<|eot_id|>\n", messages[i].Content)
-		case messages[i].Role == "assistant":
-			m = fmt.Sprintf("<|start_header_id|>assistant<|end_header_id|>%s<|eot_id|>\n", messages[i].Content)
-		default:
-			continue
-		}
+// limit is the number of prompt tokens which leaves room for the generation
+func (b LLMPromptBuilder) limit() int {
+	return b.llm.n_ctx - b.llm.n_predict
+}
 
-		newbuff := make([]byte, len(m)+len(buff))
-		copy(newbuff, []byte(m))
-		copy(newbuff[len(m):], buff)
-		l, _, err := b.llm.tokenizePrompt(string(newbuff))
-		if err != nil {
-			return "", err
-		}
+// raw uses the request prompt as is, it is not fitted into the context window
+func (b LLMPromptBuilder) raw(r domain.CompletionsRequest) (Prompt, error) {
+	if len(r.ChatMessages) > 0 || len(r.Content) > 0 || len(r.Prefill) > 0 {
+		return Prompt{}, errors.New("raw prompt can't be used with chat messages")
+	}
+	if len(r.Tools) > 0 {
+		return Prompt{}, errors.New("tools can't be used with raw prompt")
+	}
 
-		if l >= (b.llm.n_ctx - b.llm.n_predict) {
-			return string(buff), nil
-		}
-		buff = newbuff
+	l, _, err := b.llm.tokenizePrompt(r.Prompt)
+	if err != nil {
+		return Prompt{}, err
+	}
+	if l > b.limit() {
+		return Prompt{}, ErrPromptTooLong
 	}
 
-	return string(buff), nil
+	return Prompt{Text: r.Prompt}, nil
 }
 
-func (b LLMPromptBuilder) Build(messages []domain.ChatMessage, next string) (string, error) {
-	messages = append(messages, domain.ChatMessage{
-		Role:    "user",
-		Content: next,
+// Build makes the prompt for the request. The prompt ends with an open assistant turn,
+// which starts with the incomplete last assistant message and the request prefill if any.
+// Raw prompt of the request is used without the chat template
+func (b LLMPromptBuilder) Build(ctx context.Context, r domain.CompletionsRequest) (Prompt, error) {
+	return b.build(ctx, r, false)
+}
+
+func (b LLMPromptBuilder) Preview(ctx context.Context, r domain.CompletionsRequest, s Sampling) (domain.PromptPreview, error) {
+	if _, ok := b.llm.adapters[s.Adapter]; len(s.Adapter) > 0 && !ok {
+		return domain.PromptPreview{}, fmt.Errorf("adapter %s is not loaded", s.Adapter)
+	}
+
+	p, err := b.build(ctx, r, true)
+	if err != nil {
+		return domain.PromptPreview{}, err
+	}
+
+	l, _, err := b.llm.tokenizePrompt(p.Text)
+	if err != nil {
+		return domain.PromptPreview{}, err
+	}
+
+	dropped := p.Dropped
+	if dropped == nil {
+		dropped = []int{}
+	}
+	return domain.PromptPreview{
+		Prompt:   p.Text,
+		Tokens:   l,
+		Template: b.llm.ChatTemplate(),
+		Context:  p.Context,
+		Dropped:  dropped,
+		Sampling: s.Params(b.llm.n_predict),
+	}, nil
+}
+
+func (b LLMPromptBuilder) build(ctx context.Context, r domain.CompletionsRequest, preview bool) (Prompt, error) {
+	if len(r.Prompt) > 0 {
+		return b.raw(r)
+	}
+
+	history := r.ChatMessages
+	prefill := r.Prefill
+	tail := make([]domain.ChatMessage, 0, 1)
+
+	n := len(history)
+	switch {
+	case n > 0 && history[n-1].Incomplete:
+		last := history[n-1]
+		if last.Role != "assistant" {
+			return Prompt{}, errors.New("only assistant message can be continued")
+		}
+		prefill = last.Content + prefill
+		history = history[:n-1]
+	case len(r.Content) > 0:
+		tail = append(tail, domain.ChatMessage{
+			Role:    "user",
+			Content: r.Content,
+		})
+	case n > 0 && history[n-1].Role == "tool":
+		// the assistant replies to the tool results
+	default:
+		return Prompt{}, errors.New("content is required for completions")
+	}
+
+	format := b.llm.tool_format
+	prefix := make([]domain.ChatMessage, 0, 1)
+	var tools ToolFormat
+	if len(r.Tools) > 0 && r.ToolChoice != domain.ToolChoiceNone {
+		prefix = append(prefix, format.System(r.Tools))
+		tools = format
+	}
+
+	// tool calls and results are rendered as plain messages the chat template understands
+	rendered := make([]domain.ChatMessage, len(history))
+	for i, m := range history {
+		rendered[i] = format.Message(m)
+	}
+
+	strategy, err := NewContextStrategy(r.Context)
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	p, err := strategy.Fit(ctx, &contextWindow{
+		b:       b,
+		prefix:  prefix,
+		history: rendered,
+		tail:    tail,
+		prefill: prefill,
+		preview: preview,
 	})
-	if len(b.llm.model_chat_template) > 0 {
-		return b.promptFromModelChatTemplate(messages)
-	} else {
-		return b.promptFromDefaultTemplate(messages)
+	if err != nil {
+		return Prompt{}, err
 	}
+	p.Tools = tools
+
+	return p, nil
 }
@@ -0,0 +1,93 @@
+package llama
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+const (
+	defaultTemperature = 0.8
+	defaultMinP        = 0.05
+)
+
+// Sampling holds the sampler settings and the adapter of the request
+type Sampling struct {
+	Temperature float32
+	MinP        float32
+	// Grammar is GBNF grammar the output is constrained with
+	Grammar string
+
+	Logprobs    bool
+	TopLogprobs int
+
+	// Adapter is LoRA adapter applied to the model with AdapterScale
+	Adapter      string
+	AdapterScale float32
+}
+
+func NewSampling(r domain.CompletionsRequest) (Sampling, error) {
+	s := Sampling{
+		Temperature: defaultTemperature,
+		MinP:        defaultMinP,
+		Grammar:     r.Grammar,
+		Logprobs:    r.Logprobs,
+		TopLogprobs: r.TopLogprobs,
+	}
+
+	if len(r.Adapter) > 0 {
+		if r.AdapterScale < 0 {
+			return Sampling{}, errors.New("adapter scale should not be negative")
+		}
+		s.Adapter = r.Adapter
+		s.AdapterScale = r.AdapterScale
+		if s.AdapterScale == 0 {
+			s.AdapterScale = 1
+		}
+	}
+
+	if r.TopLogprobs < 0 || r.TopLogprobs > domain.MaxTopLogprobs {
+		return Sampling{}, fmt.Errorf("top logprobs should be between 0 and %d", domain.MaxTopLogprobs)
+	}
+
+	if len(r.JSONSchema) > 0 {
+		if len(r.Grammar) > 0 {
+			return Sampling{}, errors.New("only one of grammar and json schema can be set")
+		}
+		g, err := SchemaToGrammar(r.JSONSchema)
+		if err != nil {
+			return Sampling{}, err
+		}
+		s.Grammar = g
+	}
+
+	// the grammar matches the reply from its start, so the reply which starts with the prefill
+	// or continues the incomplete message would be rejected by it
+	if len(s.Grammar) > 0 && prefilled(r) {
+		return Sampling{}, errors.New("prefill and incomplete messages can't be used with grammar or json schema")
+	}
+
+	return s, nil
+}
+
+// prefilled reports whether the reply of the request starts with the given text
+func prefilled(r domain.CompletionsRequest) bool {
+	n := len(r.ChatMessages)
+	return len(r.Prefill) > 0 || (n > 0 && r.ChatMessages[n-1].Incomplete)
+}
+
+// Params are the settings reported by the dry run
+func (s Sampling) Params(n_predict int) domain.SamplingParams {
+	return domain.SamplingParams{
+		Temperature: s.Temperature,
+		MinP:        s.MinP,
+		NPredict:    n_predict,
+		Grammar:     s.Grammar,
+		Logprobs:    s.Logprobs,
+		TopLogprobs: s.TopLogprobs,
+
+		Adapter:      s.Adapter,
+		AdapterScale: s.AdapterScale,
+	}
+}
@@ -0,0 +1,346 @@
+package llama
+
+/*
+#include "llama.h"
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// DefaultDraftTokens is the number of tokens the draft model proposes at once
+	DefaultDraftTokens = 8
+
+	// vocabMaxDifference is the max difference of the main and the draft vocab sizes, the same as in llama.cpp
+	vocabMaxDifference = 128
+	// vocabCheckStart is the first token of the text check, the first tokens are special and may differ, the same as in llama.cpp
+	vocabCheckStart = 5
+)
+
+// DraftConfig is the draft model parameters, the draft context has the size of the main context
+// because it holds the same sequence, the rest of the context parameters are of the draft model
+type DraftConfig struct {
+	// NDraft is the number of tokens the draft model proposes at once
+	NDraft     int
+	NGPULayers int
+	// Threads and ThreadsBatch are chosen by llama.cpp if they are 0
+	Threads      int
+	ThreadsBatch int
+}
+
+// draftModel is a small model with the vocab of the main model, it proposes the next tokens
+// and the main model verifies all of them with a single decode
+type draftModel struct {
+	model *C.struct_llama_model
+	vocab *C.struct_llama_vocab
+	ctx   *C.struct_llama_context
+	smpl  *C.struct_llama_sampler
+
+	n_draft int
+	n_batch int
+	// past is the number of tokens of the current sequence in the draft kv cache
+	past int
+}
+
+// speculativeStats are the totals of all requests of the draft model,
+// they are atomic to be read by the health checks while the model is swapped
+type speculativeStats struct {
+	enabled  atomic.Bool
+	drafted  atomic.Int64
+	accepted atomic.Int64
+}
+
+// LoadDraftModel enables speculative decoding with the draft model, the main model should be loaded first
+func (llm *LLM) LoadDraftModel(model_path string, cfg DraftConfig) error {
+	if llm.model == nil {
+		return errors.New("main model should be loaded before the draft model")
+	}
+	if llm.draft != nil {
+		return errors.New("draft model has initilized already")
+	}
+	if cfg.NDraft <= 0 {
+		return fmt.Errorf("number of draft tokens should be positive, got %d", cfg.NDraft)
+	}
+
+	model_params := llm.modelParams()
+	model_params.n_gpu_layers = C.int32_t(cfg.NGPULayers)
+
+	path := C.CString(model_path)
+	model := C.llama_model_load_from_file(path, model_params)
+	C.free(unsafe.Pointer(path))
+	if model == nil {
+		return fmt.Errorf("can't initilize the draft model")
+	}
+	vocab := C.llama_model_get_vocab(model)
+
+	if err := llm.checkDraftVocab(vocab); err != nil {
+		C.llama_model_free(model)
+		return err
+	}
+
+	ctx := C.llama_init_from_model(model, llm.draftContextParams(cfg))
+	if ctx == nil {
+		C.llama_model_free(model)
+		return fmt.Errorf("can't initiliize draft context")
+	}
+
+	// the draft is greedy, the main model sampler decides what is accepted
+	llm.draft = &draftModel{
+		model:   model,
+		vocab:   vocab,
+		ctx:     ctx,
+		smpl:    C.llama_sampler_init_greedy(),
+		n_draft: cfg.NDraft,
+		n_batch: llm.n_batch,
+	}
+	llm.speculative.drafted.Store(0)
+	llm.speculative.accepted.Store(0)
+	llm.speculative.enabled.Store(true)
+
+	return nil
+}
+
+// draftContextParams sizes the draft context as the main one, the rope parameters
+// of the main model config are not applied, the draft model uses its own
+func (llm *LLM) draftContextParams(cfg DraftConfig) C.struct_llama_context_params {
+	ctx_params := C.llama_context_default_params()
+	ctx_params.n_ctx = C.uint32_t(llm.n_ctx)
+	ctx_params.n_batch = C.uint32_t(llm.n_batch)
+	if cfg.Threads > 0 {
+		ctx_params.n_threads = C.int32_t(cfg.Threads)
+	}
+	if cfg.ThreadsBatch > 0 {
+		ctx_params.n_threads_batch = C.int32_t(cfg.ThreadsBatch)
+	}
+	ctx_params.flash_attn = C.bool(llm.config.FlashAttn)
+	ctx_params.no_perf = false
+
+	return ctx_params
+}
+
+// checkDraftVocab checks the draft model tokens are the same as the main model tokens, their text is compared
+// except the first special tokens
+func (llm *LLM) checkDraftVocab(vocab *C.struct_llama_vocab) error {
+	if C.llama_vocab_type(llm.vocab) != C.llama_vocab_type(vocab) {
+		return errors.New("draft model vocab type differs from the main model")
+	}
+	if C.llama_vocab_bos(llm.vocab) != C.llama_vocab_bos(vocab) || C.llama_vocab_eos(llm.vocab) != C.llama_vocab_eos(vocab) {
+		return errors.New("draft model special tokens differ from the main model")
+	}
+
+	n_main := int(C.llama_vocab_n_tokens(llm.vocab))
+	n_draft := int(C.llama_vocab_n_tokens(vocab))
+	if diff := n_main - n_draft; diff > vocabMaxDifference || diff < -vocabMaxDifference {
+		return fmt.Errorf("draft model vocab size %d differs from the main model vocab size %d", n_draft, n_main)
+	}
+
+	// the drafted tokens are decoded by the main model, so the tokens of both vocabs should have the same text
+	for i := vocabCheckStart; i < min(n_main, n_draft); i++ {
+		main_text := C.GoString(C.llama_vocab_get_text(llm.vocab, C.llama_token(i)))
+		draft_text := C.GoString(C.llama_vocab_get_text(vocab, C.llama_token(i)))
+		if main_text != draft_text {
+			return fmt.Errorf("draft model token %d is %q, the main model token is %q", i, draft_text, main_text)
+		}
+	}
+
+	return nil
+}
+
+func (d *draftModel) free() {
+	C.llama_sampler_free(d.smpl)
+	C.llama_free(d.ctx)
+	C.llama_model_free(d.model)
+}
+
+// reset starts the new sequence
+func (d *draftModel) reset() {
+	C.llama_kv_cache_clear(d.ctx)
+	d.past = 0
+}
+
+// propose generates up to n tokens which follow the tokens and id_last
+func (d *draftModel) propose(b *batch, tokens []C.llama_token, id_last C.llama_token, n int) ([]C.llama_token, error) {
+	// only the tokens the draft has not seen yet are decoded
+	d.past = min(d.past, len(tokens))
+	C.llama_kv_cache_seq_rm(d.ctx, 0, C.llama_pos(d.past), -1)
+
+	if err := decodeTokens(d.ctx, tokens[d.past:], d.n_batch); err != nil {
+		return nil, err
+	}
+
+	b.clear()
+	b.add(id_last, len(tokens), true)
+	if C.llama_decode(d.ctx, b.b) != 0 {
+		return nil, errors.New("failed to eval draft batch")
+	}
+	d.past = len(tokens) + 1
+
+	C.llama_sampler_reset(d.smpl)
+	draft := make([]C.llama_token, 0, n)
+	for len(draft) < n {
+		id := C.llama_sampler_sample(d.smpl, d.ctx, -1)
+		draft = append(draft, id)
+		if len(draft) == n || C.llama_vocab_is_eog(d.vocab, id) {
+			break
+		}
+
+		b.clear()
+		b.add(id, d.past, true)
+		if C.llama_decode(d.ctx, b.b) != 0 {
+			return nil, errors.New("failed to eval draft batch")
+		}
+		d.past++
+	}
+
+	return draft, nil
+}
+
+// Speculative reports whether the draft model is loaded
+func (llm *LLM) Speculative() bool {
+	return llm.speculative.enabled.Load()
+}
+
+// SpeculativeStats returns the number of drafted and accepted tokens of all requests of the draft model
+func (llm *LLM) SpeculativeStats() (int64, int64) {
+	return llm.speculative.drafted.Load(), llm.speculative.accepted.Load()
+}
+
+// SpeculativeAcceptance is the percent of the drafted tokens accepted by the main model
+func SpeculativeAcceptance(drafted, accepted int64) float64 {
+	if drafted == 0 {
+		return 0
+	}
+	return 100 * float64(accepted) / float64(drafted)
+}
+
+// speculate generates the reply with the draft model. Every step the draft proposes tokens,
+// the main model decodes them in one batch and samples every position, the tokens are
+// accepted while the sampled token is the same as the drafted one
+func (llm *LLM) speculate(ctx context.Context, req string, prompt_tokens []C.llama_token, s Sampling, smpl *C.struct_llama_sampler, next chan Token, stop chan bool) {
+	d := llm.draft
+	b := newBatch(d.n_draft + 1)
+
+	drafted, accepted := 0, 0
+	defer func() {
+		b.free()
+		C.llama_sampler_free(smpl)
+		llm.running.Done()
+
+		llm.speculative.drafted.Add(int64(drafted))
+		llm.speculative.accepted.Add(int64(accepted))
+		log.Printf("speculative decoding: accepted %d of %d drafted tokens (%.1f%%), total %.1f%%",
+			accepted, drafted, SpeculativeAcceptance(int64(drafted), int64(accepted)),
+			SpeculativeAcceptance(llm.SpeculativeStats()))
+	}()
+
+	d.reset()
+
+	// the last prompt token is decoded together with the first draft
+	n_prompt := len(prompt_tokens)
+	if n_prompt == 0 {
+		log.Printf("%s, prompt is empty", req)
+		llm.end(req, stop)
+		return
+	}
+	tokens := make([]C.llama_token, 0, n_prompt+llm.n_predict)
+	tokens = append(tokens, prompt_tokens[:n_prompt-1]...)
+	id_last := prompt_tokens[n_prompt-1]
+
+	if err := decodeTokens(llm.ctx, tokens, llm.n_batch); err != nil {
+		log.Printf("%s", err)
+		llm.end(req, stop)
+		return
+	}
+
+	n_generated := 0
+	for {
+		select {
+		case <-ctx.Done():
+			llm.end(req, stop)
+			return
+		default:
+		}
+
+		if n_generated >= llm.n_predict {
+			llm.end(req, stop)
+			return
+		}
+
+		n_past := len(tokens)
+		var draft []C.llama_token
+		if n := min(d.n_draft, llm.n_predict-n_generated-1); n > 0 {
+			var err error
+			draft, err = d.propose(b, tokens, id_last, n)
+			if err != nil {
+				log.Printf("%s", err)
+				llm.end(req, stop)
+				return
+			}
+		}
+
+		// verify the last token and the draft with the main model
+		b.clear()
+		b.add(id_last, n_past, true)
+		for i, t := range draft {
+			b.add(t, n_past+1+i, true)
+		}
+		if C.llama_decode(llm.ctx, b.b) != 0 {
+			log.Printf("failed to eval current batch")
+			llm.end(req, stop)
+			return
+		}
+		llm.decoded()
+
+		ids := make([]C.llama_token, 0, len(draft)+1)
+		for i := 0; i <= len(draft); i++ {
+			id := C.llama_sampler_sample(smpl, llm.ctx, C.int32_t(i))
+			ids = append(ids, id)
+			if i == len(draft) || id != draft[i] {
+				break
+			}
+		}
+		drafted += len(draft)
+		accepted += len(ids) - 1
+
+		for i, id := range ids {
+			if C.llama_vocab_is_eog(llm.vocab, id) {
+				llm.end(req, stop)
+				return
+			}
+
+			piece, err := llm.tokenToPiece(id)
+			if err != nil {
+				log.Printf("%s", err)
+				llm.end(req, stop)
+				return
+			}
+			t := Token{Piece: piece}
+			if s.Logprobs {
+				t.Logprob = llm.logprob(id, C.int32_t(i), s.TopLogprobs)
+			}
+			select {
+			case next <- t:
+			case <-ctx.Done():
+				llm.end(req, stop)
+				return
+			}
+			n_generated++
+		}
+
+		// the rejected draft tokens are removed from the caches
+		tokens = append(tokens, id_last)
+		tokens = append(tokens, ids[:len(ids)-1]...)
+		id_last = ids[len(ids)-1]
+
+		C.llama_kv_cache_seq_rm(llm.ctx, 0, C.llama_pos(len(tokens)), -1)
+		d.past = min(d.past, len(tokens))
+	}
+}
@@ -0,0 +1,193 @@
+package llama
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/soulnvkz/llm/internal/jinja"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// ChatTemplate renders the chat messages into the prompt which ends with an open assistant turn
+type ChatTemplate interface {
+	Name() string
+	Apply(messages []domain.ChatMessage) (string, error)
+}
+
+// templateAliases are short names of llama.cpp built-in templates
+var templateAliases = map[string]string{
+	"mistral": "mistral-v3",
+	"phi":     "phi3",
+}
+
+// llamaTemplate is applied by llama.cpp, it is the model template or a built-in template name.
+// llama.cpp does not run jinja, it detects the known template by its text, the templates
+// it does not know are loaded from file as jinja or go templates
+type llamaTemplate struct {
+	llm      *LLM
+	name     string
+	template string
+}
+
+func (t llamaTemplate) Name() string {
+	return t.name
+}
+
+func (t llamaTemplate) Apply(messages []domain.ChatMessage) (string, error) {
+	return t.llm.applyChatTemplate(t.template, messages)
+}
+
+// goTemplate is go text/template loaded from file. The template gets .Messages and .AddAssistant and has trim function:
+//
+//	{{range .Messages}}<|im_start|>{{.Role}}
+//	{{.Content}}<|im_end|>
+//	{{end}}{{if .AddAssistant}}<|im_start|>assistant
+//	{{end}}
+type goTemplate struct {
+	name     string
+	template *template.Template
+}
+
+type goTemplateData struct {
+	Messages     []domain.ChatMessage
+	AddAssistant bool
+}
+
+func (t goTemplate) Name() string {
+	return t.name
+}
+
+func (t goTemplate) Apply(messages []domain.ChatMessage) (string, error) {
+	var b bytes.Buffer
+	err := t.template.Execute(&b, goTemplateData{
+		Messages:     messages,
+		AddAssistant: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// jinjaTemplate is the jinja chat template of the model loaded from file, it is rendered
+// as transformers renders it with messages, bos_token, eos_token and add_generation_prompt
+type jinjaTemplate struct {
+	name     string
+	template *jinja.Template
+	bos      string
+	eos      string
+}
+
+func (t jinjaTemplate) Name() string {
+	return t.name
+}
+
+func (t jinjaTemplate) Apply(messages []domain.ChatMessage) (string, error) {
+	vars := make([]any, 0, len(messages))
+	for _, m := range messages {
+		vars = append(vars, jinjaMessage(m))
+	}
+	return t.template.Execute(map[string]any{
+		"messages":              vars,
+		"bos_token":             t.bos,
+		"eos_token":             t.eos,
+		"add_generation_prompt": true,
+		"tools":                 nil,
+	})
+}
+
+// jinjaMessage is the message as the templates get it, the fields which are not set are undefined
+func jinjaMessage(m domain.ChatMessage) map[string]any {
+	message := map[string]any{
+		"role":    m.Role,
+		"content": m.Content,
+	}
+	if len(m.ToolCalls) > 0 {
+		calls := make([]any, 0, len(m.ToolCalls))
+		for _, c := range m.ToolCalls {
+			// the templates write the arguments with tojson, so they are decoded if they are valid
+			var args any = c.Function.Arguments
+			d := json.NewDecoder(strings.NewReader(c.Function.Arguments))
+			d.UseNumber()
+			var decoded any
+			if err := d.Decode(&decoded); err == nil && !d.More() {
+				args = decoded
+			}
+			calls = append(calls, map[string]any{
+				"id":   c.ID,
+				"type": c.Type,
+				"function": map[string]any{
+					"name":      c.Function.Name,
+					"arguments": args,
+				},
+			})
+		}
+		message["tool_calls"] = calls
+	}
+	if len(m.ToolCallID) > 0 {
+		message["tool_call_id"] = m.ToolCallID
+	}
+	if len(m.Name) > 0 {
+		message["name"] = m.Name
+	}
+	return message
+}
+
+// defaultTemplate is used when the model has no template and nothing is configured
+type defaultTemplate struct{}
+
+func (defaultTemplate) Name() string {
+	return "default"
+}
+
+func (defaultTemplate) Apply(messages []domain.ChatMessage) (string, error) {
+	return promptFromDefaultTemplate(messages), nil
+}
+
+// loadGoTemplate reads go template from the file
+func loadGoTemplate(path string) (ChatTemplate, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(path).Funcs(template.FuncMap{
+		"trim": strings.TrimSpace,
+	}).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to parse chat template %s", err, path)
+	}
+
+	return goTemplate{name: path, template: t}, nil
+}
+
+// loadJinjaTemplate reads jinja template from the file, bos and eos are the texts of the model tokens
+func loadJinjaTemplate(path string, bos string, eos string) (ChatTemplate, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := jinja.Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to parse chat template %s", err, path)
+	}
+
+	return jinjaTemplate{name: path, template: t, bos: bos, eos: eos}, nil
+}
+
+// templateProbe renders a short chat, the output shows the markup of the template
+func templateProbe(t ChatTemplate) string {
+	p, err := t.Apply([]domain.ChatMessage{
+		{Role: "system", Content: "system"},
+		{Role: "user", Content: "user"},
+	})
+	if err != nil {
+		return ""
+	}
+	return p
+}
@@ -0,0 +1,339 @@
+package llama
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+// ToolFormat renders tools and tool messages the way the model was trained on
+// and parses tool calls from the model output
+type ToolFormat interface {
+	// System returns the system message describing the tools
+	System(tools []domain.Tool) domain.ChatMessage
+	// Message converts assistant tool calls and tool results to plain chat messages
+	Message(m domain.ChatMessage) domain.ChatMessage
+	// Prefixes are the beginnings of the model output with tool calls
+	Prefixes() []string
+	// Parse extracts tool calls from the model output
+	Parse(output string) ([]domain.ToolCall, error)
+}
+
+// NewToolFormat chooses the tool format by the markup of the chat template,
+// the default template is llama 3 template
+func NewToolFormat(template string) ToolFormat {
+	switch {
+	case len(template) == 0 || strings.Contains(template, "<|start_header_id|>"):
+		return llama3Tools{}
+	case strings.Contains(template, "[INST]"):
+		return mistralTools{}
+	default:
+		// hermes format is used by chatml models and works well enough for others
+		return hermesTools{}
+	}
+}
+
+func toolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+func toolsJSON(tools []domain.Tool) []string {
+	result := make([]string, 0, len(tools))
+	for _, t := range tools {
+		b, err := json.Marshal(t)
+		if err != nil {
+			continue
+		}
+		result = append(result, string(b))
+	}
+	return result
+}
+
+// rawCall is a tool call in the model output, models use both parameters and arguments names
+type rawCall struct {
+	Name       string          `json:"name"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+func (c rawCall) toolCall() (domain.ToolCall, error) {
+	if len(c.Name) == 0 {
+		return domain.ToolCall{}, errors.New("tool call without function name")
+	}
+	args := c.Arguments
+	if len(args) == 0 {
+		args = c.Parameters
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+
+	// some models return arguments as JSON encoded string
+	var encoded string
+	if err := json.Unmarshal(args, &encoded); err == nil {
+		args = json.RawMessage(encoded)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, args); err != nil {
+		return domain.ToolCall{}, fmt.Errorf("invalid tool call arguments, %w", err)
+	}
+
+	return domain.ToolCall{
+		ID:   toolCallID(),
+		Type: "function",
+		Function: domain.FunctionCall{
+			Name:      c.Name,
+			Arguments: compact.String(),
+		},
+	}, nil
+}
+
+// parseCalls decodes the sequence of JSON tool calls separated by spaces, commas or semicolons
+func parseCalls(output string) ([]domain.ToolCall, error) {
+	output = strings.TrimSpace(output)
+	if strings.HasPrefix(output, "[") {
+		var raws []rawCall
+		if err := json.Unmarshal([]byte(output), &raws); err != nil {
+			return nil, err
+		}
+		return toolCalls(raws)
+	}
+
+	raws := make([]rawCall, 0, 1)
+	for len(output) > 0 {
+		d := json.NewDecoder(strings.NewReader(output))
+		var raw rawCall
+		if err := d.Decode(&raw); err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+		output = strings.TrimLeft(output[d.InputOffset():], " \t\n;,")
+	}
+	return toolCalls(raws)
+}
+
+func toolCalls(raws []rawCall) ([]domain.ToolCall, error) {
+	calls := make([]domain.ToolCall, 0, len(raws))
+	for _, raw := range raws {
+		call, err := raw.toolCall()
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+func callJSON(c domain.ToolCall, argsKey string) string {
+	args := json.RawMessage(c.Function.Arguments)
+	if !json.Valid(args) {
+		args = json.RawMessage("{}")
+	}
+	name, _ := json.Marshal(c.Function.Name)
+	return fmt.Sprintf(`{"name": %s, "%s": %s}`, name, argsKey, args)
+}
+
+// llama3Tools is JSON based tool calling of Llama 3.1 and later,
+// tool results are passed with ipython role
+type llama3Tools struct{}
+
+func (llama3Tools) System(tools []domain.Tool) domain.ChatMessage {
+	return domain.ChatMessage{
+		Role: "system",
+		Content: "Environment: ipython\n\n" +
+			"You have access to the following functions. When you receive a tool call response, " +
+			"use the output to format an answer to the original user question.\n\n" +
+			"If you choose to call a function, respond only with a JSON for a function call " +
+			`in the format {"name": function name, "parameters": dictionary of argument name and its value}. ` +
+			"Do not use variables.\n\n" +
+			strings.Join(toolsJSON(tools), "\n\n"),
+	}
+}
+
+func (llama3Tools) Message(m domain.ChatMessage) domain.ChatMessage {
+	switch {
+	case m.Role == "assistant" && len(m.ToolCalls) > 0:
+		calls := make([]string, 0, len(m.ToolCalls))
+		for _, c := range m.ToolCalls {
+			calls = append(calls, callJSON(c, "parameters"))
+		}
+		return domain.ChatMessage{Role: "assistant", Content: m.Content + strings.Join(calls, "; ")}
+	case m.Role == "tool":
+		return domain.ChatMessage{Role: "ipython", Content: m.Content}
+	default:
+		return m
+	}
+}
+
+func (llama3Tools) Prefixes() []string {
+	return []string{"<|python_tag|>", `{"name"`}
+}
+
+func (llama3Tools) Parse(output string) ([]domain.ToolCall, error) {
+	output = strings.TrimSpace(output)
+	output = strings.TrimPrefix(output, "<|python_tag|>")
+	return parseCalls(output)
+}
+
+// hermesTools is tool calling of Hermes and Qwen models with calls in <tool_call> tags
+type hermesTools struct{}
+
+var hermesCall = regexp.MustCompile(`(?s)<tool_call>\s*(.*?)\s*(?:</tool_call>|$)`)
+
+func (hermesTools) System(tools []domain.Tool) domain.ChatMessage {
+	return domain.ChatMessage{
+		Role: "system",
+		Content: "# Tools\n\nYou may call one or more functions to assist with the user query.\n\n" +
+			"You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n" +
+			strings.Join(toolsJSON(tools), "\n") +
+			"\n</tools>\n\n" +
+			"For each function call, return a json object with function name and arguments " +
+			"within <tool_call></tool_call> XML tags:\n<tool_call>\n" +
+			`{"name": <function-name>, "arguments": <args-json-object>}` +
+			"\n</tool_call>",
+	}
+}
+
+func (hermesTools) Message(m domain.ChatMessage) domain.ChatMessage {
+	switch {
+	case m.Role == "assistant" && len(m.ToolCalls) > 0:
+		var b strings.Builder
+		b.WriteString(m.Content)
+		for _, c := range m.ToolCalls {
+			fmt.Fprintf(&b, "\n<tool_call>\n%s\n</tool_call>", callJSON(c, "arguments"))
+		}
+		return domain.ChatMessage{Role: "assistant", Content: strings.TrimSpace(b.String())}
+	case m.Role == "tool":
+		return domain.ChatMessage{Role: "user", Content: "<tool_response>\n" + m.Content + "\n</tool_response>"}
+	default:
+		return m
+	}
+}
+
+func (hermesTools) Prefixes() []string {
+	return []string{"<tool_call>"}
+}
+
+func (hermesTools) Parse(output string) ([]domain.ToolCall, error) {
+	matches := hermesCall.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return nil, errors.New("no tool calls in the output")
+	}
+
+	calls := make([]domain.ToolCall, 0, len(matches))
+	for _, m := range matches {
+		c, err := parseCalls(m[1])
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, c...)
+	}
+	return calls, nil
+}
+
+// mistralTools is tool calling of Mistral models with [TOOL_CALLS] followed by JSON array of calls
+type mistralTools struct{}
+
+func (mistralTools) System(tools []domain.Tool) domain.ChatMessage {
+	return domain.ChatMessage{
+		Role: "system",
+		Content: "You have access to the following tools:\n[" +
+			strings.Join(toolsJSON(tools), ", ") + "]\n\n" +
+			"To call tools, respond only with [TOOL_CALLS] followed by JSON array of the calls: " +
+			`[TOOL_CALLS][{"name": <function-name>, "arguments": <args-json-object>}]`,
+	}
+}
+
+func (mistralTools) Message(m domain.ChatMessage) domain.ChatMessage {
+	switch {
+	case m.Role == "assistant" && len(m.ToolCalls) > 0:
+		calls := make([]string, 0, len(m.ToolCalls))
+		for _, c := range m.ToolCalls {
+			calls = append(calls, callJSON(c, "arguments"))
+		}
+		return domain.ChatMessage{Role: "assistant", Content: m.Content + "[TOOL_CALLS][" + strings.Join(calls, ", ") + "]"}
+	case m.Role == "tool":
+		result, _ := json.Marshal(map[string]string{
+			"call_id": m.ToolCallID,
+			"content": m.Content,
+		})
+		return domain.ChatMessage{Role: "user", Content: "[TOOL_RESULTS]" + string(result) + "[/TOOL_RESULTS]"}
+	default:
+		return m
+	}
+}
+
+func (mistralTools) Prefixes() []string {
+	return []string{"[TOOL_CALLS]"}
+}
+
+func (mistralTools) Parse(output string) ([]domain.ToolCall, error) {
+	output = strings.TrimSpace(output)
+	output = strings.TrimPrefix(output, "[TOOL_CALLS]")
+	return parseCalls(output)
+}
+
+// ToolCallsStream holds back the beginning of the model output while it can be a tool call,
+// so tool calls are not streamed to the client as content
+type ToolCallsStream struct {
+	format      ToolFormat
+	held        []Token
+	text        []byte
+	passthrough bool
+}
+
+func NewToolCallsStream(format ToolFormat) *ToolCallsStream {
+	return &ToolCallsStream{
+		format: format,
+		held:   make([]Token, 0, 64),
+		text:   make([]byte, 0, 256),
+	}
+}
+
+// Next returns the tokens which can be streamed to the client
+func (s *ToolCallsStream) Next(t Token) []Token {
+	if s.passthrough {
+		return []Token{t}
+	}
+
+	s.held = append(s.held, t)
+	s.text = append(s.text, t.Piece...)
+	text := strings.TrimLeft(string(s.text), " \t\n")
+	if len(text) == 0 {
+		return nil
+	}
+	for _, p := range s.format.Prefixes() {
+		if strings.HasPrefix(text, p) || strings.HasPrefix(p, text) {
+			return nil
+		}
+	}
+
+	s.passthrough = true
+	out := s.held
+	s.held = nil
+	return out
+}
+
+// End parses the held output. Returns the tool calls, or the held tokens
+// as content if they are not a valid tool call
+func (s *ToolCallsStream) End() ([]domain.ToolCall, []Token) {
+	if s.passthrough || len(s.held) == 0 {
+		return nil, nil
+	}
+
+	calls, err := s.format.Parse(string(s.text))
+	if err != nil || len(calls) == 0 {
+		return nil, s.held
+	}
+	return calls, nil
+}
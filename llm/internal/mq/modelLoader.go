@@ -0,0 +1,9 @@
+package mq
+
+import "github.com/soulnvkz/mq/domain"
+
+// ModelLoader replaces the model of the worker, the previous model is loaded back if the new one fails.
+// It returns the name of the loaded model and its adapters
+type ModelLoader interface {
+	Swap(cmd domain.ControlCommand) (string, []string, error)
+}
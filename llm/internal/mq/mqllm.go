@@ -2,128 +2,240 @@ package mq
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/soulnvkz/llm/internal/llama"
+	"github.com/soulnvkz/llm/internal/utils"
 	"github.com/soulnvkz/mq"
 	"github.com/soulnvkz/mq/domain"
 )
 
 type MQConfig struct {
-	CancelExKey string
-	ReqQKey     string
+	ReqQKey      string
+	WorkersExKey string
+	ControlExKey string
+
+	// DrainTimeout is how long the current request can take after the shutdown is requested
+	DrainTimeout time.Duration
+
+	// the worker is advertised with its model and adapters,
+	// the requests for every adapter come from its own queue
+	WorkerID string
+	Model    string
+	Adapters []string
 }
 
 type MQllm struct {
-	reqChannel    *amqp.Channel
-	cancelChannel *amqp.Channel
-	pubChannel    *amqp.Channel
+	transport mq.Transport
+
+	// commands are executed by the requests loop between the requests
+	commands chan domain.ControlCommand
+	loader   ModelLoader
+
+	// advert is published periodically and right after it is changed
+	advertMu  sync.Mutex
+	advert    domain.WorkerAdvert
+	advertNow chan struct{}
+
+	// index numbers the responses of the current request, it is used by the requests loop only
+	index int
+	// streams are replayed to the servers the clients have reconnected to
+	streams *streamBuffer
 
-	reqQ    *mq.MQQueue
-	cancelQ *mq.MQQueue
+	// the consumer loops are running, they are reported by the health checks
+	requestsRunning      atomic.Bool
+	cancellationsRunning atomic.Bool
+	controlRunning       atomic.Bool
 
 	config MQConfig
 }
 
-func NewMQllm(pull, pub *mq.MQConnection, config MQConfig) (*MQllm, error) {
-	// initilize channels
-	req_channel, err := pull.Channel()
-	if err != nil {
-		return nil, err
-	}
-	err = req_channel.Qos(1, 0, false)
-	if err != nil {
-		return nil, err
-	}
-	cancel_channel, err := pull.Channel()
-	if err != nil {
-		return nil, err
+func NewMQllm(transport mq.Transport, config MQConfig) *MQllm {
+	return &MQllm{
+		transport: transport,
 
+		commands: make(chan domain.ControlCommand),
+
+		advert: domain.WorkerAdvert{
+			WorkerID: config.WorkerID,
+			Model:    config.Model,
+			Adapters: config.Adapters,
+			Status:   domain.WorkerReady,
+		},
+		advertNow: make(chan struct{}, 1),
+		streams:   newStreamBuffer(),
+
+		config: config,
 	}
-	pub_channel, err := pub.Channel()
-	if err != nil {
-		return nil, err
-	}
+}
+
+// reply sends the response to the server of the request, it is the server the stream is resumed by if it is resumed.
+// The response is numbered with the index of the current request and is buffered to be replayed
+func (llmq *MQllm) reply(resp domain.CompletionsResponse) error {
+	resp.Index = llmq.index
+	llmq.index++
+	replyTo := llmq.streams.add(resp)
 
-	err = cancel_channel.ExchangeDeclare(
-		config.CancelExKey,
-		"fanout",
-		false,
-		true,
-		false,
-		false,
-		nil,
-	)
+	buff, err := resp.Marshal()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	cancelQ, err := mq.NewMQueue(cancel_channel, "")
+	// the reply fails if the server is gone, so the generation nobody waits for is stopped
+	return llmq.transport.Reply(context.Background(), replyTo, mq.Message{
+		ID:   resp.RequestID,
+		Body: buff,
+	})
+}
+
+// replyError reports the failed request to the requester
+func (llmq *MQllm) replyError(requestID string, chatID string, e error) {
+	err := llmq.reply(domain.CompletionsResponse{
+		RequestID: requestID,
+		ChatID:    chatID,
+		Content:   e.Error(),
+		ResType:   domain.CompletionsError,
+	})
 	if err != nil {
-		return nil, err
+		log.Printf("%s, failed to reply", err)
 	}
-	err = cancel_channel.QueueBind(cancelQ.Name(), "", config.CancelExKey, false, nil)
+}
+
+// replyCancelled acknowledges the cancellation of the request to the requester
+func (llmq *MQllm) replyCancelled(requestID string, chatID string) {
+	err := llmq.reply(domain.CompletionsResponse{
+		RequestID: requestID,
+		ChatID:    chatID,
+		ResType:   domain.CompletionsCancelled,
+	})
 	if err != nil {
-		return nil, err
+		log.Printf("%s, failed to reply", err)
 	}
+}
 
-	reqQ, err := mq.NewMQueue(req_channel, config.ReqQKey)
-	if err != nil {
-		return nil, err
+// abandon stops replying to the request whose reply has failed, e.g. its server is gone.
+// The stream is ended with the cancellation in the buffer, so the server it is resumed by learns it is stopped
+func (llmq *MQllm) abandon(requestID string, chatID string, err error) {
+	if errors.Is(err, mq.ErrUnroutable) {
+		log.Printf("server of %s is gone, the request is cancelled", requestID)
+	} else {
+		log.Printf("%s, failed to reply, %s is cancelled", err, requestID)
 	}
 
-	return &MQllm{
-		reqChannel:    req_channel,
-		cancelChannel: cancel_channel,
-		pubChannel:    pub_channel,
+	llmq.streams.add(domain.CompletionsResponse{
+		RequestID: requestID,
+		ChatID:    chatID,
+		Index:     llmq.index,
+		ResType:   domain.CompletionsCancelled,
+	})
+	llmq.index++
+}
 
-		reqQ:    reqQ,
-		cancelQ: cancelQ,
+// nextResponse joins generated tokens into a single completions chunk
+func nextResponse(requestID string, chatID string, tokens []llama.Token) domain.CompletionsResponse {
+	resp := domain.CompletionsResponse{
+		RequestID: requestID,
+		ChatID:    chatID,
+		ResType:   domain.CompletionsNext,
+	}
 
-		config: config,
-	}, nil
+	content := make([]byte, 0, 16*len(tokens))
+	for _, t := range tokens {
+		content = append(content, t.Piece...)
+		if t.Logprob != nil {
+			resp.Logprobs = append(resp.Logprobs, *t.Logprob)
+		}
+	}
+	resp.Content = string(content)
+
+	return resp
 }
 
-func (llmq *MQllm) reply(replyTo string, resp domain.CompletionsResponse) error {
-	buff, err := resp.Marshal()
+// consumeRequests takes the requests of the common queue and the queues of the adapters until stop is called,
+// the requests which are not taken are returned to the queues then
+func (llmq *MQllm) consumeRequests(ctx context.Context, adapters []string) (<-chan mq.Message, context.CancelFunc, error) {
+	queues := make([]string, 0, len(adapters)+1)
+	queues = append(queues, llmq.config.ReqQKey)
+	for _, a := range adapters {
+		queues = append(queues, domain.AdapterQueue(llmq.config.ReqQKey, a))
+	}
+
+	req_ctx, stop := context.WithCancel(ctx)
+	llm_r, err := llmq.transport.ConsumeRequests(req_ctx, queues...)
 	if err != nil {
-		return err
+		stop()
+		return nil, nil, err
 	}
+	return llm_r, stop, nil
+}
 
-	err = llmq.pubChannel.Publish(
-		"",      // exchange
-		replyTo, // routing key
-		false,   // mandatory
-		false,   // immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			CorrelationId: resp.RequestID,
-			Body:          buff,
-		})
+// swap stops taking the requests, replaces the model and takes the requests of the new adapters.
+// The requests wait in the queues meanwhile or are taken by the other workers
+func (llmq *MQllm) swap(ctx context.Context, cmd domain.ControlCommand, stop context.CancelFunc) (<-chan mq.Message, context.CancelFunc, error) {
+	stop()
+
+	llmq.updateAdvert(func(a *domain.WorkerAdvert) {
+		a.Status = domain.WorkerSwapping
+		a.Error = ""
+	})
+
+	log.Printf("swapping model to %s", cmd.Model)
+	model, adapters, err := llmq.loader.Swap(cmd)
 	if err != nil {
-		return err
+		log.Printf("%s, failed to swap model", err)
+	} else {
+		log.Printf("model is swapped to %s", model)
 	}
 
-	return nil
+	llmq.updateAdvert(func(a *domain.WorkerAdvert) {
+		a.Model = model
+		a.Adapters = adapters
+		a.Status = domain.WorkerReady
+		if err != nil {
+			a.Error = err.Error()
+		}
+	})
+
+	return llmq.consumeRequests(ctx, adapters)
 }
 
 func (llmq *MQllm) ConsumeCompletionsRequests(ctx context.Context, pbuilder llama.PromptBuilder, d ResponseGenerator) (<-chan bool, error) {
-	llm_r, err := llmq.reqQ.Consume()
+	llm_r, stop_r, err := llmq.consumeRequests(ctx, llmq.config.Adapters)
 	if err != nil {
 		return nil, err
 	}
 	done := make(chan bool)
 
+	llmq.requestsRunning.Store(true)
 	go func() {
+		defer llmq.requestsRunning.Store(false)
 	main_loop:
 		for {
 			select {
 			case <-ctx.Done():
 				done <- true
 				break main_loop
-			case req := <-llm_r:
-				req.Ack(false)
+			case cmd := <-llmq.commands:
+				// the previous request is finished, as the requests are handled one by one
+				llm_r, stop_r, err = llmq.swap(ctx, cmd, stop_r)
+				if err != nil {
+					log.Printf("%s, failed to consume requests after swap", err)
+					done <- true
+					break main_loop
+				}
+			case req, ok := <-llm_r:
+				if !ok {
+					if ctx.Err() == nil {
+						log.Printf("requests consumer has stopped")
+					}
+					done <- true
+					break main_loop
+				}
+				llmq.index = 0
 
 				cr := domain.CompletionsRequest{}
 				err := cr.UnMarshal(req.Body)
@@ -131,52 +243,159 @@ func (llmq *MQllm) ConsumeCompletionsRequests(ctx context.Context, pbuilder llam
 					log.Printf("%s, unsupported request data", err)
 					continue
 				}
+				llmq.streams.open(req.ID, req.ReplyTo)
 
-				err = llmq.reply(req.ReplyTo, domain.CompletionsResponse{
-					RequestID: req.CorrelationId,
+				// the request can be cancelled before it is taken
+				if err := d.Accept(req.ID); err != nil {
+					log.Printf("%s, %s is not accepted", err, req.ID)
+					if errors.Is(err, utils.ErrRequestCancelled) {
+						llmq.replyCancelled(req.ID, cr.ChatID)
+					} else {
+						llmq.replyError(req.ID, cr.ChatID, err)
+					}
+					continue
+				}
+
+				// the server sends the cancellation of the started request to this worker only
+				err = llmq.reply(domain.CompletionsResponse{
+					RequestID: req.ID,
+					ChatID:    cr.ChatID,
+					WorkerID:  llmq.config.WorkerID,
 					ResType:   domain.CompletionsStart,
 				})
 				if err != nil {
-					log.Printf("%s, failed to reply", err)
+					llmq.abandon(req.ID, cr.ChatID, err)
+					d.Finish(req.ID)
 					continue
 				}
 
-				prompt, err := pbuilder.Build(cr.ChatMessages, cr.Content)
+				sampling, err := llama.NewSampling(cr)
+				if err != nil {
+					log.Printf("%s, unsupported sampling settings", err)
+					llmq.replyError(req.ID, cr.ChatID, err)
+					d.Finish(req.ID)
+					continue
+				}
+
+				if cr.Preview {
+					preview, err := pbuilder.Preview(ctx, cr, sampling)
+					if err != nil {
+						log.Printf("%s, failed to preview prompt", err)
+						llmq.replyError(req.ID, cr.ChatID, err)
+						d.Finish(req.ID)
+						continue
+					}
+					err = llmq.reply(domain.CompletionsResponse{
+						RequestID: req.ID,
+						ChatID:    cr.ChatID,
+						Preview:   &preview,
+						ResType:   domain.CompletionsPreview,
+					})
+					if err != nil {
+						log.Printf("%s, failed to reply", err)
+					}
+					d.Finish(req.ID)
+					continue
+				}
+
+				prompt, err := pbuilder.Build(ctx, cr)
 				if err != nil {
 					log.Printf("%s, failed to build prompt", err)
+					llmq.replyError(req.ID, cr.ChatID, err)
+					d.Finish(req.ID)
 					continue
 				}
 
-				req_ctx, cancel := context.WithCancel(ctx)
-				next, stop, err := d.Proccess(req_ctx, prompt, cr.RequestID)
+				err = llmq.reply(domain.CompletionsResponse{
+					RequestID: req.ID,
+					ChatID:    cr.ChatID,
+					Context:   &prompt.Context,
+					ResType:   domain.CompletionsContext,
+				})
+				if err != nil {
+					llmq.abandon(req.ID, cr.ChatID, err)
+					d.Finish(req.ID)
+					continue
+				}
+
+				// the generation is not cancelled by the shutdown at once, it has DrainTimeout to finish
+				req_ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+				next, stop, err := d.Proccess(req_ctx, prompt.Text, req.ID, sampling)
+				if errors.Is(err, utils.ErrRequestCancelled) {
+					log.Printf("%s is cancelled before generation", req.ID)
+					llmq.replyCancelled(req.ID, cr.ChatID)
+					d.Finish(req.ID)
+					cancel()
+					continue
+				}
 				if err != nil {
 					log.Printf("%s, failed to start generation", err)
+					llmq.replyError(req.ID, cr.ChatID, err)
+					d.Finish(req.ID)
 					cancel()
 					continue
 				}
+
+				// tool calls are held back and sent with the end of completions
+				var calls *llama.ToolCallsStream
+				if prompt.Tools != nil {
+					calls = llama.NewToolCallsStream(prompt.Tools)
+				}
+				shutdown := ctx.Done()
+				var drain <-chan time.Time
 			proccess_loop:
 				for {
 					select {
+					case <-shutdown:
+						log.Printf("%s is finishing before shutdown", req.ID)
+						shutdown = nil
+						drain = time.After(llmq.config.DrainTimeout)
+					case <-drain:
+						// the generation stops and the end of completions is sent
+						log.Printf("%s is cancelled on shutdown", req.ID)
+						drain = nil
+						cancel()
 					case <-stop:
-						log.Printf("%s stop", req.CorrelationId)
-						err = llmq.reply(req.ReplyTo, domain.CompletionsResponse{
-							RequestID: req.CorrelationId,
+						log.Printf("%s stop", req.ID)
+						if d.RequestState(req.ID) == utils.RequestCancelled {
+							llmq.replyCancelled(req.ID, cr.ChatID)
+							break proccess_loop
+						}
+						end := domain.CompletionsResponse{
+							RequestID: req.ID,
+							ChatID:    cr.ChatID,
 							ResType:   domain.CompletionsEnd,
-						})
+						}
+						if calls != nil {
+							toolCalls, rest := calls.End()
+							if len(rest) > 0 {
+								err = llmq.reply(nextResponse(req.ID, cr.ChatID, rest))
+								if err != nil {
+									llmq.abandon(req.ID, cr.ChatID, err)
+									cancel()
+									break proccess_loop
+								}
+							}
+							end.ToolCalls = toolCalls
+						}
+						err = llmq.reply(end)
 						if err != nil {
 							log.Printf("%s, failed to reply", err)
 							cancel()
 							break proccess_loop
 						}
 						break proccess_loop
-					case buff := <-next:
-						err = llmq.reply(req.ReplyTo, domain.CompletionsResponse{
-							RequestID: req.CorrelationId,
-							Content:   string(buff),
-							ResType:   domain.CompletionsNext,
-						})
+					case token := <-next:
+						tokens := []llama.Token{token}
+						if calls != nil {
+							tokens = calls.Next(token)
+							if len(tokens) == 0 {
+								continue proccess_loop
+							}
+						}
+						err = llmq.reply(nextResponse(req.ID, cr.ChatID, tokens))
 						if err != nil {
-							log.Printf("%s, failed to reply", err)
+							llmq.abandon(req.ID, cr.ChatID, err)
 							cancel()
 							break proccess_loop
 						}
@@ -191,22 +410,32 @@ func (llmq *MQllm) ConsumeCompletionsRequests(ctx context.Context, pbuilder llam
 }
 
 func (llmq *MQllm) ConsumeCancellations(ctx context.Context, c ResponseCancellation) (<-chan bool, error) {
-	llm_cancel, err := llmq.cancelQ.Consume()
+	// the cancellations of the requests this worker has started are sent to it,
+	// the ones of the requests which are not started yet are broadcast
+	llm_cancel, err := llmq.transport.ConsumeCancellations(ctx, llmq.config.WorkerID)
 	if err != nil {
 		return nil, err
 	}
 	done := make(chan bool)
+	llmq.cancellationsRunning.Store(true)
 	go func() {
+		defer llmq.cancellationsRunning.Store(false)
 	main_loop:
 		for {
 			select {
 			case <-ctx.Done():
 				done <- true
 				break main_loop
-			case req := <-llm_cancel:
-				log.Printf("%s queue cancellation", req.CorrelationId)
-				c.Cancel(req.CorrelationId)
-				req.Ack(false)
+			case req, ok := <-llm_cancel:
+				if !ok {
+					if ctx.Err() == nil {
+						log.Printf("cancellations consumer has stopped")
+					}
+					done <- true
+					break main_loop
+				}
+				log.Printf("%s cancellation", req.ID)
+				c.Cancel(req.ID)
 			}
 		}
 	}()
@@ -214,8 +443,167 @@ func (llmq *MQllm) ConsumeCancellations(ctx context.Context, c ResponseCancellat
 	return done, nil
 }
 
-func (llmq *MQllm) Close() {
-	llmq.reqChannel.Close()
-	llmq.cancelChannel.Close()
-	llmq.pubChannel.Close()
+// replay sends the buffered responses of the request after the index to the server the client
+// has reconnected to, the rest of the stream goes to that server then. The command is ignored
+// if the stream is not of this worker
+func (llmq *MQllm) replay(ctx context.Context, cmd domain.ControlCommand) error {
+	if len(cmd.ReplyTo) == 0 {
+		return errors.New("replay server is not specified")
+	}
+	responses, finished, ok := llmq.streams.resume(cmd.RequestID, cmd.Index, cmd.ReplyTo)
+	if !ok {
+		return nil
+	}
+
+	buff, err := domain.CompletionsResponse{
+		RequestID: cmd.RequestID,
+		ResType:   domain.CompletionsReplay,
+		Replay: &domain.StreamReplay{
+			RequestID: cmd.RequestID,
+			WorkerID:  llmq.config.WorkerID,
+			Responses: responses,
+			Finished:  finished,
+		},
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return llmq.transport.Reply(ctx, cmd.ReplyTo, mq.Message{
+		ID:   cmd.RequestID,
+		Body: buff,
+	})
+}
+
+// ConsumeControl takes the commands of this worker, they are executed by the requests loop
+func (llmq *MQllm) ConsumeControl(ctx context.Context, loader ModelLoader) (<-chan bool, error) {
+	llm_control, err := llmq.transport.Subscribe(ctx, llmq.config.ControlExKey)
+	if err != nil {
+		return nil, err
+	}
+	llmq.loader = loader
+
+	done := make(chan bool)
+	llmq.controlRunning.Store(true)
+	go func() {
+		defer llmq.controlRunning.Store(false)
+	main_loop:
+		for {
+			select {
+			case <-ctx.Done():
+				done <- true
+				break main_loop
+			case req, ok := <-llm_control:
+				if !ok {
+					if ctx.Err() == nil {
+						log.Printf("control consumer has stopped")
+					}
+					done <- true
+					break main_loop
+				}
+
+				cmd := domain.ControlCommand{}
+				if err := cmd.UnMarshal(req.Body); err != nil {
+					log.Printf("%s, unsupported command data", err)
+					continue
+				}
+				if len(cmd.WorkerID) > 0 && cmd.WorkerID != llmq.config.WorkerID {
+					continue
+				}
+
+				switch cmd.Command {
+				case domain.CommandSwapModel:
+					select {
+					case llmq.commands <- cmd:
+					case <-ctx.Done():
+					}
+				case domain.CommandReplayStream:
+					// the replay does not wait for the requests loop, the buffer is shared with it
+					if err := llmq.replay(ctx, cmd); err != nil {
+						log.Printf("%s, failed to replay %s", err, cmd.RequestID)
+					}
+				default:
+					log.Printf("unsupported command %s", cmd.Command)
+				}
+			}
+		}
+	}()
+
+	return done, nil
+}
+
+// Advert is the current advert of the worker
+func (llmq *MQllm) Advert() domain.WorkerAdvert {
+	llmq.advertMu.Lock()
+	defer llmq.advertMu.Unlock()
+	return llmq.advert
+}
+
+// CheckConsumers returns an error if a consumer loop has stopped
+func (llmq *MQllm) CheckConsumers() error {
+	switch {
+	case !llmq.requestsRunning.Load():
+		return errors.New("requests consumer is not running")
+	case !llmq.cancellationsRunning.Load():
+		return errors.New("cancellations consumer is not running")
+	case !llmq.controlRunning.Load():
+		return errors.New("control consumer is not running")
+	}
+	return nil
+}
+
+// CheckTransport returns an error if the transport is broken
+func (llmq *MQllm) CheckTransport() error {
+	return llmq.transport.Check()
+}
+
+func (llmq *MQllm) updateAdvert(update func(a *domain.WorkerAdvert)) {
+	llmq.advertMu.Lock()
+	update(&llmq.advert)
+	llmq.advertMu.Unlock()
+
+	select {
+	case llmq.advertNow <- struct{}{}:
+	default:
+	}
+}
+
+// Advertise publishes the worker advert until the context is done
+func (llmq *MQllm) Advertise(ctx context.Context, interval time.Duration) error {
+	advertise := func() {
+		llmq.advertMu.Lock()
+		buff, err := llmq.advert.Marshal()
+		llmq.advertMu.Unlock()
+		if err != nil {
+			log.Printf("%s, failed to advertise worker", err)
+			return
+		}
+
+		// the advert is dropped when the next one is published
+		err = llmq.transport.Broadcast(ctx, llmq.config.WorkersExKey, mq.Message{
+			Body: buff,
+			TTL:  interval,
+		})
+		if err != nil {
+			log.Printf("%s, failed to advertise worker", err)
+		}
+	}
+
+	advertise()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				advertise()
+			case <-llmq.advertNow:
+				advertise()
+			}
+		}
+	}()
+
+	return nil
 }
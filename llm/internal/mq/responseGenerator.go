@@ -1,7 +1,18 @@
 package mq
 
-import "context"
+import (
+	"context"
+
+	"github.com/soulnvkz/llm/internal/llama"
+	"github.com/soulnvkz/llm/internal/utils"
+)
 
 type ResponseGenerator interface {
-	Proccess(ctx context.Context, prompt string, req string) (chan []byte, chan bool, error)
+	// Accept registers the request before the prompt is built, so it can be cancelled meanwhile
+	Accept(req string) error
+	// Finish ends the accepted request which is not proccessed, the proccessed request is finished by its generation
+	Finish(req string)
+	Proccess(ctx context.Context, prompt string, req string, s llama.Sampling) (chan llama.Token, chan bool, error)
+	// RequestState tells whether the stopped request is cancelled or finished
+	RequestState(req string) utils.RequestState
 }
@@ -0,0 +1,103 @@
+package mq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+const (
+	// StreamRetention is how long the finished stream can be replayed
+	StreamRetention = time.Minute
+	// StreamTimeout is how long the stream is kept without new responses, e.g. when its replies have failed
+	StreamTimeout = 10 * time.Minute
+)
+
+// bufferedStream is the responses of the request in the order they are sent
+type bufferedStream struct {
+	// replyTo is the server the responses go to, it is the server the stream is resumed by last
+	replyTo   string
+	responses []domain.CompletionsResponse
+	finished  bool
+	// updated is the time of the last response
+	updated time.Time
+}
+
+// streamBuffer keeps the responses of the worker requests, so the server the client
+// has reconnected to can replay the stream. The worker generates one request at a time,
+// so the buffer holds the current stream and the streams finished within the retention
+type streamBuffer struct {
+	mu      sync.Mutex
+	streams map[string]*bufferedStream
+}
+
+func newStreamBuffer() *streamBuffer {
+	return &streamBuffer{
+		streams: make(map[string]*bufferedStream),
+	}
+}
+
+func finishes(resType uint8) bool {
+	return resType == domain.CompletionsEnd ||
+		resType == domain.CompletionsError ||
+		resType == domain.CompletionsCancelled
+}
+
+// open starts the stream of the request, its responses go to the server which has published the request
+func (b *streamBuffer) open(requestID string, replyTo string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.evict(now)
+	b.streams[requestID] = &bufferedStream{replyTo: replyTo, updated: now}
+}
+
+// add buffers the response and returns the server it goes to
+func (b *streamBuffer) add(resp domain.CompletionsResponse) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[resp.RequestID]
+	if !ok {
+		s = &bufferedStream{}
+		b.streams[resp.RequestID] = s
+	}
+	s.responses = append(s.responses, resp)
+	s.finished = s.finished || finishes(resp.ResType)
+	s.updated = time.Now()
+	return s.replyTo
+}
+
+// resume returns the responses after the index and whether the stream is finished,
+// the rest of the stream goes to the server the stream is resumed by. ok is false if the stream is not buffered
+func (b *streamBuffer) resume(requestID string, index int, replyTo string) (responses []domain.CompletionsResponse, finished bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[requestID]
+	if !ok {
+		return nil, false, false
+	}
+	s.replyTo = replyTo
+
+	responses = make([]domain.CompletionsResponse, 0, len(s.responses))
+	for _, r := range s.responses {
+		if r.Index > index {
+			responses = append(responses, r)
+		}
+	}
+	return responses, s.finished, true
+}
+
+// evict removes the finished streams after the retention and the abandoned ones after the timeout,
+// it is called with the lock held
+func (b *streamBuffer) evict(now time.Time) {
+	for id, s := range b.streams {
+		age := now.Sub(s.updated)
+		if (s.finished && age >= StreamRetention) || age >= StreamTimeout {
+			delete(b.streams, id)
+		}
+	}
+}
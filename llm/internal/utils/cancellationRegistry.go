@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RequestState is the state of the request in the cancellation registry
+type RequestState int
+
+const (
+	RequestUnknown RequestState = iota
+	// RequestPending is taken by the worker, the generation is not started yet
+	RequestPending
+	RequestRunning
+	RequestCancelled
+	RequestFinished
+)
+
+func (s RequestState) String() string {
+	switch s {
+	case RequestPending:
+		return "pending"
+	case RequestRunning:
+		return "running"
+	case RequestCancelled:
+		return "cancelled"
+	case RequestFinished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+var (
+	ErrRequestCancelled = errors.New("request is cancelled")
+	ErrRequestExists    = errors.New("request is registered already")
+)
+
+type requestEntry struct {
+	state  RequestState
+	cancel context.CancelFunc
+	// updated is the time of the last state change, the entries which are not running expire after it
+	updated time.Time
+}
+
+// CancellationRegistry tracks the requests of the worker, so they can be cancelled in any state.
+// The request cancelled before it is taken by the worker is remembered until it expires,
+// and the request is not started then
+type CancellationRegistry struct {
+	mu       sync.Mutex
+	requests map[string]*requestEntry
+	ttl      time.Duration
+}
+
+func NewCancellationRegistry(ctx context.Context, ttl time.Duration, tick time.Duration) *CancellationRegistry {
+	r := &CancellationRegistry{
+		requests: make(map[string]*requestEntry),
+		ttl:      ttl,
+	}
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				r.evict(now)
+			}
+		}
+	}()
+
+	return r
+}
+
+// evict removes the expired entries, the running requests never expire
+func (r *CancellationRegistry) evict(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, e := range r.requests {
+		if e.state != RequestRunning && now.Sub(e.updated) >= r.ttl {
+			delete(r.requests, id)
+		}
+	}
+}
+
+func (r *CancellationRegistry) set(id string, e *requestEntry, state RequestState) {
+	e.state = state
+	e.updated = time.Now()
+	r.requests[id] = e
+}
+
+// Accept registers the request taken by the worker as pending,
+// it fails with ErrRequestCancelled if the request is cancelled already
+func (r *CancellationRegistry) Accept(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.requests[id]
+	if !ok {
+		r.set(id, &requestEntry{}, RequestPending)
+		return nil
+	}
+	if e.state == RequestCancelled {
+		return ErrRequestCancelled
+	}
+	return ErrRequestExists
+}
+
+// Start makes the pending request running, the returned context is cancelled by Cancel.
+// The request is registered if it is not accepted before
+func (r *CancellationRegistry) Start(ctx context.Context, id string) (context.Context, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.requests[id]
+	switch {
+	case !ok:
+		e = &requestEntry{}
+	case e.state == RequestCancelled:
+		return nil, ErrRequestCancelled
+	case e.state != RequestPending:
+		return nil, ErrRequestExists
+	}
+
+	req_ctx, cancel := context.WithCancel(ctx)
+	e.cancel = cancel
+	r.set(id, e, RequestRunning)
+
+	return req_ctx, nil
+}
+
+// Finish ends the request and returns its final state, the cancelled request stays cancelled
+func (r *CancellationRegistry) Finish(id string) RequestState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.requests[id]
+	if !ok {
+		return RequestUnknown
+	}
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+	if e.state == RequestCancelled {
+		return RequestCancelled
+	}
+	r.set(id, e, RequestFinished)
+	return RequestFinished
+}
+
+// Cancel cancels the request and returns its state before the cancellation.
+// The unknown request is remembered as cancelled, the finished one is not changed
+func (r *CancellationRegistry) Cancel(id string) RequestState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.requests[id]
+	if !ok {
+		r.set(id, &requestEntry{}, RequestCancelled)
+		return RequestUnknown
+	}
+
+	prev := e.state
+	if prev == RequestPending || prev == RequestRunning {
+		if e.cancel != nil {
+			e.cancel()
+			e.cancel = nil
+		}
+		r.set(id, e, RequestCancelled)
+	}
+	return prev
+}
+
+// State returns the state of the request, it is unknown if the request is not registered or has expired
+func (r *CancellationRegistry) State(id string) RequestState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.requests[id]
+	if !ok {
+		return RequestUnknown
+	}
+	return e.state
+}
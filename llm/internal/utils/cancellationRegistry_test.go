@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testTTL = time.Minute
+
+// registryStep is an operation of the request, finish and cancel are checked by their result,
+// the other operations by the error and the state of the request after them
+type registryStep struct {
+	op string
+	// after is the time since the last state change of evict
+	after time.Duration
+	err   error
+	state RequestState
+}
+
+var cancellationRegistryTests = []struct {
+	name  string
+	steps []registryStep
+}{
+	{
+		name: "cancel before start",
+		steps: []registryStep{
+			{op: "cancel", state: RequestUnknown},
+			{op: "accept", err: ErrRequestCancelled, state: RequestCancelled},
+			{op: "start", err: ErrRequestCancelled, state: RequestCancelled},
+		},
+	},
+	{
+		name: "cancel while pending",
+		steps: []registryStep{
+			{op: "accept", state: RequestPending},
+			{op: "cancel", state: RequestPending},
+			{op: "start", err: ErrRequestCancelled, state: RequestCancelled},
+		},
+	},
+	{
+		name: "cancel while running",
+		steps: []registryStep{
+			{op: "accept", state: RequestPending},
+			{op: "start", state: RequestRunning},
+			{op: "cancel", state: RequestRunning},
+			{op: "finish", state: RequestCancelled},
+			{op: "cancel", state: RequestCancelled},
+		},
+	},
+	{
+		name: "finish then cancel",
+		steps: []registryStep{
+			{op: "start", state: RequestRunning},
+			{op: "finish", state: RequestFinished},
+			{op: "cancel", state: RequestFinished},
+			{op: "start", err: ErrRequestExists, state: RequestFinished},
+		},
+	},
+	{
+		name: "tombstone consumed by late start",
+		steps: []registryStep{
+			{op: "cancel", state: RequestUnknown},
+			// the request is taken after the cancellation has come
+			{op: "start", err: ErrRequestCancelled, state: RequestCancelled},
+			{op: "finish", state: RequestCancelled},
+		},
+	},
+	{
+		name: "tombstone evicted after ttl",
+		steps: []registryStep{
+			{op: "cancel", state: RequestUnknown},
+			{op: "evict", after: testTTL / 2, state: RequestCancelled},
+			{op: "evict", after: testTTL, state: RequestUnknown},
+			{op: "start", state: RequestRunning},
+		},
+	},
+	{
+		name: "running request is not evicted",
+		steps: []registryStep{
+			{op: "start", state: RequestRunning},
+			{op: "evict", after: testTTL, state: RequestRunning},
+			{op: "finish", state: RequestFinished},
+			{op: "evict", after: testTTL, state: RequestUnknown},
+			{op: "finish", state: RequestUnknown},
+		},
+	},
+}
+
+func TestCancellationRegistry(t *testing.T) {
+	for _, tt := range cancellationRegistryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// the registry is evicted by the steps only
+			r := NewCancellationRegistry(ctx, testTTL, time.Hour)
+
+			var req_ctx context.Context
+			for i, s := range tt.steps {
+				var err error
+				state := RequestUnknown
+				switch s.op {
+				case "accept":
+					err = r.Accept("req")
+					state = r.State("req")
+				case "start":
+					var started context.Context
+					started, err = r.Start(ctx, "req")
+					if err == nil {
+						req_ctx = started
+					}
+					state = r.State("req")
+				case "finish":
+					state = r.Finish("req")
+				case "cancel":
+					state = r.Cancel("req")
+				case "evict":
+					r.evict(time.Now().Add(s.after))
+					state = r.State("req")
+				}
+
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d %s: expected error %v, got %v", i, s.op, s.err, err)
+				}
+				if state != s.state {
+					t.Fatalf("step %d %s: expected state %s, got %s", i, s.op, s.state, state)
+				}
+			}
+
+			// the context of the started request is done once the request is cancelled or finished
+			if req_ctx != nil && r.State("req") != RequestRunning && req_ctx.Err() == nil {
+				t.Fatal("context of the request is not cancelled")
+			}
+		})
+	}
+}
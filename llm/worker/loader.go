@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/soulnvkz/llm/internal/config"
+	"github.com/soulnvkz/llm/internal/llama"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// modelLoader loads the model with its chat template, draft model and adapters
+type modelLoader struct {
+	llm *llama.LLM
+	// cfg is the config of the loaded model
+	cfg config.Config
+}
+
+func (l *modelLoader) load(cfg config.Config) error {
+	if err := l.llm.Initilize(cfg.Model); err != nil {
+		return fmt.Errorf("%w, failed to initilize model", err)
+	}
+
+	// the model chat template can be replaced with a built-in template, a go or a jinja template file
+	switch {
+	case len(cfg.ChatTemplate) > 0:
+		if err := l.llm.UseChatTemplate(cfg.ChatTemplate); err != nil {
+			return fmt.Errorf("%w, failed to set chat template", err)
+		}
+	case len(cfg.ChatGoTemplate) > 0:
+		if err := l.llm.LoadGoTemplate(cfg.ChatGoTemplate); err != nil {
+			return fmt.Errorf("%w, failed to load chat template", err)
+		}
+	case len(cfg.ChatJinjaTemplate) > 0:
+		if err := l.llm.LoadJinjaTemplate(cfg.ChatJinjaTemplate); err != nil {
+			return fmt.Errorf("%w, failed to load chat template", err)
+		}
+	}
+	log.Printf("chat template: %s", l.llm.ChatTemplate())
+
+	// speculative decoding is enabled with the draft model
+	if len(cfg.DraftModel) > 0 {
+		if err := l.llm.LoadDraftModel(cfg.DraftModel, cfg.Draft()); err != nil {
+			return fmt.Errorf("%w, failed to load draft model", err)
+		}
+		log.Printf("speculative decoding with %s, %d draft tokens", cfg.DraftModel, cfg.DraftN)
+	}
+
+	adapters, err := cfg.Adapters()
+	if err != nil {
+		return fmt.Errorf("%w, invalid adapters", err)
+	}
+	for _, a := range adapters {
+		if err := l.llm.LoadAdapter(a.Name, a.Path); err != nil {
+			return fmt.Errorf("%w, failed to load adapter", err)
+		}
+		log.Printf("LoRA adapter %s: %s", a.Name, a.Path)
+	}
+
+	l.cfg = cfg
+	return nil
+}
+
+func (l *modelLoader) model() string {
+	return filepath.Base(l.cfg.Model)
+}
+
+// Swap frees the model and loads the model of the command, the chat template settings are kept.
+// If the new model fails the previous model is loaded back
+func (l *modelLoader) Swap(cmd domain.ControlCommand) (string, []string, error) {
+	if len(cmd.Model) == 0 {
+		return l.model(), l.llm.Adapters(), errors.New("model path should be specified")
+	}
+
+	cfg := l.cfg
+	cfg.Model = cmd.Model
+	cfg.DraftModel = cmd.DraftModel
+	cfg.LoraAdapters = cmd.LoraAdapters
+	if err := cfg.Validate(); err != nil {
+		return l.model(), l.llm.Adapters(), err
+	}
+
+	previous := l.cfg
+	l.llm.Clean()
+	if err := l.load(cfg); err != nil {
+		l.llm.Clean()
+		if rerr := l.load(previous); rerr != nil {
+			// the worker has no model to serve the requests
+			log.Panicf("%s, failed to roll back to %s after %s", rerr, previous.Model, err)
+		}
+		return l.model(), l.llm.Adapters(), fmt.Errorf("%w, rolled back to %s", err, l.model())
+	}
+
+	return l.model(), l.llm.Adapters(), nil
+}
@@ -0,0 +1,200 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/soulnvkz/llm/internal/config"
+	"github.com/soulnvkz/llm/internal/health"
+	"github.com/soulnvkz/llm/internal/llama"
+	mqc "github.com/soulnvkz/llm/internal/mq"
+	"github.com/soulnvkz/mq"
+	"github.com/soulnvkz/mq/domain"
+)
+
+func Getenv(env string) (v string) {
+	v, f := os.LookupEnv(env)
+	if !f {
+		log.Fatalf("ENV %s should be specifed", env)
+	}
+	return
+}
+
+// advertInterval is how often the worker advertises itself to the servers
+const advertInterval = 10 * time.Second
+
+// workerID is the hostname with a random suffix, so replicas on the same host differ
+func workerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "llm"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Panicf("%s, failed to generate worker id", err)
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// details is the state of the worker reported by the probes
+type details struct {
+	WorkerID   string     `json:"worker_id"`
+	Model      string     `json:"model"`
+	Status     string     `json:"status"`
+	LastDecode *time.Time `json:"last_decode,omitempty"`
+	// Speculative is set if the draft model is loaded
+	Speculative *speculativeDetails `json:"speculative,omitempty"`
+}
+
+// speculativeDetails are the totals of speculative decoding of all requests
+type speculativeDetails struct {
+	Drafted  int64 `json:"drafted"`
+	Accepted int64 `json:"accepted"`
+	// AcceptanceRate is the percent of the drafted tokens accepted by the main model
+	AcceptanceRate float64 `json:"acceptance_rate"`
+}
+
+func workerDetails(advert domain.WorkerAdvert, lastDecode time.Time, llm *llama.LLM) details {
+	d := details{
+		WorkerID: advert.WorkerID,
+		Model:    advert.Model,
+		Status:   advert.Status,
+	}
+	if !lastDecode.IsZero() {
+		d.LastDecode = &lastDecode
+	}
+	if llm.Speculative() {
+		drafted, accepted := llm.SpeculativeStats()
+		d.Speculative = &speculativeDetails{
+			Drafted:        drafted,
+			Accepted:       accepted,
+			AcceptanceRate: llama.SpeculativeAcceptance(drafted, accepted),
+		}
+	}
+	return d
+}
+
+// Run loads the model of the config and serves the requests of the transport until the context is done
+// or any of the consumers stops. The worker stops taking the requests then and finishes the current one,
+// the cancellations are taken until it is finished. The error is returned if a consumer has stopped
+// before the context is done. It is run by the worker binary and by the dev command
+// which runs the server and the worker in one process
+func Run(ctx context.Context, transport mq.Transport) error {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%s, invalid config", err)
+	}
+
+	mq_llm_q := Getenv("MQ_LLM_Q")
+	mq_workers_ex := Getenv("MQ_WORKERS_EX")
+	mq_control_ex := Getenv("MQ_CONTROL_EX")
+
+	llm := llama.NewLLM(context.Background(), cfg.Config)
+	loader := &modelLoader{llm: llm}
+	if err := loader.load(cfg); err != nil {
+		log.Panicf("%s", err)
+	}
+	defer llm.Clean()
+
+	mqllm := mqc.NewMQllm(transport, mqc.MQConfig{
+		ReqQKey:      mq_llm_q,
+		WorkersExKey: mq_workers_ex,
+		ControlExKey: mq_control_ex,
+		DrainTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
+
+		WorkerID: workerID(),
+		Model:    loader.model(),
+		Adapters: llm.Adapters(),
+	})
+
+	// run is done on shutdown or when any of the consumers stops, so the others are stopped with it
+	run, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+	cancellations_ctx, stopCancellations := context.WithCancel(context.Background())
+	defer stopCancellations()
+
+	pbuilder := llama.NewPromptBuilder(llm)
+
+	if err := mqllm.Advertise(run, advertInterval); err != nil {
+		log.Panicf("%s, failed to advertise worker", err)
+	}
+
+	completionsDone, err := mqllm.ConsumeCompletionsRequests(run, pbuilder, llm)
+	if err != nil {
+		log.Panicf("%s, failed to start consume completions", err)
+	}
+	cancellationsDone, err := mqllm.ConsumeCancellations(cancellations_ctx, llm)
+	if err != nil {
+		log.Panicf("%s, failed to start consume cancellations", err)
+	}
+	controlDone, err := mqllm.ConsumeControl(run, loader)
+	if err != nil {
+		log.Panicf("%s, failed to start consume control commands", err)
+	}
+
+	if len(cfg.HealthAddr) > 0 {
+		h := health.New(func() any {
+			return workerDetails(mqllm.Advert(), llm.LastDecode(), llm)
+		}).
+			Live("mq", mqllm.CheckTransport).
+			Live("consumers", mqllm.CheckConsumers).
+			Ready("model", func() error {
+				if !llm.Loaded() {
+					return errors.New("model is not loaded")
+				}
+				return nil
+			}).
+			Ready("shutdown", func() error {
+				if run.Err() != nil {
+					return errors.New("worker is shutting down")
+				}
+				return nil
+			})
+
+		server := &http.Server{
+			Addr:    cfg.HealthAddr,
+			Handler: h.Handler(),
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("%s, health listener has stopped", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	// the channel of the stopped consumer is received once, the others are waited after the shutdown
+	select {
+	case <-ctx.Done():
+	case <-completionsDone:
+		completionsDone = nil
+		err = errors.New("requests consumer has stopped")
+	case <-cancellationsDone:
+		cancellationsDone = nil
+		err = errors.New("cancellations consumer has stopped")
+	case <-controlDone:
+		controlDone = nil
+		err = errors.New("control consumer has stopped")
+	}
+	log.Printf("shutting down")
+	stopRun()
+	if completionsDone != nil {
+		<-completionsDone
+	}
+	stopCancellations()
+	if cancellationsDone != nil {
+		<-cancellationsDone
+	}
+	if controlDone != nil {
+		<-controlDone
+	}
+
+	// the channels and the model are freed by the deferred calls
+	return err
+}
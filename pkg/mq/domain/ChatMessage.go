@@ -3,4 +3,13 @@ package domain
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"Content"`
+	// Incomplete marks the last assistant message of the request as unfinished,
+	// the model keeps generating it instead of replying to the request content
+	Incomplete bool `json:"incomplete,omitempty"`
+
+	// ToolCalls are the calls requested by the assistant
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call the tool message is the result of
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Name       string `json:"name,omitempty"`
 }
@@ -7,6 +7,33 @@ type CompletionsRequest struct {
 	Content      string        `json:"content,omitempty"`
 	ChatMessages []ChatMessage `json:"chat_messages,omitempty"`
 	ChatID       string        `json:"chat_id,omitempty"`
+	// Prompt is the raw prompt the model continues, the chat template is not applied to it.
+	// It can't be used with the chat messages and the content
+	Prompt string `json:"prompt,omitempty"`
+	// Prefill is the beginning of the assistant reply, the model continues it verbatim
+	Prefill string `json:"prefill,omitempty"`
+
+	Context *ContextOptions `json:"context,omitempty"`
+	// Preview is the dry run, the worker replies with the prompt and does not generate
+	Preview bool `json:"preview,omitempty"`
+
+	// Grammar is GBNF grammar the output has to match
+	Grammar string `json:"grammar,omitempty"`
+	// JSONSchema is JSON schema the output has to match, it is converted to grammar by the worker
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	Tools []Tool `json:"tools,omitempty"`
+	// ToolChoice is auto when empty, none keeps the tools out of the prompt
+	ToolChoice string `json:"tool_choice,omitempty"`
+
+	// Adapter is the name of LoRA adapter applied to the model, AdapterScale is 1 if it is not set
+	Adapter      string  `json:"adapter,omitempty"`
+	AdapterScale float32 `json:"adapter_scale,omitempty"`
+
+	// Logprobs asks to send log-probabilities of the generated tokens
+	// with TopLogprobs most likely alternatives
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
 }
 
 func (r CompletionsRequest) Marshal() ([]byte, error) {
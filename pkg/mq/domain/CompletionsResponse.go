@@ -6,16 +6,43 @@ const (
 	CompletionsStart = 1
 	CompletionsNext  = 2
 	CompletionsEnd   = 3
+	CompletionsError = 4
+	// CompletionsContext reports how the chat history was fitted into the context window
+	CompletionsContext = 5
+	// CompletionsPreview is the reply to the preview request, nothing is generated
+	CompletionsPreview = 6
+	// CompletionsCancelled acknowledges the cancellation, the request is stopped or is not started
+	CompletionsCancelled = 7
+	// CompletionsReplay carries the responses the worker replays to the server which has resumed the stream
+	CompletionsReplay = 8
 )
 
 type CompletionsResponse struct {
 	RequestID string `json:"request_id"`
 	Content   string `json:"content,omitempty"`
 	ChatID    string `json:"chat_id,omitempty"`
+	// WorkerID is the worker which has taken the request, it is sent with CompletionsStart
+	WorkerID string `json:"worker_id,omitempty"`
+	// Index numbers the responses of the request from zero, the stream is resumed from it
+	Index int `json:"index"`
+
+	Context *ContextReport `json:"context,omitempty"`
+	Preview *PromptPreview `json:"preview,omitempty"`
+	// ToolCalls are parsed from the generated reply, they are sent with CompletionsEnd
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// Logprobs of the tokens of the content, they are sent with CompletionsNext if requested
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+	// Replay is sent with CompletionsReplay
+	Replay *StreamReplay `json:"replay,omitempty"`
 
 	ResType uint8 `json:"response_type"`
 }
 
+// ServerReplyQueue is the queue of the responses to the requests the server has published
+func ServerReplyQueue(serverID string) string {
+	return "llm_replies." + serverID
+}
+
 func (r CompletionsResponse) Marshal() ([]byte, error) {
 	bytes, err := json.Marshal(r)
 	if err != nil {
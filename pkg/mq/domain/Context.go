@@ -0,0 +1,31 @@
+package domain
+
+// strategies to fit chat history into the model context window
+const (
+	// ContextSlidingWindow drops the oldest messages
+	ContextSlidingWindow = "sliding_window"
+	// ContextKeepFirst keeps the first KeepFirst messages and drops the oldest messages after them
+	ContextKeepFirst = "keep_first"
+	// ContextSummarize replaces the dropped messages with their summary
+	ContextSummarize = "summarize"
+)
+
+type ContextOptions struct {
+	Strategy  string `json:"strategy,omitempty"`
+	KeepFirst int    `json:"keep_first,omitempty"`
+
+	// Summary is the summary of the first Summarized chat messages made by previous requests
+	Summary    string `json:"summary,omitempty"`
+	Summarized int    `json:"summarized,omitempty"`
+}
+
+// ContextReport describes how the chat history was fitted into the context window
+type ContextReport struct {
+	Strategy string `json:"strategy"`
+	// Dropped is the number of history messages which are not in the prompt as is
+	Dropped int `json:"dropped"`
+
+	// Summary covers the first Summarized chat messages, it should be sent with the next requests
+	Summary    string `json:"summary,omitempty"`
+	Summarized int    `json:"summarized,omitempty"`
+}
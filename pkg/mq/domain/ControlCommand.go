@@ -0,0 +1,48 @@
+package domain
+
+import "encoding/json"
+
+// commands of the workers
+const (
+	// CommandSwapModel makes the worker finish the current request and load the other model
+	CommandSwapModel = "swap_model"
+	// CommandReplayStream makes the worker which has the stream of the request
+	// send its responses after Index to the ReplyTo server, the rest of the stream goes there too
+	CommandReplayStream = "replay_stream"
+)
+
+// ControlCommand is published by the server to the control exchange,
+// the command is executed by every worker if WorkerID is empty
+type ControlCommand struct {
+	Command  string `json:"command"`
+	WorkerID string `json:"worker_id,omitempty"`
+
+	// Model is the path of GGUF file, the draft model and the adapters
+	// are replaced too and are not loaded if they are empty
+	Model        string `json:"model,omitempty"`
+	DraftModel   string `json:"draft_model,omitempty"`
+	LoraAdapters string `json:"lora_adapters,omitempty"`
+
+	// RequestID, Index and ReplyTo are the stream to replay and the server it is replayed to,
+	// the index -1 replays it from the beginning
+	RequestID string `json:"request_id,omitempty"`
+	Index     int    `json:"index,omitempty"`
+	ReplyTo   string `json:"reply_to,omitempty"`
+}
+
+func (c ControlCommand) Marshal() ([]byte, error) {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+func (c *ControlCommand) UnMarshal(data []byte) error {
+	err := json.Unmarshal(data, c)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package domain
+
+// MaxTopLogprobs is the max number of alternatives sent with every token
+const MaxTopLogprobs = 20
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	ID      int32   `json:"id"`
+	Logprob float32 `json:"logprob"`
+}
+
+// TokenLogprob is the log-probability of the generated token with the most likely alternatives
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	ID          int32        `json:"id"`
+	Logprob     float32      `json:"logprob"`
+	TopLogprobs []TopLogprob `json:"top_logprobs,omitempty"`
+}
@@ -0,0 +1,28 @@
+package domain
+
+// SamplingParams are the effective sampler settings of the request
+type SamplingParams struct {
+	Temperature float32 `json:"temperature"`
+	MinP        float32 `json:"min_p"`
+	// NPredict is the max number of generated tokens
+	NPredict    int    `json:"n_predict"`
+	Grammar     string `json:"grammar,omitempty"`
+	Logprobs    bool   `json:"logprobs,omitempty"`
+	TopLogprobs int    `json:"top_logprobs,omitempty"`
+
+	Adapter      string  `json:"adapter,omitempty"`
+	AdapterScale float32 `json:"adapter_scale,omitempty"`
+}
+
+// PromptPreview is the result of the dry run, it is the prompt the worker would generate the reply for
+type PromptPreview struct {
+	Prompt string `json:"prompt"`
+	// Tokens is the length of the prompt in tokens
+	Tokens int `json:"tokens"`
+	// Template is the name of the chat template the prompt is rendered with
+	Template string        `json:"template"`
+	Context  ContextReport `json:"context"`
+	// Dropped are the indices of the request chat messages which are not in the prompt
+	Dropped  []int          `json:"dropped"`
+	Sampling SamplingParams `json:"sampling"`
+}
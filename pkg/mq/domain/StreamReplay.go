@@ -0,0 +1,29 @@
+package domain
+
+import "encoding/json"
+
+// StreamReplay is the reply of the worker to CommandReplayStream, Responses are the responses after the index.
+// The stream is finished if its last response is sent already
+type StreamReplay struct {
+	RequestID string                `json:"request_id"`
+	WorkerID  string                `json:"worker_id"`
+	Responses []CompletionsResponse `json:"responses"`
+	Finished  bool                  `json:"finished,omitempty"`
+}
+
+func (r StreamReplay) Marshal() ([]byte, error) {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+func (r *StreamReplay) UnMarshal(data []byte) error {
+	err := json.Unmarshal(data, r)
+	if err != nil {
+		return err
+	}
+	return nil
+}
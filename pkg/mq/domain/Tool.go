@@ -0,0 +1,32 @@
+package domain
+
+import "encoding/json"
+
+const (
+	ToolChoiceAuto = "auto"
+	ToolChoiceNone = "none"
+)
+
+type ToolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is JSON schema of the function arguments
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type FunctionCall struct {
+	Name string `json:"name"`
+	// Arguments is JSON encoded object of the call arguments
+	Arguments string `json:"arguments"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
@@ -0,0 +1,50 @@
+package domain
+
+import "encoding/json"
+
+// statuses of the worker
+const (
+	WorkerReady = "ready"
+	// WorkerSwapping worker does not take requests until the model is loaded
+	WorkerSwapping = "swapping"
+)
+
+// WorkerAdvert is published by every worker periodically, so the servers know
+// which workers are alive and what they can do
+type WorkerAdvert struct {
+	WorkerID string `json:"worker_id"`
+	Model    string `json:"model"`
+	// Adapters are the names of LoRA adapters the worker has loaded
+	Adapters []string `json:"adapters,omitempty"`
+	Status   string   `json:"status"`
+	// Error is the failure of the last command
+	Error string `json:"error,omitempty"`
+}
+
+// AdapterQueue is the name of the queue of the requests for the adapter,
+// it is consumed by the workers which have loaded the adapter
+func AdapterQueue(queue string, adapter string) string {
+	return queue + "." + adapter
+}
+
+// WorkerCancelQueue is the queue of the cancellations of the requests the worker has taken
+func WorkerCancelQueue(workerID string) string {
+	return "llm_cancel." + workerID
+}
+
+func (a WorkerAdvert) Marshal() ([]byte, error) {
+	bytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+func (a *WorkerAdvert) UnMarshal(data []byte) error {
+	err := json.Unmarshal(data, a)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package mq
+
+import (
+	"context"
+	"sync"
+)
+
+// inprocBuffer is the capacity of the queues and the subscriptions of the in-process transport
+const inprocBuffer = 1024
+
+// InProc is the transport of the server and the worker in one process, so both of them
+// can run and be tested without a broker. The messages are not persisted and their TTL is ignored.
+// The dev command runs the server and the worker on it
+type InProc struct {
+	mu sync.RWMutex
+	// queues are the request queues, they live as long as the transport as the queues of RabbitMQ do
+	queues map[string]chan Message
+	// workers are the cancellations of the workers
+	workers map[string]*subscription
+	// topics are the subscriptions of the topics, the responses of the servers and the broadcast cancellations
+	topics map[string][]*subscription
+}
+
+// the reserved topics of the responses of the servers and the broadcast cancellations
+const (
+	inprocReplies = "\x00replies"
+	inprocCancels = "\x00cancels"
+)
+
+type subscription struct {
+	ch   chan Message
+	done chan struct{}
+}
+
+func NewInProc() *InProc {
+	return &InProc{
+		queues:  make(map[string]chan Message),
+		workers: make(map[string]*subscription),
+		topics:  make(map[string][]*subscription),
+	}
+}
+
+// send passes the message to the subscription, it waits if the subscription is full
+func (s *subscription) send(ctx context.Context, msg Message) error {
+	select {
+	case s.ch <- msg:
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (t *InProc) PublishRequest(ctx context.Context, queue string, msg Message) error {
+	t.mu.RLock()
+	q, ok := t.queues[queue]
+	t.mu.RUnlock()
+	if !ok {
+		return ErrUnroutable
+	}
+
+	select {
+	case q <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *InProc) ConsumeRequests(ctx context.Context, queues ...string) (<-chan Message, error) {
+	t.mu.Lock()
+	qs := make([]chan Message, 0, len(queues))
+	for _, name := range queues {
+		q, ok := t.queues[name]
+		if !ok {
+			q = make(chan Message, inprocBuffer)
+			t.queues[name] = q
+		}
+		qs = append(qs, q)
+	}
+	t.mu.Unlock()
+
+	out := make(chan Message)
+	wg := sync.WaitGroup{}
+	for _, q := range qs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-q:
+					select {
+					case out <- msg:
+					case <-ctx.Done():
+						// the request is not taken, so it is returned to the queue
+						q <- msg
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+func (t *InProc) Reply(ctx context.Context, server string, msg Message) error {
+	return t.publish(ctx, inprocReplies+"."+server, true, msg)
+}
+
+func (t *InProc) ConsumeReplies(ctx context.Context, server string) (<-chan Message, error) {
+	return t.subscribe(ctx, inprocReplies+"."+server), nil
+}
+
+func (t *InProc) Cancel(ctx context.Context, worker string, msg Message) error {
+	if len(worker) == 0 {
+		return t.publish(ctx, inprocCancels, false, msg)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.workers[worker]
+	if !ok {
+		return ErrUnroutable
+	}
+	return s.send(ctx, msg)
+}
+
+func (t *InProc) ConsumeCancellations(ctx context.Context, worker string) (<-chan Message, error) {
+	s := &subscription{
+		ch:   make(chan Message, inprocBuffer),
+		done: make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.workers[worker] = s
+	t.topics[inprocCancels] = append(t.topics[inprocCancels], s)
+	t.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		close(s.done)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.workers[worker] == s {
+			delete(t.workers, worker)
+		}
+		t.remove(inprocCancels, s)
+		close(s.ch)
+	})
+
+	return s.ch, nil
+}
+
+func (t *InProc) Broadcast(ctx context.Context, topic string, msg Message) error {
+	return t.publish(ctx, topic, false, msg)
+}
+
+func (t *InProc) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	return t.subscribe(ctx, topic), nil
+}
+
+// publish passes the message to every subscription of the topic,
+// it fails with ErrUnroutable if the message is mandatory and the topic has no subscriptions
+func (t *InProc) publish(ctx context.Context, topic string, mandatory bool, msg Message) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	subs := t.topics[topic]
+	if mandatory && len(subs) == 0 {
+		return ErrUnroutable
+	}
+	for _, s := range subs {
+		if err := s.send(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe adds the subscription to the topic until the context is done
+func (t *InProc) subscribe(ctx context.Context, topic string) <-chan Message {
+	s := &subscription{
+		ch:   make(chan Message, inprocBuffer),
+		done: make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.topics[topic] = append(t.topics[topic], s)
+	t.mu.Unlock()
+
+	// done releases the senders first, so the lock is taken and the channel is not written after it is closed
+	context.AfterFunc(ctx, func() {
+		close(s.done)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.remove(topic, s)
+		close(s.ch)
+	})
+
+	return s.ch
+}
+
+func (t *InProc) remove(topic string, s *subscription) {
+	subs := t.topics[topic]
+	for i, x := range subs {
+		if x == s {
+			t.topics[topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(t.topics[topic]) == 0 {
+		delete(t.topics, topic)
+	}
+}
+
+func (t *InProc) Check() error {
+	return nil
+}
+
+func (t *InProc) Close() error {
+	return nil
+}
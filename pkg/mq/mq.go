@@ -59,6 +59,26 @@ func NewMQueue(ch *amqp.Channel, name string) (*MQQueue, error) {
 	}, nil
 }
 
+// NewExclusiveMQueue declares the queue of the connection, it is deleted when the connection is closed
+func NewExclusiveMQueue(ch *amqp.Channel, name string) (*MQQueue, error) {
+	queue, err := ch.QueueDeclare(
+		name,  // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // args
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MQQueue{
+		ch: ch,
+		q:  &queue,
+	}, nil
+}
+
 func (q *MQQueue) Name() string {
 	return q.q.Name
 }
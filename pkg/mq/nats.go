@@ -0,0 +1,312 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// natsIDHeader carries the ID of the request the message belongs to
+	natsIDHeader = "Correlation-Id"
+	// natsReplyToHeader carries the server the responses to the request go to
+	natsReplyToHeader = "Reply-To"
+	// natsExpiresHeader is the unix time in nanoseconds the request expires at, it is set if the request has TTL
+	natsExpiresHeader = "Expires-At"
+	// natsBuffer is the capacity of the subscriptions
+	natsBuffer = 1024
+	// natsFetchWait is how long the queue is polled before the next queue of the worker is polled
+	natsFetchWait = time.Second
+	// natsProgress extends the ack wait of the request which is not taken yet
+	natsProgress = 10 * time.Second
+	// natsRequestTimeout is how long the worker acknowledges the cancellation sent to it
+	// and the server acknowledges the response
+	natsRequestTimeout = 5 * time.Second
+)
+
+// NATSConfig are the stream and the subjects of the transport
+type NATSConfig struct {
+	// Stream is the JetStream work queue stream of the requests
+	Stream string
+	// Prefix is the prefix of all subjects
+	Prefix string
+}
+
+// NATS is the transport of NATS. The requests are kept in the JetStream work queue stream,
+// every request queue has its durable consumer shared by the workers. The responses, the cancellations
+// and the topics are core NATS subjects, the responses go to the subject of the server of the request.
+//
+// The responses and the cancellations of the worker are sent as NATS requests the receivers acknowledge,
+// so they fail with ErrUnroutable if nobody is listening. The TTL of the request is checked by the worker,
+// the expired request is dropped when it is fetched
+type NATS struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	config NATSConfig
+}
+
+func NATSConnect(url string, limit int) (*nats.Conn, error) {
+	retry := 0
+	for {
+		nc, err := nats.Connect(url, nats.MaxReconnects(-1))
+		if err != nil {
+			log.Printf("%s, failed to connect to nats with %d retry", err, retry)
+			retry++
+			if retry > limit {
+				return nil, err
+			}
+
+			time.Sleep(500 * time.Millisecond)
+
+			continue
+		}
+		return nc, nil
+	}
+}
+
+func NewNATS(nc *nats.Conn, config NATSConfig) (*NATS, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsRequestTimeout)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      config.Stream,
+		Subjects:  []string{config.Prefix + ".requests.>"},
+		Retention: jetstream.WorkQueuePolicy,
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to declare requests stream"))
+	}
+
+	return &NATS{
+		nc:     nc,
+		js:     js,
+		config: config,
+	}, nil
+}
+
+func (t *NATS) subject(kind string, name ...string) string {
+	return strings.Join(append([]string{t.config.Prefix, kind}, name...), ".")
+}
+
+// durable is the name of the consumer of the queue, the names cannot have dots and wildcards
+func durable(queue string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(queue)
+}
+
+func natsMsg(subject string, msg Message) *nats.Msg {
+	m := nats.NewMsg(subject)
+	m.Header.Set(natsIDHeader, msg.ID)
+	m.Data = msg.Body
+	return m
+}
+
+func (t *NATS) PublishRequest(ctx context.Context, queue string, msg Message) error {
+	// the consumer of the queue is created by the workers, so the request is not routed without it
+	_, err := t.js.Consumer(ctx, t.config.Stream, durable(queue))
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return ErrUnroutable
+	}
+	if err != nil {
+		return err
+	}
+
+	m := natsMsg(t.subject("requests", queue), msg)
+	m.Header.Set(natsReplyToHeader, msg.ReplyTo)
+	if msg.TTL > 0 {
+		m.Header.Set(natsExpiresHeader, strconv.FormatInt(time.Now().Add(msg.TTL).UnixNano(), 10))
+	}
+	_, err = t.js.PublishMsg(ctx, m)
+	return err
+}
+
+// expired reports whether the TTL of the request has passed
+func expired(m jetstream.Msg) bool {
+	at, err := strconv.ParseInt(m.Headers().Get(natsExpiresHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().UnixNano() > at
+}
+
+func (t *NATS) ConsumeRequests(ctx context.Context, queues ...string) (<-chan Message, error) {
+	consumers := make([]jetstream.Consumer, 0, len(queues))
+	for _, queue := range queues {
+		c, err := t.js.CreateOrUpdateConsumer(ctx, t.config.Stream, jetstream.ConsumerConfig{
+			Durable:       durable(queue),
+			FilterSubject: t.subject("requests", queue),
+			AckPolicy:     jetstream.AckExplicitPolicy,
+		})
+		if err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, c)
+	}
+
+	out := make(chan Message)
+	// turn is held from the fetch until the request is taken, so the worker holds one request at a time
+	turn := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, c := range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				turn.Lock()
+				take(ctx, c, out)
+				turn.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// take fetches the request and passes it to out, it is acknowledged when it is taken
+// and is returned to the queue if the context is done before
+func take(ctx context.Context, c jetstream.Consumer, out chan<- Message) {
+	batch, err := c.Fetch(1, jetstream.FetchMaxWait(natsFetchWait))
+	if err != nil {
+		log.Printf("%s, failed to fetch request", err)
+		time.Sleep(natsFetchWait)
+		return
+	}
+
+	for m := range batch.Messages() {
+		if expired(m) {
+			// the expired request is removed from the queue, nobody awaits it
+			m.Term()
+			return
+		}
+
+		progress := time.NewTicker(natsProgress)
+		defer progress.Stop()
+
+		for {
+			select {
+			case out <- Message{
+				ID:      m.Headers().Get(natsIDHeader),
+				Body:    m.Data(),
+				ReplyTo: m.Headers().Get(natsReplyToHeader),
+			}:
+				m.Ack()
+				return
+			case <-progress.C:
+				m.InProgress()
+			case <-ctx.Done():
+				m.Nak()
+				return
+			}
+		}
+	}
+}
+
+// Reply requests the server to acknowledge the response, so the server which is gone has no responders
+func (t *NATS) Reply(ctx context.Context, server string, msg Message) error {
+	return t.request(ctx, natsMsg(t.subject("replies", server), msg))
+}
+
+func (t *NATS) ConsumeReplies(ctx context.Context, server string) (<-chan Message, error) {
+	return t.subscribe(ctx, true, t.subject("replies", server))
+}
+
+// Cancel requests the worker to acknowledge the cancellation, so the worker which is gone has no responders
+func (t *NATS) Cancel(ctx context.Context, worker string, msg Message) error {
+	if len(worker) == 0 {
+		return t.nc.PublishMsg(natsMsg(t.subject("cancel"), msg))
+	}
+	return t.request(ctx, natsMsg(t.subject("cancel", worker), msg))
+}
+
+// request waits for the first receiver to acknowledge the message, it fails with ErrUnroutable if there is none
+func (t *NATS) request(ctx context.Context, m *nats.Msg) error {
+	ctx, cancel := context.WithTimeout(ctx, natsRequestTimeout)
+	defer cancel()
+	_, err := t.nc.RequestMsgWithContext(ctx, m)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return ErrUnroutable
+	}
+	return err
+}
+
+func (t *NATS) ConsumeCancellations(ctx context.Context, worker string) (<-chan Message, error) {
+	return t.subscribe(ctx, true, t.subject("cancel"), t.subject("cancel", worker))
+}
+
+func (t *NATS) Broadcast(ctx context.Context, topic string, msg Message) error {
+	return t.nc.PublishMsg(natsMsg(t.subject("topics", topic), msg))
+}
+
+func (t *NATS) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	return t.subscribe(ctx, false, t.subject("topics", topic))
+}
+
+// subscribe merges the messages of the subjects until the context is done,
+// the requests among them are acknowledged if respond is set
+func (t *NATS) subscribe(ctx context.Context, respond bool, subjects ...string) (<-chan Message, error) {
+	in := make(chan *nats.Msg, natsBuffer)
+	subs := make([]*nats.Subscription, 0, len(subjects))
+	unsubscribe := func() {
+		for _, s := range subs {
+			s.Unsubscribe()
+		}
+	}
+
+	for _, subject := range subjects {
+		s, err := t.nc.ChanSubscribe(subject, in)
+		if err != nil {
+			unsubscribe()
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-in:
+				if respond && len(m.Reply) > 0 {
+					m.Respond(nil)
+				}
+				select {
+				case out <- Message{ID: m.Header.Get(natsIDHeader), Body: m.Data}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (t *NATS) Check() error {
+	if !t.nc.IsConnected() {
+		return errors.New("connection to NATS is closed")
+	}
+	return nil
+}
+
+// Close does nothing, the connection is closed by its owner
+func (t *NATS) Close() error {
+	return nil
+}
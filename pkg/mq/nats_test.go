@@ -0,0 +1,69 @@
+package mq
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// newTestNATS connects to the JetStream enabled server of NATS_URL, every test has its own stream and subjects
+func newTestNATS(t *testing.T) *NATS {
+	url, ok := os.LookupEnv("NATS_URL")
+	if !ok {
+		t.Skip("NATS_URL is not set")
+	}
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	name := testName(t)
+	tr, err := NewNATS(nc, NATSConfig{Stream: name, Prefix: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tr.js.DeleteStream(context.Background(), name)
+	})
+	return tr
+}
+
+func TestNATSTransport(t *testing.T) {
+	testTransport(t, func(t *testing.T) Transport {
+		return newTestNATS(t)
+	})
+}
+
+func TestNATSExpiredRequest(t *testing.T) {
+	tr := newTestNATS(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requests, err := tr.ConsumeRequests(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range requests {
+	}
+
+	if err := tr.PublishRequest(context.Background(), "q", Message{ID: "expired", TTL: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := tr.PublishRequest(context.Background(), "q", Message{ID: "live", TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, err = tr.ConsumeRequests(testContext(t), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, requests); msg.ID != "live" {
+		t.Fatalf("expected the live request, got %s", msg.ID)
+	}
+}
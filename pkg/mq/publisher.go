@@ -0,0 +1,93 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrUnroutable is returned if the mandatory message has no queue to go to
+	ErrUnroutable = errors.New("message is not routed to any queue")
+	// ErrNotConfirmed is returned if the broker has not taken the message
+	ErrNotConfirmed    = errors.New("message is not confirmed by the broker")
+	ErrPublisherClosed = errors.New("publisher channel is closed")
+)
+
+// Publisher publishes on the channel in confirm mode, every publish waits for the broker
+// to confirm the message, the returned mandatory messages are reported as ErrUnroutable
+type Publisher struct {
+	ch *amqp.Channel
+
+	// mu serializes the publishes, so the confirmation and the return belong to the last message
+	mu       sync.Mutex
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func NewPublisher(conn *MQConnection) (*Publisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return &Publisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		// the broker sends the return before the confirmation, so it is buffered when the confirmation comes
+		returns: ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// Channel is the channel of the publisher, it is used to declare the exchanges
+func (p *Publisher) Channel() *amqp.Channel {
+	return p.ch
+}
+
+func (p *Publisher) IsClosed() bool {
+	return p.ch.IsClosed()
+}
+
+// Publish sends the message and waits for the confirmation. The mandatory message
+// which is not routed to any queue fails with ErrUnroutable
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.ch.PublishWithContext(ctx,
+		exchange,  // exchange
+		key,       // routing key
+		mandatory, // mandatory
+		false,     // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+
+	// the confirmation is awaited even if the context is done, otherwise it is taken by the next message
+	confirm, ok := <-p.confirms
+	if !ok {
+		return ErrPublisherClosed
+	}
+
+	select {
+	case <-p.returns:
+		return ErrUnroutable
+	default:
+	}
+
+	if !confirm.Ack {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+func (p *Publisher) Close() error {
+	return p.ch.Close()
+}
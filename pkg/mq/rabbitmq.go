@@ -0,0 +1,263 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// RabbitMQConfig are the exchanges of the transport
+type RabbitMQConfig struct {
+	// CancelEx is the fanout exchange of the broadcast cancellations
+	CancelEx string
+}
+
+// RabbitMQ is the transport of RabbitMQ. The requests and the responses go to the queues through the default exchange,
+// every server has its exclusive reply queue. The broadcast cancellations and the topics go through the fanout exchanges.
+// Every consumer has its own channel, which is closed when the context is done
+type RabbitMQ struct {
+	pull, pub *MQConnection
+	publisher *Publisher
+	config    RabbitMQConfig
+
+	// topics are the declared exchanges of the topics
+	topics sync.Map
+}
+
+func NewRabbitMQ(pull, pub *MQConnection, config RabbitMQConfig) (*RabbitMQ, error) {
+	publisher, err := NewPublisher(pub)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to create publisher"))
+	}
+
+	if err := declareFanout(publisher.Channel(), config.CancelEx); err != nil {
+		publisher.Close()
+		return nil, err
+	}
+
+	return &RabbitMQ{
+		pull:      pull,
+		pub:       pub,
+		publisher: publisher,
+		config:    config,
+	}, nil
+}
+
+func declareFanout(ch *amqp.Channel, name string) error {
+	err := ch.ExchangeDeclare(
+		name,     // name
+		"fanout", // kind
+		false,    // durable
+		true,     // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // args
+	)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to declare exchange "+name))
+	}
+	return nil
+}
+
+func publishing(msg Message) amqp.Publishing {
+	p := amqp.Publishing{
+		ContentType:   "text/plain",
+		CorrelationId: msg.ID,
+		ReplyTo:       msg.ReplyTo,
+		Body:          msg.Body,
+	}
+	if msg.TTL > 0 {
+		p.Expiration = strconv.FormatInt(msg.TTL.Milliseconds(), 10)
+	}
+	return p
+}
+
+func (t *RabbitMQ) PublishRequest(ctx context.Context, queue string, msg Message) error {
+	return t.publisher.Publish(ctx, "", queue, true, publishing(msg))
+}
+
+func (t *RabbitMQ) ConsumeRequests(ctx context.Context, queues ...string) (<-chan Message, error) {
+	ch, err := t.pull.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// the worker takes one request at a time, the rest are taken by the other workers
+	if err := ch.Qos(1, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	qs := make([]*MQQueue, 0, len(queues))
+	for _, name := range queues {
+		q, err := NewMQueue(ch, name)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+
+	// the request is acknowledged when it is taken, so it is not returned to the queue after that
+	return consume(ctx, ch, true, qs...)
+}
+
+func (t *RabbitMQ) Reply(ctx context.Context, server string, msg Message) error {
+	return t.publisher.Publish(ctx, "", domain.ServerReplyQueue(server), true, publishing(msg))
+}
+
+func (t *RabbitMQ) ConsumeReplies(ctx context.Context, server string) (<-chan Message, error) {
+	ch, err := t.pull.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// the queue is gone with the server, so the responses sent to it fail
+	q, err := NewExclusiveMQueue(ch, domain.ServerReplyQueue(server))
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return consume(ctx, ch, false, q)
+}
+
+func (t *RabbitMQ) Cancel(ctx context.Context, worker string, msg Message) error {
+	if len(worker) == 0 {
+		return t.publisher.Publish(ctx, t.config.CancelEx, "", false, publishing(msg))
+	}
+	return t.publisher.Publish(ctx, "", domain.WorkerCancelQueue(worker), true, publishing(msg))
+}
+
+func (t *RabbitMQ) ConsumeCancellations(ctx context.Context, worker string) (<-chan Message, error) {
+	ch, err := t.pull.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcast, err := NewExclusiveMQueue(ch, "")
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if err := ch.QueueBind(broadcast.Name(), "", t.config.CancelEx, false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	// the queue of the worker is gone with the worker, so the cancellations sent to it fail
+	own, err := NewExclusiveMQueue(ch, domain.WorkerCancelQueue(worker))
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return consume(ctx, ch, false, broadcast, own)
+}
+
+func (t *RabbitMQ) Broadcast(ctx context.Context, topic string, msg Message) error {
+	if err := t.declareTopic(topic); err != nil {
+		return err
+	}
+	return t.publisher.Publish(ctx, topic, "", false, publishing(msg))
+}
+
+func (t *RabbitMQ) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	if err := t.declareTopic(topic); err != nil {
+		return nil, err
+	}
+	return t.subscribe(ctx, topic)
+}
+
+func (t *RabbitMQ) declareTopic(topic string) error {
+	if _, ok := t.topics.Load(topic); ok {
+		return nil
+	}
+	if err := declareFanout(t.publisher.Channel(), topic); err != nil {
+		return err
+	}
+	t.topics.Store(topic, struct{}{})
+	return nil
+}
+
+// subscribe consumes the exclusive queue bound to the fanout exchange
+func (t *RabbitMQ) subscribe(ctx context.Context, exchange string) (<-chan Message, error) {
+	ch, err := t.pull.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := NewExclusiveMQueue(ch, "")
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if err := ch.QueueBind(q.Name(), "", exchange, false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return consume(ctx, ch, false, q)
+}
+
+// consume merges the deliveries of the queues until the context is done, the channel is closed then.
+// The deliveries are acknowledged when they are received or, if onTake, when they are taken
+func consume(ctx context.Context, ch *amqp.Channel, onTake bool, qs ...*MQQueue) (<-chan Message, error) {
+	out := make(chan Message)
+	wg := sync.WaitGroup{}
+
+	for _, q := range qs {
+		deliveries, err := q.Consume()
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				if !onTake {
+					d.Ack(false)
+				}
+				select {
+				case out <- Message{ID: d.CorrelationId, Body: d.Body, ReplyTo: d.ReplyTo}:
+					if onTake {
+						d.Ack(false)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// the channel is closed on the context, so the deliveries end and the not taken ones are returned
+	stop := context.AfterFunc(ctx, func() {
+		ch.Close()
+	})
+	go func() {
+		wg.Wait()
+		stop()
+		ch.Close()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+func (t *RabbitMQ) Check() error {
+	if t.pull.IsClosed() || t.pub.IsClosed() {
+		return errors.New("connection to RabbitMQ is closed")
+	}
+	if t.publisher.IsClosed() {
+		return errors.New("mq channel is closed")
+	}
+	return nil
+}
+
+func (t *RabbitMQ) Close() error {
+	return t.publisher.Close()
+}
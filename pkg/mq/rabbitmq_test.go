@@ -0,0 +1,47 @@
+package mq
+
+import (
+	"os"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newTestRabbitMQ connects to the broker of RABBITMQ_URL, every test has its own exchanges.
+// The queues of the tests are not durable, so they are left until the broker restarts
+func newTestRabbitMQ(t *testing.T) *RabbitMQ {
+	url, ok := os.LookupEnv("RABBITMQ_URL")
+	if !ok {
+		t.Skip("RABBITMQ_URL is not set")
+	}
+
+	conns := make([]*MQConnection, 0, 2)
+	for range 2 {
+		conn, err := amqp.Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		conns = append(conns, &MQConnection{conn})
+	}
+
+	name := testName(t)
+	tr, err := NewRabbitMQ(conns[0], conns[1], RabbitMQConfig{
+		CancelEx: name + "_cancel",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tr.Close()
+	})
+	return tr
+}
+
+func TestRabbitMQTransport(t *testing.T) {
+	testTransport(t, func(t *testing.T) Transport {
+		return newTestRabbitMQ(t)
+	})
+}
@@ -0,0 +1,373 @@
+package mq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisGroup is the consumer group of the workers on every request stream
+	redisGroup = "workers"
+	// redisBlock is how long the stream is polled before the next stream of the worker is polled
+	redisBlock = time.Second
+	// redisProgress resets the idle time of the request which is not taken yet
+	redisProgress = 10 * time.Second
+	// redisReclaim is the idle time after which the request held by a gone worker is taken by another one
+	redisReclaim = 3 * redisProgress
+	// redisBuffer is the capacity of the subscriptions
+	redisBuffer = 1024
+)
+
+// RedisConfig is the prefix of the keys and the channels of the transport
+type RedisConfig struct {
+	Prefix string
+}
+
+// Redis is the transport of Redis. The requests are kept in the streams, every request queue
+// is the stream with the consumer group shared by the workers. The responses, the cancellations
+// and the topics are published to the channels, every server has its own channel of the responses.
+// The publisher learns from the number of receivers whether the message is routed.
+//
+// The request read by the worker stays pending until it is taken, the worker resets its idle time
+// meanwhile, so the request of the worker which is gone is reclaimed by another one.
+// The expired request is dropped when it is read
+type Redis struct {
+	rdb    *redis.Client
+	config RedisConfig
+	// consumer is the name of the transport in the consumer groups
+	consumer string
+}
+
+// redisMessage is the payload of the channels, the streams keep the same fields
+type redisMessage struct {
+	ID   string `json:"id"`
+	Body []byte `json:"body"`
+}
+
+func RedisConnect(url string, limit int) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+
+	retry := 0
+	for {
+		err := rdb.Ping(context.Background()).Err()
+		if err != nil {
+			log.Printf("%s, failed to connect to redis with %d retry", err, retry)
+			retry++
+			if retry > limit {
+				rdb.Close()
+				return nil, err
+			}
+
+			time.Sleep(500 * time.Millisecond)
+
+			continue
+		}
+		return rdb, nil
+	}
+}
+
+func NewRedis(rdb *redis.Client, config RedisConfig) (*Redis, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Join(err, errors.New("failed to generate consumer name"))
+	}
+
+	return &Redis{
+		rdb:      rdb,
+		config:   config,
+		consumer: hex.EncodeToString(id),
+	}, nil
+}
+
+func (t *Redis) key(kind string, name ...string) string {
+	return strings.Join(append([]string{t.config.Prefix, kind}, name...), ":")
+}
+
+func (t *Redis) PublishRequest(ctx context.Context, queue string, msg Message) error {
+	// the group of the stream is created by the workers, so the request is not routed without it
+	groups, err := t.rdb.XInfoGroups(ctx, t.key("requests", queue)).Result()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return ErrUnroutable
+	}
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return ErrUnroutable
+	}
+
+	values := map[string]any{"id": msg.ID, "body": msg.Body, "reply_to": msg.ReplyTo}
+	if msg.TTL > 0 {
+		values["expires_at"] = time.Now().Add(msg.TTL).UnixNano()
+	}
+	return t.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: t.key("requests", queue),
+		Values: values,
+	}).Err()
+}
+
+// redisExpired reports whether the TTL of the request has passed,
+// expires_at is the unix time in nanoseconds, it is set if the request has TTL
+func redisExpired(m *redis.XMessage) bool {
+	v, _ := m.Values["expires_at"].(string)
+	at, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().UnixNano() > at
+}
+
+func (t *Redis) ConsumeRequests(ctx context.Context, queues ...string) (<-chan Message, error) {
+	streams := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		stream := t.key("requests", queue)
+		err := t.rdb.XGroupCreateMkStream(ctx, stream, redisGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+
+	out := make(chan Message)
+	// turn is held from the read until the request is taken, so the worker holds one request at a time
+	turn := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				turn.Lock()
+				t.take(ctx, stream, out)
+				turn.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// read returns the request reclaimed from the gone worker or the next one of the stream
+func (t *Redis) read(ctx context.Context, stream string) (*redis.XMessage, error) {
+	claimed, _, err := t.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    redisGroup,
+		Consumer: t.consumer,
+		MinIdle:  redisReclaim,
+		Start:    "0-0",
+		Count:    1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(claimed) > 0 {
+		return &claimed[0], nil
+	}
+
+	res, err := t.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    redisGroup,
+		Consumer: t.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    redisBlock,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 || len(res[0].Messages) == 0 {
+		return nil, nil
+	}
+	return &res[0].Messages[0], nil
+}
+
+// take reads the request and passes it to out, it is removed from the stream when it is taken
+// and is added to the stream again if the context is done before
+func (t *Redis) take(ctx context.Context, stream string, out chan<- Message) {
+	m, err := t.read(ctx, stream)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("%s, failed to read request", err)
+			time.Sleep(redisBlock)
+		}
+		return
+	}
+	if m == nil {
+		return
+	}
+	if redisExpired(m) {
+		// the expired request is removed from the stream, nobody awaits it
+		t.ack(context.WithoutCancel(ctx), stream, m.ID)
+		return
+	}
+
+	id, _ := m.Values["id"].(string)
+	body, _ := m.Values["body"].(string)
+	replyTo, _ := m.Values["reply_to"].(string)
+
+	progress := time.NewTicker(redisProgress)
+	defer progress.Stop()
+
+	// bg outlives the context, so the request is returned to the stream after the context is done
+	bg := context.WithoutCancel(ctx)
+	for {
+		select {
+		case out <- Message{ID: id, Body: []byte(body), ReplyTo: replyTo}:
+			t.ack(bg, stream, m.ID)
+			return
+		case <-progress.C:
+			err := t.rdb.XClaim(bg, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    redisGroup,
+				Consumer: t.consumer,
+				Messages: []string{m.ID},
+			}).Err()
+			if err != nil {
+				log.Printf("%s, failed to extend request %s", err, id)
+			}
+		case <-ctx.Done():
+			_, err := t.rdb.TxPipelined(bg, func(p redis.Pipeliner) error {
+				p.XAdd(bg, &redis.XAddArgs{Stream: stream, Values: m.Values})
+				p.XAck(bg, stream, redisGroup, m.ID)
+				p.XDel(bg, stream, m.ID)
+				return nil
+			})
+			if err != nil {
+				log.Printf("%s, failed to return request %s", err, id)
+			}
+			return
+		}
+	}
+}
+
+func (t *Redis) ack(ctx context.Context, stream, id string) {
+	_, err := t.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAck(ctx, stream, redisGroup, id)
+		p.XDel(ctx, stream, id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("%s, failed to acknowledge request %s", err, id)
+	}
+}
+
+// publish sends the message to the channel,
+// it fails with ErrUnroutable if the message is mandatory and the channel has no receivers
+func (t *Redis) publish(ctx context.Context, channel string, mandatory bool, msg Message) error {
+	payload, err := json.Marshal(redisMessage{ID: msg.ID, Body: msg.Body})
+	if err != nil {
+		return err
+	}
+
+	n, err := t.rdb.Publish(ctx, channel, payload).Result()
+	if err != nil {
+		return err
+	}
+	if mandatory && n == 0 {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+func (t *Redis) Reply(ctx context.Context, server string, msg Message) error {
+	return t.publish(ctx, t.key("replies", server), true, msg)
+}
+
+func (t *Redis) ConsumeReplies(ctx context.Context, server string) (<-chan Message, error) {
+	return t.subscribe(ctx, t.key("replies", server))
+}
+
+func (t *Redis) Cancel(ctx context.Context, worker string, msg Message) error {
+	if len(worker) == 0 {
+		return t.publish(ctx, t.key("cancel"), false, msg)
+	}
+	return t.publish(ctx, t.key("cancel", worker), true, msg)
+}
+
+func (t *Redis) ConsumeCancellations(ctx context.Context, worker string) (<-chan Message, error) {
+	return t.subscribe(ctx, t.key("cancel"), t.key("cancel", worker))
+}
+
+func (t *Redis) Broadcast(ctx context.Context, topic string, msg Message) error {
+	return t.publish(ctx, t.key("topics", topic), false, msg)
+}
+
+func (t *Redis) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	return t.subscribe(ctx, t.key("topics", topic))
+}
+
+// subscribe merges the messages of the channels until the context is done
+func (t *Redis) subscribe(ctx context.Context, channels ...string) (<-chan Message, error) {
+	ps := t.rdb.Subscribe(ctx, channels...)
+	// the subscription is confirmed, so the messages published after return are received
+	for range channels {
+		if _, err := ps.Receive(ctx); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+
+	in := ps.Channel(redis.WithChannelSize(redisBuffer))
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		defer ps.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-in:
+				if !ok {
+					return
+				}
+
+				var msg redisMessage
+				if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+					log.Printf("%s, failed to decode message of %s", err, m.Channel)
+					continue
+				}
+				select {
+				case out <- Message{ID: msg.ID, Body: msg.Body}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (t *Redis) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := t.rdb.Ping(ctx).Err(); err != nil {
+		return errors.Join(err, errors.New("connection to Redis is broken"))
+	}
+	return nil
+}
+
+// Close does nothing, the client is closed by its owner
+func (t *Redis) Close() error {
+	return nil
+}
@@ -0,0 +1,141 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis runs the transport on the in-memory server, the clock of the server is returned
+// with it, so the idle time of the pending requests is under control of the test
+func newTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+	})
+
+	tr, err := NewRedis(rdb, RedisConfig{Prefix: testName(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, mr
+}
+
+func TestRedisPublishRequestWithoutGroup(t *testing.T) {
+	tr, _ := newTestRedis(t)
+
+	err := tr.PublishRequest(context.Background(), "q", Message{ID: "1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable without stream, got %v", err)
+	}
+
+	// the stream is left without the group of the workers
+	err = tr.rdb.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: tr.key("requests", "q"),
+		Values: map[string]any{"id": "0"},
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.PublishRequest(context.Background(), "q", Message{ID: "1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable without group, got %v", err)
+	}
+}
+
+func TestRedisReclaimFromGoneWorker(t *testing.T) {
+	tr, mr := newTestRedis(t)
+	ctx := context.Background()
+	stream := tr.key("requests", "q")
+
+	now := time.Now()
+	mr.SetTime(now)
+	if err := tr.rdb.XGroupCreateMkStream(ctx, stream, redisGroup, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.PublishRequest(ctx, "q", Message{ID: "1", Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the gone worker has read the request and has never taken it
+	err := tr.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    redisGroup,
+		Consumer: "gone",
+		Streams:  []string{stream, ">"},
+		Count:    1,
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.SetTime(now.Add(redisReclaim))
+
+	requests, err := tr.ConsumeRequests(testContext(t), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, requests)
+	if msg.ID != "1" || string(msg.Body) != "a" {
+		t.Fatalf("unexpected request %+v", msg)
+	}
+
+	pending, err := tr.rdb.XPending(ctx, stream, redisGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("expected the taken request to be acknowledged, %d are pending", pending.Count)
+	}
+}
+
+func TestRedisExpiredRequest(t *testing.T) {
+	tr, _ := newTestRedis(t)
+	ctx := context.Background()
+	stream := tr.key("requests", "q")
+
+	if err := tr.rdb.XGroupCreateMkStream(ctx, stream, redisGroup, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.PublishRequest(ctx, "q", Message{ID: "expired", TTL: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := tr.PublishRequest(ctx, "q", Message{ID: "live", TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, err := tr.ConsumeRequests(testContext(t), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, requests); msg.ID != "live" {
+		t.Fatalf("expected the live request, got %s", msg.ID)
+	}
+
+	// the expired request is removed from the stream as the taken one, which is acknowledged after it is passed
+	deadline := time.Now().Add(testTimeout)
+	for {
+		n, err := tr.rdb.XLen(ctx, stream).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stream to be empty, %d requests are left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisTransport(t *testing.T) {
+	testTransport(t, func(t *testing.T) Transport {
+		tr, _ := newTestRedis(t)
+		return tr
+	})
+}
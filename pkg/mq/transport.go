@@ -0,0 +1,51 @@
+package mq
+
+import (
+	"context"
+	"time"
+)
+
+// Message is the message of the transport, ID is the ID of the request it belongs to
+type Message struct {
+	ID   string
+	Body []byte
+	// ReplyTo is the server the responses to the request go to, it is set on the requests
+	ReplyTo string
+	// TTL drops the message if it is not taken in time, it is not limited if zero
+	TTL time.Duration
+}
+
+// Transport carries the requests from the servers to the workers, the responses back
+// and the cancellations. The messages of the topics are broadcast, e.g. the worker adverts
+// and the control commands.
+//
+// The requests are taken from the queue by one worker, the responses go to the reply queue
+// of the server which has published the request, so the server which is gone fails the replies
+type Transport interface {
+	// PublishRequest sends the request to the queue, it fails with ErrUnroutable if no worker has declared the queue
+	PublishRequest(ctx context.Context, queue string, msg Message) error
+	// ConsumeRequests declares the queues and takes the requests one by one until the context is done,
+	// the requests which are not taken are returned to the queues then
+	ConsumeRequests(ctx context.Context, queues ...string) (<-chan Message, error)
+
+	// Reply sends the response to the server, it fails with ErrUnroutable if the server is gone
+	Reply(ctx context.Context, server string, msg Message) error
+	// ConsumeReplies declares the reply queue of the server and receives the responses sent to it
+	// until the context is done
+	ConsumeReplies(ctx context.Context, server string) (<-chan Message, error)
+
+	// Cancel sends the cancellation to the worker, it is broadcast to all workers if the worker is empty.
+	// It fails with ErrUnroutable if the worker is gone
+	Cancel(ctx context.Context, worker string, msg Message) error
+	// ConsumeCancellations receives the cancellations of the worker and the broadcast ones until the context is done
+	ConsumeCancellations(ctx context.Context, worker string) (<-chan Message, error)
+
+	// Broadcast publishes the message to all subscribers of the topic
+	Broadcast(ctx context.Context, topic string, msg Message) error
+	// Subscribe receives the messages of the topic until the context is done
+	Subscribe(ctx context.Context, topic string) (<-chan Message, error)
+
+	// Check returns an error if the transport is broken
+	Check() error
+	Close() error
+}
@@ -0,0 +1,308 @@
+package mq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTimeout is how long the tests wait for the message
+const testTimeout = 5 * time.Second
+
+// testName is the unique name of the keys, the streams and the subjects of the test
+func testName(t *testing.T) string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return "test_" + hex.EncodeToString(id)
+}
+
+// testContext is done when the test ends
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func receive(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("channel is closed")
+		}
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("message is not received")
+	}
+	return Message{}
+}
+
+// transportTests are the contract of the Transport, every transport runs them
+var transportTests = []struct {
+	name string
+	test func(t *testing.T, tr Transport)
+}{
+	{"RequestWithoutWorker", testRequestWithoutWorker},
+	{"RequestTakenOnce", testRequestTakenOnce},
+	{"RequestReturnedOnCancel", testRequestReturnedOnCancel},
+	{"Reply", testReply},
+	{"ReplyToStoppedServer", testReplyToStoppedServer},
+	{"Cancel", testCancel},
+	{"Broadcast", testBroadcast},
+	{"ClosedOnContext", testClosedOnContext},
+}
+
+// testTransport runs the contract against the transport, every test has its own transport
+func testTransport(t *testing.T, newTransport func(t *testing.T) Transport) {
+	for _, tt := range transportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newTransport(t))
+		})
+	}
+}
+
+func TestInProcTransport(t *testing.T) {
+	testTransport(t, func(t *testing.T) Transport {
+		return NewInProc()
+	})
+}
+
+func testRequestWithoutWorker(t *testing.T, tr Transport) {
+	err := tr.PublishRequest(context.Background(), testName(t), Message{ID: "1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable, got %v", err)
+	}
+}
+
+func testRequestTakenOnce(t *testing.T, tr Transport) {
+	queue := testName(t)
+	workers := make([]<-chan Message, 0, 2)
+	for range 2 {
+		requests, err := tr.ConsumeRequests(testContext(t), queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, requests)
+	}
+
+	ids := []string{"1", "2", "3", "4"}
+	for _, id := range ids {
+		if err := tr.PublishRequest(context.Background(), queue, Message{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken := make(map[string]int)
+	timeout := time.After(testTimeout)
+	for len(taken) < len(ids) {
+		select {
+		case msg := <-workers[0]:
+			taken[msg.ID]++
+		case msg := <-workers[1]:
+			taken[msg.ID]++
+		case <-timeout:
+			t.Fatalf("requests are not taken, taken %v", taken)
+		}
+	}
+
+	// the requests are taken, so nothing is left to the workers
+	select {
+	case msg := <-workers[0]:
+		taken[msg.ID]++
+	case msg := <-workers[1]:
+		taken[msg.ID]++
+	case <-time.After(200 * time.Millisecond):
+	}
+	for _, id := range ids {
+		if taken[id] != 1 {
+			t.Fatalf("expected every request to be taken once, taken %v", taken)
+		}
+	}
+}
+
+func testRequestReturnedOnCancel(t *testing.T, tr Transport) {
+	queue := testName(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := tr.ConsumeRequests(ctx, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.PublishRequest(context.Background(), queue, Message{ID: "1", Body: []byte("a"), ReplyTo: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first worker has read the request, but it is not taken
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	for range first {
+		t.Fatal("request is taken after the context is done")
+	}
+
+	second, err := tr.ConsumeRequests(testContext(t), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, second)
+	if msg.ID != "1" || string(msg.Body) != "a" || msg.ReplyTo != "server" {
+		t.Fatalf("unexpected request %+v", msg)
+	}
+}
+
+func testReply(t *testing.T, tr Transport) {
+	if err := tr.Reply(context.Background(), "gone", Message{ID: "1"}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable for the gone server, got %v", err)
+	}
+
+	first, err := tr.ConsumeReplies(testContext(t), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tr.ConsumeReplies(testContext(t), "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Reply(context.Background(), "first", Message{ID: "1", Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reply(context.Background(), "second", Message{ID: "2", Body: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	// the response of the first server does not go to the second one
+	if msg := receive(t, first); msg.ID != "1" || string(msg.Body) != "a" {
+		t.Fatalf("unexpected reply %+v", msg)
+	}
+	if msg := receive(t, second); msg.ID != "2" || string(msg.Body) != "b" {
+		t.Fatalf("unexpected reply %+v", msg)
+	}
+}
+
+func testReplyToStoppedServer(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	replies, err := tr.ConsumeReplies(ctx, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reply(context.Background(), "server", Message{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, replies)
+
+	// the server is gone, so the worker learns it from the next responses,
+	// the broker can take a moment to drop the subscription of the closed connection
+	cancel()
+	for range replies {
+	}
+	deadline := time.Now().Add(testTimeout)
+	for {
+		err := tr.Reply(context.Background(), "server", Message{ID: "2"})
+		if errors.Is(err, ErrUnroutable) {
+			return
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("expected ErrUnroutable after the server has stopped, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testCancel(t *testing.T, tr Transport) {
+	if err := tr.Cancel(context.Background(), "", Message{ID: "0"}); err != nil {
+		t.Fatalf("expected the broadcast cancellation without workers to be sent, got %v", err)
+	}
+	if err := tr.Cancel(context.Background(), "gone", Message{ID: "0"}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable for the gone worker, got %v", err)
+	}
+
+	first, err := tr.ConsumeCancellations(testContext(t), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tr.ConsumeCancellations(testContext(t), "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Cancel(context.Background(), "first", Message{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, first); msg.ID != "1" {
+		t.Fatalf("expected the cancellation of the worker, got %s", msg.ID)
+	}
+
+	if err := tr.Cancel(context.Background(), "", Message{ID: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	// the cancellation of the first worker does not go to the second one
+	for _, cancellations := range []<-chan Message{first, second} {
+		if msg := receive(t, cancellations); msg.ID != "2" {
+			t.Fatalf("expected the broadcast cancellation, got %s", msg.ID)
+		}
+	}
+}
+
+func testBroadcast(t *testing.T, tr Transport) {
+	topic := testName(t)
+	if err := tr.Broadcast(context.Background(), topic, Message{ID: "0"}); err != nil {
+		t.Fatalf("expected the broadcast without subscribers to be sent, got %v", err)
+	}
+
+	subscribers := make([]<-chan Message, 0, 2)
+	for range 2 {
+		messages, err := tr.Subscribe(testContext(t), topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscribers = append(subscribers, messages)
+	}
+
+	if err := tr.Broadcast(context.Background(), topic, Message{ID: "1", Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, messages := range subscribers {
+		if msg := receive(t, messages); msg.ID != "1" || string(msg.Body) != "a" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+}
+
+func testClosedOnContext(t *testing.T, tr Transport) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests, err := tr.ConsumeRequests(ctx, testName(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := tr.ConsumeReplies(ctx, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancellations, err := tr.ConsumeCancellations(ctx, "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := tr.Subscribe(ctx, testName(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	for _, ch := range []<-chan Message{requests, replies, cancellations, messages} {
+		select {
+		case _, ok := <-ch:
+			if ok {
+				t.Fatal("message is received after the context is done")
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("channel is not closed after the context is done")
+		}
+	}
+}
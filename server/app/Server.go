@@ -0,0 +1,234 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq"
+	"github.com/soulnvkz/server/internal/chat"
+	mqc "github.com/soulnvkz/server/internal/mq"
+	"github.com/soulnvkz/server/internal/openai"
+	"github.com/soulnvkz/server/internal/rest"
+	wsc "github.com/soulnvkz/server/internal/ws"
+)
+
+func Getenv(env string) (v string) {
+	v, f := os.LookupEnv(env)
+	if !f {
+		log.Error().Fatalf("ENV %s should be specifed", env)
+	}
+	return
+}
+
+type wrappedWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *wrappedWriter) WriteHeader(statusCode int) {
+	w.ResponseWriter.WriteHeader(statusCode)
+	w.statusCode = statusCode
+}
+
+func (w *wrappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+func (w *wrappedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &wrappedWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+
+		next.ServeHTTP(wrapped, r)
+
+		log.Info().Println(wrapped.statusCode, r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
+// chatTTL is how long the chats are kept if they are not used, it is set by CHAT_TTL
+const chatTTL = 24 * time.Hour
+
+// newChatStore creates the store selected by CHAT_STORE, the chats are kept in memory by default.
+// The returned function closes the connection of the store
+func newChatStore() (chat.ChatStore, func()) {
+	ttl := chatTTL
+	if v, ok := os.LookupEnv("CHAT_TTL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Error().Panicf("invalid CHAT_TTL %s", v)
+		}
+		ttl = d
+	}
+
+	switch kind := os.Getenv("CHAT_STORE"); kind {
+	case "", "memory":
+		return chat.NewMemoryChatStore(ttl), func() {}
+	case "redis":
+		rdb, err := mq.RedisConnect(Getenv("REDIS_URL"), 20)
+		if err != nil {
+			log.Error().Panicf("%s, failed to connect to Redis", err)
+		}
+		return chat.NewRedisChatStore(rdb, mqc.RedisPrefixKey, ttl), func() {
+			rdb.Close()
+		}
+	default:
+		log.Error().Panicf("unsupported chat store %s", kind)
+		return nil, nil
+	}
+}
+
+// shutdownTimeout is how long the active requests can take to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// Run serves the clients with the workers of the transport until the context is done,
+// the active requests are finished then. It is run by the server binary and by the dev command
+// which runs the server and the worker in one process with the in-process transport
+func Run(ctx context.Context, transport mq.Transport) error {
+	chats, closeChats := newChatStore()
+	defer closeChats()
+	// streams are shared by the websocket and the rest clients, every chat has only one stream at a time
+	streams := chat.NewChatStreams()
+
+	// workers advertise their models and adapters, the requests with adapter are routed by them
+	workers := mqc.NewWorkers(transport)
+	if err := workers.Consume(context.Background()); err != nil {
+		return errors.Join(err, errors.New("failed to consume workers adverts"))
+	}
+
+	// completions are shared by all requests, the replies come to the single queue of the server
+	completions, err := mqc.NewMQCompletions(transport, workers)
+	if err != nil {
+		return errors.Join(err, errors.New("failed to initilize mq"))
+	}
+	defer completions.Close()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	// sockets are hijacked connections, the server shutdown does not wait for them
+	sockets := sync.WaitGroup{}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/completions", func(w http.ResponseWriter, r *http.Request) {
+		websocket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Error().Print(err)
+			return
+		}
+		sockets.Add(1)
+		defer sockets.Done()
+
+		websocket.SetCloseHandler(func(code int, text string) error {
+			log.Info().Printf("closing ws connection. Code: %d, text:%s", code, text)
+			return nil
+		})
+
+		// chats are shared between connections and addressed by chat ID,
+		// messages without chat ID go to the default chat of the connection
+		socket := wsc.NewWSCompletions(r.Context(), websocket, completions, chats, streams)
+		defer socket.Close()
+
+		stopShutdown := context.AfterFunc(ctx, func() {
+			sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			socket.Shutdown(sctx)
+		})
+		defer stopShutdown()
+
+		socket.HandleMessages()
+	})
+
+	rest.NewChatsHandler(chats, streams, completions).Register(router)
+
+	rest.NewWorkersHandler(workers).Register(router)
+
+	// admin routes are enabled with the admin token
+	if token, ok := os.LookupEnv("ADMIN_TOKEN"); ok && len(token) > 0 {
+		control := mqc.NewMQControl(transport)
+		rest.NewAdminHandler(token, control, workers).Register(router)
+	}
+
+	openai.NewHandler(completions).Register(router)
+
+	rest.NewHealthHandler().
+		Live("mq", func(context.Context) error {
+			return transport.Check()
+		}).
+		Ready("chats", chats.Ping).
+		Ready("shutdown", func(context.Context) error {
+			if ctx.Err() != nil {
+				return errors.New("server is shutting down")
+			}
+			return nil
+		}).
+		Register(router)
+
+	// requests are cancelled with base context if they do not finish in time on shutdown,
+	// so the clients get the error before the connections are closed
+	base, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	server := http.Server{
+		Addr:    ":8080",
+		Handler: Logging(router),
+		BaseContext: func(net.Listener) context.Context {
+			return base
+		},
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		// the server is not shut down yet, so it has failed to listen
+		return err
+	case <-ctx.Done():
+	}
+	log.Info().Print("shutting down...")
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(sctx); err != nil {
+		log.Error().Printf("%s, cancelling active requests", err)
+		cancelRequests()
+
+		cctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(cctx); err != nil {
+			server.Close()
+		}
+	}
+	sockets.Wait()
+
+	// the channels and the connections are closed by the deferred calls
+	return nil
+}
@@ -1,124 +1,101 @@
 package main
 
 import (
-	"bufio"
-	"errors"
-	"net"
-	"net/http"
+	"context"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/gorilla/websocket"
 	"github.com/soulnvkz/log"
 	"github.com/soulnvkz/mq"
-	"github.com/soulnvkz/server/internal/chat"
+	"github.com/soulnvkz/server/app"
 	mqc "github.com/soulnvkz/server/internal/mq"
-	wsc "github.com/soulnvkz/server/internal/ws"
 )
 
-func Getenv(env string) (v string) {
-	v, f := os.LookupEnv(env)
-	if !f {
-		log.Error().Fatalf("ENV %s should be specifed", env)
-	}
-	return
-}
-
-type wrappedWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (w *wrappedWriter) WriteHeader(statusCode int) {
-	w.ResponseWriter.WriteHeader(statusCode)
-	w.statusCode = statusCode
-}
-
-func (w *wrappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	h, ok := w.ResponseWriter.(http.Hijacker)
-	if !ok {
-		return nil, nil, errors.New("hijack not supported")
-	}
-	return h.Hijack()
-}
-
-func Logging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapped := &wrappedWriter{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
+// newTransport connects to the broker selected by MQ_TRANSPORT, it is RabbitMQ by default.
+// The returned function closes the transport and its connections
+func newTransport() (mq.Transport, func()) {
+	switch kind := os.Getenv("MQ_TRANSPORT"); kind {
+	case "", "rabbitmq":
+		mq_user := app.Getenv("MQ_USER")
+		mq_password := app.Getenv("MQ_PASSWORD")
+		mq_host := app.Getenv("MQ_HOST")
+		mq_port := app.Getenv("MQ_PORT")
+
+		qconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
+		if err != nil {
+			log.Error().Panicf("%s, failed to connect to RabbitMQ", err)
 		}
-
-		next.ServeHTTP(wrapped, r)
-
-		log.Info().Println(wrapped.statusCode, r.Method, r.URL.Path, time.Since(start))
-	})
-}
-
-func main() {
-	log.Info().Print("Hello, server!")
-
-	mq_user := Getenv("MQ_USER")
-	mq_password := Getenv("MQ_PASSWORD")
-	mq_host := Getenv("MQ_HOST")
-	mq_port := Getenv("MQ_PORT")
-
-	qconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
-	if err != nil {
-		log.Error().Panicf("%s, failed to connect to RabbitMQ", err)
-	}
-	defer qconn.Close()
-
-	pqconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
-	if err != nil {
-		log.Error().Panicf("%s, failed to connect to RabbitMQ", err)
-	}
-	defer pqconn.Close()
-
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
-	router := http.NewServeMux()
-	router.HandleFunc("/completions", func(w http.ResponseWriter, r *http.Request) {
-		websocket, err := upgrader.Upgrade(w, r, nil)
+		pqconn, err := mq.MQConnect(mq_user, mq_password, mq_host, mq_port, 20)
 		if err != nil {
-			log.Error().Print(err)
+			log.Error().Panicf("%s, failed to connect to RabbitMQ", err)
 		}
 
-		websocket.SetCloseHandler(func(code int, text string) error {
-			log.Info().Printf("closing ws connection. Code: %d, text:%s", code, text)
-			return nil
+		transport, err := mq.NewRabbitMQ(qconn, pqconn, mq.RabbitMQConfig{
+			CancelEx: mqc.CancelExchangeKey,
 		})
+		if err != nil {
+			log.Error().Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			pqconn.Close()
+			qconn.Close()
+		}
+	case "nats":
+		nc, err := mq.NATSConnect(app.Getenv("NATS_URL"), 20)
+		if err != nil {
+			log.Error().Panicf("%s, failed to connect to NATS", err)
+		}
 
-		mqcompeltions, err := mqc.NewMQCompletions(qconn, pqconn)
+		transport, err := mq.NewNATS(nc, mq.NATSConfig{
+			Stream: mqc.NATSStreamKey,
+			Prefix: mqc.NATSPrefixKey,
+		})
 		if err != nil {
-			log.Error().Print(err)
+			log.Error().Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			nc.Close()
+		}
+	case "redis":
+		rdb, err := mq.RedisConnect(app.Getenv("REDIS_URL"), 20)
+		if err != nil {
+			log.Error().Panicf("%s, failed to connect to Redis", err)
 		}
-		defer mqcompeltions.Close()
 
-		// for now chat and connection is the same. Every new connection creating new chat context
-		// TODO: implement chat storage via db/files/redis/whatever
-		chatContext := chat.NewChatContext()
+		transport, err := mq.NewRedis(rdb, mq.RedisConfig{
+			Prefix: mqc.RedisPrefixKey,
+		})
+		if err != nil {
+			log.Error().Panicf("%s, failed to initilize mq", err)
+		}
+		return transport, func() {
+			transport.Close()
+			rdb.Close()
+		}
+	case "inproc":
+		// the server binary has no worker to serve the requests of the in-process transport
+		log.Error().Panicf("in-process transport is served by the dev command, it runs the server and the worker in one process")
+		return nil, nil
+	default:
+		log.Error().Panicf("unsupported transport %s", kind)
+		return nil, nil
+	}
+}
 
-		socket := wsc.NewWSCompletions(r.Context(), websocket, mqcompeltions, chatContext)
-		defer socket.Close()
+func main() {
+	log.Info().Print("Hello, server!")
 
-		socket.HandleMessages()
-	})
+	// ctx is done on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	server := http.Server{
-		Addr:    ":8080",
-		Handler: Logging(router),
-	}
+	transport, closeTransport := newTransport()
+	defer closeTransport()
 
-	err = server.ListenAndServe()
-	if err != nil {
-		log.Error().Fatal(err)
+	if err := app.Run(ctx, transport); err != nil {
+		log.Error().Panicf("%s, server has stopped", err)
 	}
 }
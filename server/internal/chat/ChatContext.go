@@ -1,17 +1,375 @@
 package chat
 
-import "github.com/soulnvkz/mq/domain"
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/mq/domain"
+)
+
+var (
+	ErrChatNotFound      = errors.New("chat not found")
+	ErrNodeNotFound      = errors.New("chat message not found")
+	ErrNoUserTurn        = errors.New("no user message to regenerate reply for")
+	ErrNothingToContinue = errors.New("no assistant message to continue")
+	ErrStreamActive      = errors.New("previous stream is not finished")
+)
+
+// statuses of chat messages, partial replies of cancelled
+// or failed streams are kept with their status
+const (
+	StatusComplete  = "complete"
+	StatusCancelled = "cancelled"
+	StatusFailed    = "error"
+)
+
+// ChatNode is a message in the chat tree. Every edit or regeneration
+// adds a new child to the parent node, so discarded continuations stay
+// in the tree as branches
+type ChatNode struct {
+	ID       string             `json:"id"`
+	ParentID string             `json:"parent_id,omitempty"`
+	Message  domain.ChatMessage `json:"message"`
+	Children []string           `json:"children,omitempty"`
+	// Selected is the index of the child on the active branch
+	Selected int    `json:"selected"`
+	Status   string `json:"status"`
+	// Summary is the summary of the messages from the start of the chat up to this node,
+	// it replaces them in the prompt when the history does not fit into the context window
+	Summary string `json:"summary,omitempty"`
+}
+
+// ChatHistory is a snapshot of the chat tree with the active branch
+type ChatHistory struct {
+	ChatID string     `json:"chat_id"`
+	Nodes  []ChatNode `json:"nodes"`
+	Path   []string   `json:"path"`
+}
 
 type ChatContext struct {
-	Messages []domain.ChatMessage
+	ID string
+
+	// root is a virtual node without message, its children are the first messages of the chat
+	root  *ChatNode
+	nodes map[string]*ChatNode
+
+	// update applies the change of the chat for the store, e.g. to apply it to the latest stored tree
+	// and persist it. The chat is locked while the change is applied
+	update func(c *ChatContext, change func() error) error
+
+	mu sync.Mutex
 }
 
-func NewChatContext() *ChatContext {
+func NewChatContext(id string) *ChatContext {
 	return &ChatContext{
-		Messages: make([]domain.ChatMessage, 0, 50),
+		ID:    id,
+		root:  &ChatNode{},
+		nodes: make(map[string]*ChatNode),
+	}
+}
+
+// restoreChatContext rebuilds the chat from its snapshot
+func restoreChatContext(h ChatHistory) *ChatContext {
+	c := NewChatContext(h.ChatID)
+	c.restore(h)
+	return c
+}
+
+// restore replaces the tree of the chat with the snapshot, it is called with the lock held
+func (c *ChatContext) restore(h ChatHistory) {
+	c.root = &ChatNode{}
+	c.nodes = make(map[string]*ChatNode, len(h.Nodes))
+	for _, n := range h.Nodes {
+		node := n
+		c.nodes[node.ID] = &node
+		if len(node.ParentID) == 0 {
+			c.root.Children = append(c.root.Children, node.ID)
+		}
+	}
+	if len(h.Path) > 0 {
+		for i, id := range c.root.Children {
+			if id == h.Path[0] {
+				c.root.Selected = i
+				break
+			}
+		}
+	}
+}
+
+// change applies the change with the chat locked, the store applies it by itself if it is set
+func (c *ChatContext) change(f func() error) error {
+	if c.update != nil {
+		return c.update(c, f)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return f()
+}
+
+func (c *ChatContext) node(id string) (*ChatNode, bool) {
+	if len(id) == 0 {
+		return c.root, true
+	}
+	n, ok := c.nodes[id]
+	return n, ok
+}
+
+func (c *ChatContext) path() []*ChatNode {
+	path := make([]*ChatNode, 0, len(c.nodes))
+	n := c.root
+	for len(n.Children) > 0 {
+		n = c.nodes[n.Children[n.Selected]]
+		path = append(path, n)
+	}
+	return path
+}
+
+// Leaf returns ID of the last message on the active branch
+func (c *ChatContext) Leaf() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path()
+	if len(path) == 0 {
+		return ""
+	}
+	return path[len(path)-1].ID
+}
+
+// Append adds messages as a chain under the parent node and makes the chain active.
+// Returns IDs of the added nodes
+func (c *ChatContext) Append(parentID string, messages ...domain.ChatMessage) ([]string, error) {
+	var ids []string
+	err := c.change(func() error {
+		parent, ok := c.node(parentID)
+		if !ok {
+			return ErrNodeNotFound
+		}
+
+		ids = make([]string, 0, len(messages))
+		for _, m := range messages {
+			n := &ChatNode{
+				ID:       uuid.New().String(),
+				ParentID: parent.ID,
+				Message:  m,
+				Status:   StatusComplete,
+			}
+			c.nodes[n.ID] = n
+
+			parent.Children = append(parent.Children, n.ID)
+			parent.Selected = len(parent.Children) - 1
+
+			ids = append(ids, n.ID)
+			parent = n
+		}
+		c.selectAncestors(parent)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	return ids, nil
+}
+
+func (c *ChatContext) SetStatus(nodeID string, status string) error {
+	return c.change(func() error {
+		n, ok := c.nodes[nodeID]
+		if !ok {
+			return ErrNodeNotFound
+		}
+		n.Status = status
+		return nil
+	})
 }
 
-func (c *ChatContext) Add(m domain.ChatMessage) {
-	c.Messages = append(c.Messages, m)
+// Extend appends the content to the message, it is used to save continuations of partial replies
+func (c *ChatContext) Extend(nodeID string, content string, status string) error {
+	return c.change(func() error {
+		n, ok := c.nodes[nodeID]
+		if !ok {
+			return ErrNodeNotFound
+		}
+		n.Message.Content += content
+		n.Status = status
+		return nil
+	})
+}
+
+// History returns a copy of the messages on the active branch
+func (c *ChatContext) History() []domain.ChatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path()
+	messages := make([]domain.ChatMessage, len(path))
+	for i, n := range path {
+		messages[i] = n.Message
+	}
+	return messages
+}
+
+// HistoryBefore returns messages from the start of the chat up to the node, excluding the node itself
+func (c *ChatContext) HistoryBefore(nodeID string) ([]domain.ChatMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.node(nodeID)
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+
+	path := c.ancestors(n)
+	messages := make([]domain.ChatMessage, 0, len(path))
+	for _, a := range path[:max(len(path)-1, 0)] {
+		messages = append(messages, a.Message)
+	}
+	return messages, nil
+}
+
+// ancestors returns the nodes from the start of the chat up to the node, including the node itself
+func (c *ChatContext) ancestors(n *ChatNode) []*ChatNode {
+	path := make([]*ChatNode, 0)
+	for n != c.root {
+		path = append(path, n)
+		n, _ = c.node(n.ParentID)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Summary returns the latest summary of the messages up to the node
+// and the number of messages from the start of the chat it covers
+func (c *ChatContext) Summary(nodeID string) (string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.node(nodeID)
+	if !ok {
+		return "", 0
+	}
+	path := c.ancestors(n)
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(path[i].Summary) > 0 {
+			return path[i].Summary, i + 1
+		}
+	}
+	return "", 0
+}
+
+// SetSummary stores the summary of the first covered messages on the way to the node
+func (c *ChatContext) SetSummary(nodeID string, covered int, summary string) error {
+	return c.change(func() error {
+		n, ok := c.node(nodeID)
+		if !ok {
+			return ErrNodeNotFound
+		}
+		path := c.ancestors(n)
+		if covered <= 0 || covered > len(path) {
+			return errors.New("summary does not match the chat history")
+		}
+		path[covered-1].Summary = summary
+		return nil
+	})
+}
+
+func (c *ChatContext) Node(id string) (ChatNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return ChatNode{}, false
+	}
+	return *n, true
+}
+
+// LastUserTurn returns the last user message on the active branch,
+// it is the message the assistant reply is regenerated for
+func (c *ChatContext) LastUserTurn() (ChatNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path()
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Message.Role == "user" {
+			return *path[i], nil
+		}
+	}
+	return ChatNode{}, ErrNoUserTurn
+}
+
+// LastAssistantTurn returns the assistant message at the end of the active branch,
+// it is the message the generation is continued for
+func (c *ChatContext) LastAssistantTurn() (ChatNode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path()
+	if len(path) == 0 || path[len(path)-1].Message.Role != "assistant" {
+		return ChatNode{}, ErrNothingToContinue
+	}
+	return *path[len(path)-1], nil
+}
+
+// Select makes the branch containing the node active.
+// Below the node the previously selected children are kept
+func (c *ChatContext) Select(nodeID string) error {
+	return c.change(func() error {
+		n, ok := c.nodes[nodeID]
+		if !ok {
+			return ErrNodeNotFound
+		}
+		c.selectAncestors(n)
+		return nil
+	})
+}
+
+func (c *ChatContext) selectAncestors(n *ChatNode) {
+	for n != c.root {
+		parent, _ := c.node(n.ParentID)
+		for i, id := range parent.Children {
+			if id == n.ID {
+				parent.Selected = i
+				break
+			}
+		}
+		n = parent
+	}
+}
+
+// Tree returns a snapshot of the whole chat tree
+func (c *ChatContext) Tree() ChatHistory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tree()
+}
+
+// tree is the snapshot of the chat tree, it is called with the lock held
+func (c *ChatContext) tree() ChatHistory {
+	h := ChatHistory{
+		ChatID: c.ID,
+		Nodes:  make([]ChatNode, 0, len(c.nodes)),
+		Path:   make([]string, 0),
+	}
+
+	// walk the tree from the root to keep conversation order
+	queue := append([]string{}, c.root.Children...)
+	for len(queue) > 0 {
+		n := c.nodes[queue[0]]
+		queue = append(queue[1:], n.Children...)
+
+		node := *n
+		node.Children = append([]string{}, n.Children...)
+		h.Nodes = append(h.Nodes, node)
+	}
+	for _, n := range c.path() {
+		h.Path = append(h.Path, n.ID)
+	}
+
+	return h
 }
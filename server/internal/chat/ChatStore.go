@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sweepInterval is how often the chats which are not used are evicted from memory
+const sweepInterval = time.Minute
+
+// ChatStore keeps chat contexts by chat ID. The chats are created by the store only,
+// so the clients cannot pick the IDs of the chats. The IDs are random and they are bearer secrets,
+// the chat is served to anyone who has its ID
+type ChatStore interface {
+	Create() *ChatContext
+	Get(id string) (*ChatContext, bool)
+	// Ping checks the store serves the requests
+	Ping(ctx context.Context) error
+}
+
+// MemoryChatStore keeps chat contexts in memory, they are lost on restart
+// and evicted if they are not used for the TTL
+type MemoryChatStore struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	chats map[string]*memoryChat
+	swept time.Time
+}
+
+type memoryChat struct {
+	chat *ChatContext
+	seen time.Time
+}
+
+func NewMemoryChatStore(ttl time.Duration) *MemoryChatStore {
+	return &MemoryChatStore{
+		ttl:   ttl,
+		chats: make(map[string]*memoryChat),
+		swept: time.Now(),
+	}
+}
+
+func (s *MemoryChatStore) Create() *ChatContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+
+	c := NewChatContext(uuid.New().String())
+	s.chats[c.ID] = &memoryChat{chat: c, seen: time.Now()}
+	return c
+}
+
+func (s *MemoryChatStore) Get(id string) (*ChatContext, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+
+	mc, ok := s.chats[id]
+	if !ok {
+		return nil, false
+	}
+	mc.seen = time.Now()
+	return mc.chat, true
+}
+
+// evict drops the chats which are not used for the TTL, it is called with the lock held
+func (s *MemoryChatStore) evict() {
+	now := time.Now()
+	if now.Sub(s.swept) < sweepInterval {
+		return
+	}
+	s.swept = now
+
+	for id, mc := range s.chats {
+		if now.Sub(mc.seen) > s.ttl {
+			delete(s.chats, id)
+		}
+	}
+}
+
+// Ping checks the store serves the requests, the memory store fails only if it is locked up
+func (s *MemoryChatStore) Ping(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("chat store is not responding")
+	}
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"sync"
+
+	"github.com/soulnvkz/mq/domain"
+)
+
+// Turn describes a completions request and where its messages are attached in the chat tree
+type Turn struct {
+	// ParentID is the node the new messages are attached to
+	ParentID string
+	// User is the new user message, nil when the reply is regenerated or continued
+	User *domain.ChatMessage
+	// ContinueID is the assistant message the generation is continued for
+	ContinueID string
+	// HistoryID is the last node of the history, the context summary is stored on the way to it
+	HistoryID string
+	History   []domain.ChatMessage
+	Content   string
+	// Prefill is the beginning of the reply, the worker streams only the continuation
+	Prefill string
+}
+
+// SaveTurn stores the reply of the turn in the chat with its status, partial replies
+// of cancelled and failed requests are saved as well. Returns ID of the assistant message
+func (c *ChatContext) SaveTurn(t Turn, reply string, status string) (string, error) {
+	if len(t.ContinueID) > 0 {
+		err := c.Extend(t.ContinueID, reply, status)
+		return t.ContinueID, err
+	}
+
+	messages := make([]domain.ChatMessage, 0, 2)
+	if t.User != nil {
+		messages = append(messages, *t.User)
+	}
+	messages = append(messages, domain.ChatMessage{
+		Role:    "assistant",
+		Content: reply,
+	})
+	ids, err := c.Append(t.ParentID, messages...)
+	if err != nil {
+		return "", err
+	}
+
+	id := ids[len(ids)-1]
+	return id, c.SetStatus(id, status)
+}
+
+// ChatStreams are the active streams of the chats on the server. Every chat can have only one stream
+// at a time, so the turns of the websocket and the rest clients are not attached to the same tree at once
+type ChatStreams struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func NewChatStreams() *ChatStreams {
+	return &ChatStreams{
+		active: make(map[string]bool),
+	}
+}
+
+// Start marks the stream of the chat active, the returned function ends it
+func (s *ChatStreams) Start(chatID string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[chatID] {
+		return nil, ErrStreamActive
+	}
+	s.active[chatID] = true
+
+	return func() {
+		s.mu.Lock()
+		delete(s.active, chatID)
+		s.mu.Unlock()
+	}, nil
+}
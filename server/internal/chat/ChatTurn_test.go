@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSaveTurn(t *testing.T) {
+	c := NewChatContext("test")
+	root, err := c.Append("", message("a"), message("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the edited user message and the partial reply are a new branch
+	user := message("c")
+	id, err := c.SaveTurn(Turn{ParentID: root[0], User: &user}, "d", StatusCancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(c); !slices.Equal(got, []string{"a", "c", "d"}) {
+		t.Fatalf("expected the edited branch, got %v", got)
+	}
+	if n, _ := c.Node(id); n.Status != StatusCancelled || n.Message.Role != "assistant" {
+		t.Fatalf("expected the cancelled reply, got %+v", n)
+	}
+
+	// the continued reply is extended in place
+	cid, err := c.SaveTurn(Turn{ParentID: root[0], ContinueID: id}, "e", StatusComplete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != id {
+		t.Fatalf("expected the continued reply %s, got %s", id, cid)
+	}
+	if got := contents(c); !slices.Equal(got, []string{"a", "c", "de"}) {
+		t.Fatalf("expected the continued reply, got %v", got)
+	}
+	if n, _ := c.Node(id); n.Status != StatusComplete {
+		t.Fatalf("expected the complete reply, got %s", n.Status)
+	}
+}
+
+func TestChatStreams(t *testing.T) {
+	s := NewChatStreams()
+
+	end, err := s.Start("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start("a"); !errors.Is(err, ErrStreamActive) {
+		t.Fatalf("expected ErrStreamActive, got %v", err)
+	}
+	// the streams of the other chats are not affected
+	endOther, err := s.Start("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endOther()
+
+	end()
+	if _, err := s.Start("a"); err != nil {
+		t.Fatalf("expected the stream to start after the previous one has ended, got %v", err)
+	}
+}
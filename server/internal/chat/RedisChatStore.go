@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/soulnvkz/log"
+)
+
+const (
+	// redisTimeout is how long the chat is loaded or saved
+	redisTimeout = 5 * time.Second
+	// redisRetries is how many times the change is applied again if the chat is changed meanwhile
+	redisRetries = 10
+)
+
+// RedisChatStore keeps chat contexts in Redis, the chats expire if they are not used for the TTL.
+//
+// The chat is loaded on every get, so the chat changed by any server is up to date. Every change
+// is applied to the latest tree in Redis and the tree is saved only if it is not changed meanwhile,
+// so the concurrent changes of the servers do not overwrite each other
+type RedisChatStore struct {
+	rdb    *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRedisChatStore(rdb *redis.Client, prefix string, ttl time.Duration) *RedisChatStore {
+	return &RedisChatStore{
+		rdb:    rdb,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+func (s *RedisChatStore) key(id string) string {
+	return s.prefix + ":chat:" + id
+}
+
+func (s *RedisChatStore) Create() *ChatContext {
+	c := NewChatContext(uuid.New().String())
+	c.update = s.update
+	if err := c.change(func() error { return nil }); err != nil {
+		log.Error().Printf("%s, failed to save chat %s", err, c.ID)
+	}
+	return c
+}
+
+func (s *RedisChatStore) Get(id string) (*ChatContext, bool) {
+	c, err := s.get(id)
+	if err != nil {
+		log.Error().Printf("%s, failed to load chat %s", err, id)
+		return nil, false
+	}
+	return c, c != nil
+}
+
+// get loads the chat and extends its TTL, it is nil if the chat does not exist
+func (s *RedisChatStore) get(id string) (*ChatContext, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := s.rdb.GetEx(ctx, s.key(id), s.ttl).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var h ChatHistory
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	c := restoreChatContext(h)
+	c.update = s.update
+	return c, nil
+}
+
+// update reloads the latest tree of the chat, applies the change and saves the tree
+// if the chat is not changed meanwhile, otherwise the change is applied again.
+// The chat keeps its tree if it has expired in Redis
+func (s *RedisChatStore) update(c *ChatContext, change func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := s.key(c.ID)
+	// own is the tree of the chat before the change, it is kept if the chat has expired
+	own := c.tree()
+	for range redisRetries {
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			h := own
+			data, err := tx.Get(ctx, key).Bytes()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if err == nil {
+				h = ChatHistory{}
+				if err := json.Unmarshal(data, &h); err != nil {
+					return err
+				}
+			}
+			c.restore(h)
+
+			if err := change(); err != nil {
+				return err
+			}
+
+			data, err = json.Marshal(c.tree())
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Set(ctx, key, data, s.ttl)
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errors.New("chat is changed concurrently, failed to save it")
+}
+
+func (s *RedisChatStore) Ping(ctx context.Context) error {
+	if err := s.rdb.Ping(ctx).Err(); err != nil {
+		return errors.Join(err, errors.New("chat store is not responding"))
+	}
+	return nil
+}
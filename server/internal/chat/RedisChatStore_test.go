@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/soulnvkz/mq/domain"
+)
+
+const testTTL = time.Hour
+
+// newTestRedisChatStores runs the stores of the servers on the same in-memory server
+func newTestRedisChatStores(t *testing.T, n int) ([]*RedisChatStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	stores := make([]*RedisChatStore, 0, n)
+	for range n {
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() {
+			rdb.Close()
+		})
+		stores = append(stores, NewRedisChatStore(rdb, "test", testTTL))
+	}
+	return stores, mr
+}
+
+func message(content string) domain.ChatMessage {
+	return domain.ChatMessage{Role: "user", Content: content}
+}
+
+func contents(c *ChatContext) []string {
+	history := c.History()
+	out := make([]string, 0, len(history))
+	for _, m := range history {
+		out = append(out, m.Content)
+	}
+	return out
+}
+
+func TestRedisChatStoreExpiry(t *testing.T) {
+	stores, mr := newTestRedisChatStores(t, 1)
+	s := stores[0]
+
+	c := s.Create()
+	if _, err := c.Append("", message("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chat which is used is kept
+	mr.FastForward(testTTL - time.Minute)
+	if _, ok := s.Get(c.ID); !ok {
+		t.Fatal("chat has expired before the TTL")
+	}
+	mr.FastForward(testTTL - time.Minute)
+	if _, ok := s.Get(c.ID); !ok {
+		t.Fatal("TTL of the chat is not extended by get")
+	}
+
+	mr.FastForward(testTTL + time.Minute)
+	if _, ok := s.Get(c.ID); ok {
+		t.Fatal("chat has not expired after the TTL")
+	}
+}
+
+func TestRedisChatStoreReload(t *testing.T) {
+	stores, _ := newTestRedisChatStores(t, 2)
+	first, second := stores[0], stores[1]
+
+	created := first.Create()
+	if _, err := created.Append("", message("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chat is changed by the other server
+	other, ok := second.Get(created.ID)
+	if !ok {
+		t.Fatal("chat is not found by the other server")
+	}
+	if _, err := other.Append(other.Leaf(), message("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := first.Get(created.ID)
+	if !ok {
+		t.Fatal("chat is not found")
+	}
+	if got := contents(c); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("expected the reloaded chat, got %v", got)
+	}
+
+	// the change of the stale chat is applied to the latest tree
+	if _, err := created.Append(other.Leaf(), message("c")); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = second.Get(created.ID)
+	if got := contents(c); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the change on top of the latest tree, got %v", got)
+	}
+}
+
+func TestRedisChatStoreConcurrentChanges(t *testing.T) {
+	stores, _ := newTestRedisChatStores(t, 2)
+
+	created := stores[0].Create()
+	root, err := created.Append("", message("root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, ok := s.Get(created.ID)
+			if !ok {
+				t.Error("chat is not found")
+				return
+			}
+			for j := range 5 {
+				if err := c.Extend(root[0], string(rune('0'+i*5+j)), StatusComplete); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c, _ := stores[1].Get(created.ID)
+	n, _ := c.Node(root[0])
+	if len(n.Message.Content) != len("root")+10 {
+		t.Fatalf("expected every change to be kept, got %q", n.Message.Content)
+	}
+}
@@ -3,9 +3,10 @@ package mq
 import (
 	"context"
 	"errors"
-	"sync"
+	"fmt"
+	"io"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/soulnvkz/log"
 	"github.com/soulnvkz/mq"
 	domain "github.com/soulnvkz/mq/domain"
@@ -14,6 +15,24 @@ import (
 const (
 	CancelExchangeKey = "llm_cancel_ex"
 	PubQueueKey       = "llm_q"
+
+	// NATSStreamKey is the JetStream stream of the requests and NATSPrefixKey is the prefix of the subjects,
+	// they are used if the transport is NATS
+	NATSStreamKey = "LLM_REQUESTS"
+	NATSPrefixKey = "llm"
+
+	// RedisPrefixKey is the prefix of the streams and the channels, it is used if the transport is Redis
+	RedisPrefixKey = "llm"
+
+	// CancellationTimeout is how long the cancelled request waits for the acknowledgement of the worker
+	CancellationTimeout = 30 * time.Second
+)
+
+var (
+	// ErrUnknownAdapter is returned if no alive worker has loaded the adapter of the request
+	ErrUnknownAdapter = errors.New("no worker has loaded the adapter")
+	// ErrNoWorkerQueue is returned if the request is not routed to any worker queue
+	ErrNoWorkerQueue = errors.New("no worker queue available")
 )
 
 type Consumer interface {
@@ -21,112 +40,130 @@ type Consumer interface {
 	OnNext(r domain.CompletionsResponse) error
 }
 
+// MQCompletions is shared by the server, the responses of all requests come to its reply queue
 type MQCompletions struct {
-	completionsChannel *amqp.Channel
-	publishChannel     *amqp.Channel
-}
+	replies   *replyDispatcher
+	transport mq.Transport
 
-func NewMQCompletions(pull, pub *mq.MQConnection) (*MQCompletions, error) {
-	completionsChannel, err := pull.Channel()
-	if err != nil {
-		return nil, errors.Join(err, errors.New("failed to create completions channel"))
-	}
-
-	publishChannel, err := pub.Channel()
-	if err != nil {
-		return nil, errors.Join(err, errors.New("failed to create publish channel"))
-	}
+	workers *Workers
+}
 
-	err = publishChannel.ExchangeDeclare(
-		CancelExchangeKey,
-		"fanout",
-		false,
-		true,
-		false,
-		false,
-		nil,
-	)
+func NewMQCompletions(transport mq.Transport, workers *Workers) (*MQCompletions, error) {
+	replies, err := newReplyDispatcher(transport)
 	if err != nil {
-		return nil, errors.Join(err, errors.New("failed to declare cancel request exchange"))
+		return nil, err
 	}
 
 	return &MQCompletions{
-		completionsChannel: completionsChannel,
-		publishChannel:     publishChannel,
+		replies:   replies,
+		transport: transport,
+
+		workers: workers,
 	}, nil
 }
 
 func (comp *MQCompletions) Close() {
-	comp.completionsChannel.Close()
-	comp.publishChannel.Close()
+	comp.replies.Close()
 }
 
-func (comp *MQCompletions) NewCompletionsQueue() (*mq.MQQueue, error) {
-	q, err := mq.NewMQueue(comp.completionsChannel, "")
-	if err != nil {
-		return nil, err
-	}
+// NewReplies registers the request, its responses are kept from now on until they are consumed
+func (comp *MQCompletions) NewReplies(requestID string) (*Replies, error) {
+	return comp.replies.register(requestID)
+}
 
-	return q, nil
+// Resume awaits the replies of the request started by any server, the responses after the index
+// are replayed by the worker of the request first. The index -1 resumes the stream from the beginning
+func (comp *MQCompletions) Resume(ctx context.Context, requestID string, index int) (*Replies, error) {
+	return comp.replies.resume(ctx, requestID, index)
 }
 
-func (comp *MQCompletions) ConsumeCompletions(ctx context.Context, q *mq.MQQueue, c Consumer) error {
-	deliveries, err := q.Consume()
-	if err != nil {
-		return err
+// ConsumeCompletions passes the responses to the consumer until the stream ends or the context is done,
+// the replies are released then
+func (comp *MQCompletions) ConsumeCompletions(ctx context.Context, r *Replies, c Consumer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.OnDone(); err != nil {
+				log.Error().Print(err)
+			}
+			go comp.awaitCancellation(r)
+			return nil
+		case <-r.notify:
+			for _, resp := range r.take() {
+				if err := c.OnNext(resp); err != nil {
+					// the stream is broken, so the request has to be cancelled
+					if !errors.Is(err, io.EOF) {
+						if err := c.OnDone(); err != nil {
+							log.Error().Print(err)
+						}
+						go comp.awaitCancellation(r)
+						return nil
+					}
+					comp.replies.release(r)
+					return nil
+				}
+			}
+		}
 	}
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-
-	go func() {
-	loop:
-		for {
-			select {
-			case <-ctx.Done():
-				if err := c.OnDone(); err != nil {
-					log.Error().Print(err)
-				}
-				break loop
-			case next := <-deliveries:
-				resp := &domain.CompletionsResponse{
-					RequestID: next.CorrelationId,
-				}
-				err := resp.UnMarshal(next.Body)
-				if err != nil {
-					log.Error().Printf("unsupported mq message")
-					continue loop
-				}
-				if err = c.OnNext(*resp); err != nil {
-					break loop
+// awaitCancellation waits for the worker to acknowledge the cancelled request, the rest of its stream is dropped
+func (comp *MQCompletions) awaitCancellation(r *Replies) {
+	defer comp.replies.release(r)
+
+	timeout := time.After(CancellationTimeout)
+	for {
+		select {
+		case <-timeout:
+			log.Info().Printf("cancellation is not acknowledged in %s", CancellationTimeout)
+			return
+		case <-r.notify:
+			for _, resp := range r.take() {
+				switch resp.ResType {
+				case domain.CompletionsCancelled:
+					log.Info().Printf("cancellation of %s is acknowledged", r.requestID)
+					return
+				case domain.CompletionsEnd, domain.CompletionsError:
+					log.Info().Printf("%s has finished before the cancellation", r.requestID)
+					return
 				}
 			}
 		}
-		wg.Done()
-	}()
+	}
+}
 
-	wg.Wait()
+// RequestCompletions publishes the request, the replies are released if it fails
+func (comp *MQCompletions) RequestCompletions(ctx context.Context, r *Replies, req domain.CompletionsRequest) (err error) {
+	defer func() {
+		if err != nil {
+			comp.replies.release(r)
+		}
+	}()
 
-	return nil
-}
+	// the requests with adapter go to the queue of the adapter,
+	// which is consumed only by the workers that have loaded it
+	key := PubQueueKey
+	if len(req.Adapter) > 0 {
+		if !comp.workers.HasAdapter(req.Adapter) {
+			return fmt.Errorf("%w %s", ErrUnknownAdapter, req.Adapter)
+		}
+		key = domain.AdapterQueue(PubQueueKey, req.Adapter)
+	}
 
-func (comp *MQCompletions) RequestCompletions(ctx context.Context, q *mq.MQQueue, req domain.CompletionsRequest) error {
 	buff, err := req.Marshal()
 	if err != nil {
 		return err
 	}
 
-	err = comp.publishChannel.PublishWithContext(ctx,
-		"",          // exchange
-		PubQueueKey, // routing key
-		false,       // mandatory
-		false,       // immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			CorrelationId: req.RequestID,
-			ReplyTo:       q.Name(),
-			Body:          []byte(buff),
-		})
+	// the request fails at once if no worker has declared the queue
+	err = comp.transport.PublishRequest(ctx, key, mq.Message{
+		ID:      req.RequestID,
+		Body:    []byte(buff),
+		ReplyTo: comp.replies.server,
+	})
+	if errors.Is(err, mq.ErrUnroutable) {
+		return fmt.Errorf("%w for %s", ErrNoWorkerQueue, key)
+	}
 	if err != nil {
 		return err
 	}
@@ -134,20 +171,22 @@ func (comp *MQCompletions) RequestCompletions(ctx context.Context, q *mq.MQQueue
 	return nil
 }
 
+// CancelRequest sends the cancellation to the worker which has started the request,
+// the cancellation of the request which is not started yet is broadcast to all workers,
+// as well as the one whose worker queue is gone
 func (comp *MQCompletions) CancelRequest(requestID string) error {
-	err := comp.publishChannel.Publish(
-		CancelExchangeKey, // exchange
-		"",                // routing key
-		false,             // mandatory
-		false,             // immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			CorrelationId: requestID,
-			Body:          []byte{},
-		})
-	if err != nil {
-		return err
+	msg := mq.Message{
+		ID:   requestID,
+		Body: []byte{},
 	}
 
-	return nil
+	if workerID, ok := comp.replies.worker(requestID); ok {
+		err := comp.transport.Cancel(context.Background(), workerID, msg)
+		if !errors.Is(err, mq.ErrUnroutable) {
+			return err
+		}
+		log.Info().Printf("worker %s is gone, cancellation of %s is broadcast", workerID, requestID)
+	}
+
+	return comp.transport.Cancel(context.Background(), "", msg)
 }
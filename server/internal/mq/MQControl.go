@@ -0,0 +1,35 @@
+package mq
+
+import (
+	"context"
+
+	"github.com/soulnvkz/mq"
+	domain "github.com/soulnvkz/mq/domain"
+)
+
+const (
+	ControlExchangeKey = "llm_control_ex"
+)
+
+// MQControl publishes the commands of the workers
+type MQControl struct {
+	transport mq.Transport
+}
+
+func NewMQControl(transport mq.Transport) *MQControl {
+	return &MQControl{
+		transport: transport,
+	}
+}
+
+// Send publishes the command to the workers, the workers check whether the command is addressed to them
+func (c *MQControl) Send(ctx context.Context, cmd domain.ControlCommand) error {
+	buff, err := cmd.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.transport.Broadcast(ctx, ControlExchangeKey, mq.Message{
+		Body: buff,
+	})
+}
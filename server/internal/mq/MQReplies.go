@@ -0,0 +1,312 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq"
+	domain "github.com/soulnvkz/mq/domain"
+)
+
+// ReplayTimeout is how long the resumed stream waits for its worker to replay the responses
+const ReplayTimeout = 5 * time.Second
+
+var (
+	// ErrRepliesExist is returned if the replies of the request are awaited already
+	ErrRepliesExist = errors.New("replies of the request are awaited already")
+	// ErrUnknownStream is returned if no worker has replayed the stream
+	ErrUnknownStream = errors.New("stream is not found")
+	// ErrStreamGap is returned if the replayed stream misses the responses right after the index
+	ErrStreamGap = errors.New("stream misses the responses after the index")
+	// ErrStreamFinished is returned if the stream has finished and the responses after the index are not left
+	ErrStreamFinished = errors.New("stream has finished")
+)
+
+// Replies are the responses to the request, they are routed from the reply queue of the server by the request ID.
+// The responses are kept until they are taken, so the slow stream does not hold the others
+type Replies struct {
+	requestID string
+
+	mu      sync.Mutex
+	pending []domain.CompletionsResponse
+	// last is the index of the last pending response, the responses up to it are dropped,
+	// so the resumed stream does not get the replayed responses twice
+	last int
+	// notify is signalled when the responses are pending
+	notify chan struct{}
+}
+
+func newReplies(requestID string, index int) *Replies {
+	return &Replies{
+		requestID: requestID,
+		last:      index,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+func (r *Replies) push(resp ...domain.CompletionsResponse) {
+	r.mu.Lock()
+	added := r.add(resp)
+	r.mu.Unlock()
+
+	if added {
+		r.signal()
+	}
+}
+
+// add appends the responses after the last one, it is called with the lock held
+func (r *Replies) add(resp []domain.CompletionsResponse) bool {
+	n := len(r.pending)
+	for _, x := range resp {
+		if x.Index > r.last {
+			r.pending = append(r.pending, x)
+			r.last = x.Index
+		}
+	}
+	return len(r.pending) > n
+}
+
+func (r *Replies) signal() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// replay puts the replayed responses after the index before the live ones which have come meanwhile,
+// the live responses which are replayed too are dropped
+func (r *Replies) replay(index int, replay domain.StreamReplay) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	live := r.pending
+	r.pending = nil
+	r.last = index
+	r.add(replay.Responses)
+	r.add(live)
+
+	if len(r.pending) > 0 && r.pending[0].Index > index+1 {
+		return ErrStreamGap
+	}
+	if len(r.pending) == 0 && replay.Finished {
+		return ErrStreamFinished
+	}
+	r.signal()
+	return nil
+}
+
+// take returns the pending responses in the order they have come
+func (r *Replies) take() []domain.CompletionsResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending := r.pending
+	r.pending = nil
+	return pending
+}
+
+// replyDispatcher consumes the reply queue of the server and routes the responses to the awaiting requests.
+// The stream started by the other server is resumed with the responses replayed by its worker to this server,
+// the worker sends the rest of the stream here then
+type replyDispatcher struct {
+	stop      context.CancelFunc
+	transport mq.Transport
+	// server is the name of the reply queue, the requests and the replay commands carry it
+	server string
+
+	mu      sync.Mutex
+	replies map[string][]*Replies
+	// workers have started the awaited requests, they are known from the start responses and the replays
+	workers map[string]string
+	// replays are the resumed requests awaiting the replay of their workers
+	replays map[string]chan domain.StreamReplay
+}
+
+func newReplyDispatcher(transport mq.Transport) (*replyDispatcher, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	// the queue lives as long as the server, the workers fail to reply when it is gone
+	server := uuid.New().String()
+	replies, err := transport.ConsumeReplies(ctx, server)
+	if err != nil {
+		stop()
+		return nil, errors.Join(err, errors.New("failed to consume replies"))
+	}
+
+	d := &replyDispatcher{
+		stop:      stop,
+		transport: transport,
+		server:    server,
+		replies:   make(map[string][]*Replies),
+		workers:   make(map[string]string),
+		replays:   make(map[string]chan domain.StreamReplay),
+	}
+	go d.dispatch(replies)
+
+	return d, nil
+}
+
+func (d *replyDispatcher) dispatch(replies <-chan mq.Message) {
+	for next := range replies {
+		resp := domain.CompletionsResponse{
+			RequestID: next.ID,
+		}
+		if err := resp.UnMarshal(next.Body); err != nil {
+			log.Error().Printf("unsupported mq message")
+			continue
+		}
+
+		if resp.ResType == domain.CompletionsReplay {
+			if resp.Replay == nil {
+				log.Error().Printf("stream replay of %s is empty", resp.RequestID)
+				continue
+			}
+			d.replayed(*resp.Replay)
+			continue
+		}
+		d.route(resp)
+	}
+	log.Info().Printf("replies are closed")
+}
+
+// route passes the response to the requests awaiting it on this server
+func (d *replyDispatcher) route(resp domain.CompletionsResponse) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	replies, ok := d.replies[resp.RequestID]
+	if !ok {
+		return
+	}
+	if resp.ResType == domain.CompletionsStart && len(resp.WorkerID) > 0 {
+		d.workers[resp.RequestID] = resp.WorkerID
+	}
+	for _, r := range replies {
+		r.push(resp)
+	}
+}
+
+// replayed passes the replay to the resumed request, the replay of the request
+// which is not resumed or is replayed already is dropped
+func (d *replyDispatcher) replayed(replay domain.StreamReplay) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch, ok := d.replays[replay.RequestID]
+	if !ok {
+		return
+	}
+	select {
+	case ch <- replay:
+	default:
+	}
+}
+
+func (d *replyDispatcher) register(requestID string) (*Replies, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.replies[requestID]) > 0 {
+		return nil, ErrRepliesExist
+	}
+	r := newReplies(requestID, -1)
+	d.replies[requestID] = []*Replies{r}
+	return r, nil
+}
+
+// resume awaits the live responses of the request and asks the workers to replay the responses after the index,
+// the worker of the request replays them to this server and sends the rest of the stream here.
+// The index -1 resumes the stream from the beginning
+func (d *replyDispatcher) resume(ctx context.Context, requestID string, index int) (*Replies, error) {
+	d.mu.Lock()
+	if _, ok := d.replays[requestID]; ok {
+		d.mu.Unlock()
+		return nil, ErrRepliesExist
+	}
+	r := newReplies(requestID, index)
+	d.replies[requestID] = append(d.replies[requestID], r)
+	replayed := make(chan domain.StreamReplay, 1)
+	d.replays[requestID] = replayed
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.replays, requestID)
+		d.mu.Unlock()
+	}()
+
+	replay, err := d.awaitReplay(ctx, requestID, index, replayed)
+	if err == nil {
+		err = r.replay(index, replay)
+	}
+	if err != nil {
+		d.release(r)
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.workers[requestID] = replay.WorkerID
+	d.mu.Unlock()
+
+	return r, nil
+}
+
+// awaitReplay sends the replay command to the workers and waits for the worker of the request
+func (d *replyDispatcher) awaitReplay(ctx context.Context, requestID string, index int, replayed <-chan domain.StreamReplay) (domain.StreamReplay, error) {
+	buff, err := domain.ControlCommand{
+		Command:   domain.CommandReplayStream,
+		RequestID: requestID,
+		Index:     index,
+		ReplyTo:   d.server,
+	}.Marshal()
+	if err != nil {
+		return domain.StreamReplay{}, err
+	}
+	if err := d.transport.Broadcast(ctx, ControlExchangeKey, mq.Message{Body: buff}); err != nil {
+		return domain.StreamReplay{}, err
+	}
+
+	timeout := time.NewTimer(ReplayTimeout)
+	defer timeout.Stop()
+
+	select {
+	case replay := <-replayed:
+		return replay, nil
+	case <-timeout.C:
+		return domain.StreamReplay{}, ErrUnknownStream
+	case <-ctx.Done():
+		return domain.StreamReplay{}, ctx.Err()
+	}
+}
+
+// worker returns the worker which has started the awaited request
+func (d *replyDispatcher) worker(requestID string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	workerID, ok := d.workers[requestID]
+	return workerID, ok
+}
+
+func (d *replyDispatcher) release(r *Replies) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	replies := slices.DeleteFunc(d.replies[r.requestID], func(x *Replies) bool {
+		return x == r
+	})
+	if len(replies) == 0 {
+		delete(d.replies, r.requestID)
+		delete(d.workers, r.requestID)
+		return
+	}
+	d.replies[r.requestID] = replies
+}
+
+func (d *replyDispatcher) Close() {
+	d.stop()
+}
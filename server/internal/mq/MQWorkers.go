@@ -0,0 +1,128 @@
+package mq
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq"
+	domain "github.com/soulnvkz/mq/domain"
+)
+
+const (
+	WorkersExchangeKey = "llm_workers_ex"
+
+	// WorkerTTL is how long the worker is alive after its last advert
+	WorkerTTL = 30 * time.Second
+)
+
+// Worker is the last advert of the worker
+type Worker struct {
+	domain.WorkerAdvert
+	SeenAt time.Time `json:"seen_at"`
+}
+
+// Workers keeps the workers which have advertised themselves recently
+type Workers struct {
+	transport mq.Transport
+
+	mu      sync.RWMutex
+	workers map[string]Worker
+}
+
+func NewWorkers(transport mq.Transport) *Workers {
+	return &Workers{
+		transport: transport,
+		workers:   make(map[string]Worker),
+	}
+}
+
+// Consume reads the adverts until the context is done
+func (ws *Workers) Consume(ctx context.Context) error {
+	deliveries, err := ws.transport.Subscribe(ctx, WorkersExchangeKey)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case next, ok := <-deliveries:
+				if !ok {
+					return
+				}
+				advert := domain.WorkerAdvert{}
+				if err := advert.UnMarshal(next.Body); err != nil {
+					log.Error().Printf("unsupported worker advert")
+					continue
+				}
+				ws.seen(advert)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ws *Workers) seen(advert domain.WorkerAdvert) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, ok := ws.workers[advert.WorkerID]; !ok {
+		log.Info().Printf("worker %s joined, model %s, adapters %v", advert.WorkerID, advert.Model, advert.Adapters)
+	}
+	ws.workers[advert.WorkerID] = Worker{
+		WorkerAdvert: advert,
+		SeenAt:       time.Now(),
+	}
+}
+
+// List returns the alive workers, the expired ones are removed
+func (ws *Workers) List() []Worker {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	workers := make([]Worker, 0, len(ws.workers))
+	for id, w := range ws.workers {
+		if time.Since(w.SeenAt) > WorkerTTL {
+			log.Info().Printf("worker %s is gone", id)
+			delete(ws.workers, id)
+			continue
+		}
+		workers = append(workers, w)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].WorkerID < workers[j].WorkerID
+	})
+
+	return workers
+}
+
+// HasAdapter checks that some alive worker has loaded the adapter
+func (ws *Workers) HasAdapter(adapter string) bool {
+	for _, w := range ws.List() {
+		if slices.Contains(w.Adapters, adapter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adapters are the adapters of all alive workers
+func (ws *Workers) Adapters() []string {
+	adapters := make([]string, 0)
+	for _, w := range ws.List() {
+		for _, a := range w.Adapters {
+			if !slices.Contains(adapters, a) {
+				adapters = append(adapters, a)
+			}
+		}
+	}
+	sort.Strings(adapters)
+	return adapters
+}
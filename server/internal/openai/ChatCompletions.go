@@ -0,0 +1,462 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq/domain"
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+const DefaultModel = "llmq"
+
+type Handler struct {
+	mqcompletions *mqc.MQCompletions
+}
+
+func NewHandler(mqcomp *mqc.MQCompletions) *Handler {
+	return &Handler{
+		mqcompletions: mqcomp,
+	}
+}
+
+// Register adds OpenAI compatible routes to the router
+func (h *Handler) Register(router *http.ServeMux) {
+	router.HandleFunc("POST /v1/chat/completions", h.chatCompletions)
+	router.HandleFunc("POST /v1/completions", h.completions)
+}
+
+// completionsRequest converts OpenAI request to the worker request.
+// The last message is the user message to reply to or the assistant message to continue
+func completionsRequest(r ChatCompletionsRequest) (domain.CompletionsRequest, error) {
+	if len(r.Messages) == 0 {
+		return domain.CompletionsRequest{}, errors.New("messages are required")
+	}
+
+	req := domain.CompletionsRequest{
+		RequestID:    uuid.New().String(),
+		ChatMessages: make([]domain.ChatMessage, 0, len(r.Messages)),
+		Grammar:      r.Grammar,
+		Adapter:      r.Adapter,
+		AdapterScale: r.AdapterScale,
+	}
+
+	for _, m := range r.Messages[:len(r.Messages)-1] {
+		req.ChatMessages = append(req.ChatMessages, chatMessage(m))
+	}
+
+	last := r.Messages[len(r.Messages)-1]
+	switch last.Role {
+	case "user":
+		req.Content = last.Content
+	case "assistant":
+		m := chatMessage(last)
+		m.Incomplete = true
+		req.ChatMessages = append(req.ChatMessages, m)
+	case "tool":
+		req.ChatMessages = append(req.ChatMessages, chatMessage(last))
+	default:
+		return domain.CompletionsRequest{}, fmt.Errorf("last message should be user, assistant or tool message, got %q", last.Role)
+	}
+
+	if len(r.Tools) > 0 {
+		choice, err := toolChoice(r.ToolChoice)
+		if err != nil {
+			return domain.CompletionsRequest{}, err
+		}
+		req.Tools = r.Tools
+		req.ToolChoice = choice
+	}
+
+	if r.TopLogprobs != nil {
+		if !r.Logprobs {
+			return domain.CompletionsRequest{}, errors.New("logprobs should be enabled to use top_logprobs")
+		}
+		if *r.TopLogprobs < 0 || *r.TopLogprobs > domain.MaxTopLogprobs {
+			return domain.CompletionsRequest{}, fmt.Errorf("top_logprobs should be between 0 and %d", domain.MaxTopLogprobs)
+		}
+		req.TopLogprobs = *r.TopLogprobs
+	}
+	req.Logprobs = r.Logprobs
+
+	if f := r.ResponseFormat; f != nil {
+		switch f.Type {
+		case "", ResponseFormatText:
+		case ResponseFormatJSONObject:
+			req.JSONSchema = json.RawMessage(`{"type":"object"}`)
+		case ResponseFormatJSONSchema:
+			if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+				return domain.CompletionsRequest{}, errors.New("json_schema is required for json_schema response format")
+			}
+			req.JSONSchema = f.JSONSchema.Schema
+		default:
+			return domain.CompletionsRequest{}, fmt.Errorf("unsupported response format %q", f.Type)
+		}
+		if len(req.JSONSchema) > 0 && len(req.Grammar) > 0 {
+			return domain.CompletionsRequest{}, errors.New("grammar can't be used with json response format")
+		}
+	}
+
+	return req, nil
+}
+
+func chatMessage(m ChatMessage) domain.ChatMessage {
+	cm := domain.ChatMessage{
+		Role:       m.Role,
+		Content:    m.Content,
+		ToolCallID: m.ToolCallID,
+		Name:       m.Name,
+	}
+	for _, c := range m.ToolCalls {
+		cm.ToolCalls = append(cm.ToolCalls, domain.ToolCall{
+			ID:       c.ID,
+			Type:     c.Type,
+			Function: c.Function,
+		})
+	}
+	return cm
+}
+
+func toolCalls(calls []domain.ToolCall, indexed bool) []ToolCall {
+	result := make([]ToolCall, 0, len(calls))
+	for i, c := range calls {
+		tc := ToolCall{
+			ID:       c.ID,
+			Type:     c.Type,
+			Function: c.Function,
+		}
+		if indexed {
+			tc.Index = &i
+		}
+		result = append(result, tc)
+	}
+	return result
+}
+
+// toolChoice validates the string and the object form of tool_choice,
+// forcing the call of the named function is not supported by the workers
+func toolChoice(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return domain.ToolChoiceAuto, nil
+	}
+
+	var choice string
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		var named struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		if err := json.Unmarshal(raw, &named); err != nil || named.Type != "function" || len(named.Function.Name) == 0 {
+			return "", errors.New(`tool_choice should be a string or {"type":"function","function":{"name":...}}`)
+		}
+		return "", fmt.Errorf("tool_choice of function %q is not supported, only auto and none tool choices are supported", named.Function.Name)
+	}
+	switch choice {
+	case domain.ToolChoiceAuto, domain.ToolChoiceNone:
+		return choice, nil
+	default:
+		return "", fmt.Errorf("unsupported tool choice %q, only auto and none tool choices are supported", choice)
+	}
+}
+
+func tokenBytes(token string) []int {
+	b := make([]int, 0, len(token))
+	for _, c := range []byte(token) {
+		b = append(b, int(c))
+	}
+	return b
+}
+
+func logprobs(lp []domain.TokenLogprob) []TokenLogprob {
+	result := make([]TokenLogprob, 0, len(lp))
+	for _, t := range lp {
+		top := make([]TopLogprob, 0, len(t.TopLogprobs))
+		for _, a := range t.TopLogprobs {
+			top = append(top, TopLogprob{
+				Token:   a.Token,
+				Logprob: a.Logprob,
+				Bytes:   tokenBytes(a.Token),
+			})
+		}
+		result = append(result, TokenLogprob{
+			Token:       t.Token,
+			Logprob:     t.Logprob,
+			Bytes:       tokenBytes(t.Token),
+			TopLogprobs: top,
+		})
+	}
+	return result
+}
+
+func finishReason(calls []domain.ToolCall) *string {
+	reason := "stop"
+	if len(calls) > 0 {
+		reason = "tool_calls"
+	}
+	return &reason
+}
+
+func (h *Handler) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	var body ChatCompletionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	req, err := completionsRequest(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	model := body.Model
+	if len(model) == 0 {
+		model = DefaultModel
+	}
+
+	var consumer completionsConsumer
+	if body.Stream {
+		s, err := newStreamConsumer(w, req.RequestID, model, req.Logprobs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "server_error", err)
+			return
+		}
+		consumer = s
+	} else {
+		consumer = newResponseConsumer(req.RequestID, model, req.Logprobs)
+	}
+
+	h.complete(w, r, req, consumer)
+}
+
+// complete sends the request to the workers and passes the reply to the consumer
+func (h *Handler) complete(w http.ResponseWriter, r *http.Request, req domain.CompletionsRequest, consumer completionsConsumer) {
+	q, err := h.mqcompletions.NewReplies(req.RequestID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	if err := h.mqcompletions.RequestCompletions(r.Context(), q, req); err != nil {
+		if errors.Is(err, mqc.ErrUnknownAdapter) {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", err)
+			return
+		}
+		if errors.Is(err, mqc.ErrNoWorkerQueue) {
+			writeError(w, http.StatusServiceUnavailable, "server_error", err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	err = h.mqcompletions.ConsumeCompletions(r.Context(), q, &requestConsumer{
+		requestID:     req.RequestID,
+		mqcompletions: h.mqcompletions,
+		consumer:      consumer,
+	})
+	if err != nil {
+		log.Error().Printf("failed to start consume, %s", err)
+		writeError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	consumer.finish(w)
+}
+
+// completionsConsumer receives the generated content of the request
+type completionsConsumer interface {
+	start() error
+	next(r domain.CompletionsResponse) error
+	end(r domain.CompletionsResponse)
+	fail(err error)
+	// finish writes the response when the stream is over
+	finish(w http.ResponseWriter)
+}
+
+// requestConsumer adapts completionsConsumer to the completions queue consumer
+type requestConsumer struct {
+	requestID     string
+	mqcompletions *mqc.MQCompletions
+	consumer      completionsConsumer
+}
+
+func (c *requestConsumer) OnDone() error {
+	log.Info().Printf("http client has gone, cancel %s", c.requestID)
+	c.consumer.fail(errors.New("request is cancelled"))
+	return c.mqcompletions.CancelRequest(c.requestID)
+}
+
+func (c *requestConsumer) OnNext(r domain.CompletionsResponse) error {
+	switch r.ResType {
+	case domain.CompletionsStart:
+		return c.consumer.start()
+	case domain.CompletionsNext:
+		return c.consumer.next(r)
+	case domain.CompletionsEnd:
+		c.consumer.end(r)
+		return io.EOF
+	case domain.CompletionsError:
+		c.consumer.fail(errors.New(r.Content))
+		return io.EOF
+	case domain.CompletionsCancelled:
+		c.consumer.fail(errors.New("request is cancelled"))
+		return io.EOF
+	}
+	return nil
+}
+
+// responseConsumer collects the whole reply and writes it as a single response
+type responseConsumer struct {
+	id        string
+	model     string
+	created   int64
+	content   []byte
+	logprobs  *Logprobs
+	toolCalls []domain.ToolCall
+	err       error
+}
+
+func newResponseConsumer(requestID, model string, withLogprobs bool) *responseConsumer {
+	c := &responseConsumer{
+		id:      "chatcmpl-" + requestID,
+		model:   model,
+		created: time.Now().Unix(),
+		content: make([]byte, 0, 1024),
+	}
+	if withLogprobs {
+		c.logprobs = &Logprobs{Content: make([]TokenLogprob, 0, 256)}
+	}
+	return c
+}
+
+func (c *responseConsumer) start() error {
+	return nil
+}
+
+func (c *responseConsumer) next(r domain.CompletionsResponse) error {
+	c.content = append(c.content, r.Content...)
+	if c.logprobs != nil {
+		c.logprobs.Content = append(c.logprobs.Content, logprobs(r.Logprobs)...)
+	}
+	return nil
+}
+
+func (c *responseConsumer) end(r domain.CompletionsResponse) {
+	c.toolCalls = r.ToolCalls
+}
+
+func (c *responseConsumer) fail(err error) {
+	c.err = err
+}
+
+func (c *responseConsumer) finish(w http.ResponseWriter) {
+	if c.err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", c.err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ChatCompletionsResponse{
+		ID:      c.id,
+		Object:  "chat.completion",
+		Created: c.created,
+		Model:   c.model,
+		Choices: []ChatCompletionsChoice{{
+			Message: &ChatMessage{
+				Role:      "assistant",
+				Content:   string(c.content),
+				ToolCalls: toolCalls(c.toolCalls, false),
+			},
+			Logprobs:     c.logprobs,
+			FinishReason: finishReason(c.toolCalls),
+		}},
+	})
+}
+
+// streamConsumer writes the reply as server-sent events
+type streamConsumer struct {
+	eventStream
+
+	id           string
+	model        string
+	created      int64
+	withLogprobs bool
+	toolCalls    []domain.ToolCall
+	err          error
+}
+
+func newStreamConsumer(w http.ResponseWriter, requestID, model string, withLogprobs bool) (*streamConsumer, error) {
+	events, err := newEventStream(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamConsumer{
+		eventStream:  events,
+		id:           "chatcmpl-" + requestID,
+		model:        model,
+		created:      time.Now().Unix(),
+		withLogprobs: withLogprobs,
+	}, nil
+}
+
+func (c *streamConsumer) chunk(delta ChatMessage, lp *Logprobs, finishReason *string) ChatCompletionsResponse {
+	return ChatCompletionsResponse{
+		ID:      c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: []ChatCompletionsChoice{{
+			Delta:        &delta,
+			Logprobs:     lp,
+			FinishReason: finishReason,
+		}},
+	}
+}
+
+func (c *streamConsumer) start() error {
+	c.open()
+	return c.write(c.chunk(ChatMessage{Role: "assistant"}, nil, nil))
+}
+
+func (c *streamConsumer) next(r domain.CompletionsResponse) error {
+	var lp *Logprobs
+	if c.withLogprobs {
+		lp = &Logprobs{Content: logprobs(r.Logprobs)}
+	}
+	return c.write(c.chunk(ChatMessage{Content: r.Content}, lp, nil))
+}
+
+func (c *streamConsumer) end(r domain.CompletionsResponse) {
+	c.toolCalls = r.ToolCalls
+}
+
+func (c *streamConsumer) fail(err error) {
+	c.err = err
+}
+
+func (c *streamConsumer) finish(w http.ResponseWriter) {
+	if c.err != nil {
+		c.writeError(w, c.err)
+		return
+	}
+
+	if len(c.toolCalls) > 0 {
+		err := c.write(c.chunk(ChatMessage{ToolCalls: toolCalls(c.toolCalls, true)}, nil, nil))
+		if err != nil {
+			return
+		}
+	}
+	if err := c.write(c.chunk(ChatMessage{}, nil, finishReason(c.toolCalls))); err != nil {
+		return
+	}
+	c.done()
+}
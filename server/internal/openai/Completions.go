@@ -0,0 +1,260 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// promptText accepts the prompt as a string or an array with a single string
+func promptText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("prompt is required")
+	}
+
+	var prompt string
+	if err := json.Unmarshal(raw, &prompt); err == nil {
+		return prompt, nil
+	}
+
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil {
+		return "", errors.New("prompt should be a string or an array of strings")
+	}
+	if len(prompts) != 1 {
+		return "", errors.New("only a single prompt is supported")
+	}
+	return prompts[0], nil
+}
+
+// rawCompletionsRequest converts legacy completions request to the worker request with raw prompt
+func rawCompletionsRequest(r CompletionsRequest) (domain.CompletionsRequest, error) {
+	prompt, err := promptText(r.Prompt)
+	if err != nil {
+		return domain.CompletionsRequest{}, err
+	}
+	if len(prompt) == 0 {
+		return domain.CompletionsRequest{}, errors.New("prompt is required")
+	}
+
+	req := domain.CompletionsRequest{
+		RequestID:    uuid.New().String(),
+		Prompt:       prompt,
+		Grammar:      r.Grammar,
+		Adapter:      r.Adapter,
+		AdapterScale: r.AdapterScale,
+	}
+
+	if r.Logprobs != nil {
+		if *r.Logprobs < 0 || *r.Logprobs > domain.MaxTopLogprobs {
+			return domain.CompletionsRequest{}, fmt.Errorf("logprobs should be between 0 and %d", domain.MaxTopLogprobs)
+		}
+		req.Logprobs = true
+		req.TopLogprobs = *r.Logprobs
+	}
+
+	return req, nil
+}
+
+func (h *Handler) completions(w http.ResponseWriter, r *http.Request) {
+	var body CompletionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	req, err := rawCompletionsRequest(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	model := body.Model
+	if len(model) == 0 {
+		model = DefaultModel
+	}
+
+	text := newTextCompletions(req.RequestID, model, req.Logprobs)
+	if body.Echo {
+		// log-probabilities of the prompt tokens are not computed, so the prompt is echoed as text only
+		text.offset = len(req.Prompt)
+	}
+
+	var consumer completionsConsumer
+	if body.Stream {
+		s, err := newTextStreamConsumer(w, text)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "server_error", err)
+			return
+		}
+		if body.Echo {
+			s.echo = req.Prompt
+		}
+		consumer = s
+	} else {
+		c := &textResponseConsumer{textCompletions: text}
+		if body.Echo {
+			c.text = append(c.text, req.Prompt...)
+		}
+		consumer = c
+	}
+
+	h.complete(w, r, req, consumer)
+}
+
+// textCompletions builds legacy completions responses
+type textCompletions struct {
+	id           string
+	model        string
+	created      int64
+	withLogprobs bool
+	// offset is the position of the next token in the text
+	offset int
+	err    error
+}
+
+func newTextCompletions(requestID, model string, withLogprobs bool) textCompletions {
+	return textCompletions{
+		id:           "cmpl-" + requestID,
+		model:        model,
+		created:      time.Now().Unix(),
+		withLogprobs: withLogprobs,
+	}
+}
+
+// logprobs converts the token log-probabilities and moves the text offset
+func (c *textCompletions) logprobs(lp []domain.TokenLogprob) *CompletionsLogprobs {
+	result := &CompletionsLogprobs{
+		Tokens:        make([]string, 0, len(lp)),
+		TokenLogprobs: make([]float32, 0, len(lp)),
+		TopLogprobs:   make([]map[string]float32, 0, len(lp)),
+		TextOffset:    make([]int, 0, len(lp)),
+	}
+	for _, t := range lp {
+		top := make(map[string]float32, len(t.TopLogprobs))
+		for _, a := range t.TopLogprobs {
+			top[a.Token] = a.Logprob
+		}
+		result.Tokens = append(result.Tokens, t.Token)
+		result.TokenLogprobs = append(result.TokenLogprobs, t.Logprob)
+		result.TopLogprobs = append(result.TopLogprobs, top)
+		result.TextOffset = append(result.TextOffset, c.offset)
+		c.offset += len(t.Token)
+	}
+	return result
+}
+
+func (c *textCompletions) response(text string, lp *CompletionsLogprobs, finishReason *string) CompletionsResponse {
+	return CompletionsResponse{
+		ID:      c.id,
+		Object:  "text_completion",
+		Created: c.created,
+		Model:   c.model,
+		Choices: []CompletionsChoice{{
+			Text:         text,
+			Logprobs:     lp,
+			FinishReason: finishReason,
+		}},
+	}
+}
+
+func (c *textCompletions) end(r domain.CompletionsResponse) {}
+
+func (c *textCompletions) fail(err error) {
+	c.err = err
+}
+
+// textResponseConsumer collects the whole text and writes it as a single response
+type textResponseConsumer struct {
+	textCompletions
+	text     []byte
+	logprobs *CompletionsLogprobs
+}
+
+func (c *textResponseConsumer) start() error {
+	return nil
+}
+
+func (c *textResponseConsumer) next(r domain.CompletionsResponse) error {
+	c.text = append(c.text, r.Content...)
+	if !c.withLogprobs {
+		return nil
+	}
+
+	lp := c.textCompletions.logprobs(r.Logprobs)
+	if c.logprobs == nil {
+		c.logprobs = lp
+		return nil
+	}
+	c.logprobs.Tokens = append(c.logprobs.Tokens, lp.Tokens...)
+	c.logprobs.TokenLogprobs = append(c.logprobs.TokenLogprobs, lp.TokenLogprobs...)
+	c.logprobs.TopLogprobs = append(c.logprobs.TopLogprobs, lp.TopLogprobs...)
+	c.logprobs.TextOffset = append(c.logprobs.TextOffset, lp.TextOffset...)
+	return nil
+}
+
+func (c *textResponseConsumer) finish(w http.ResponseWriter) {
+	if c.err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", c.err)
+		return
+	}
+
+	lp := c.logprobs
+	if c.withLogprobs && lp == nil {
+		lp = c.textCompletions.logprobs(nil)
+	}
+	writeJSON(w, http.StatusOK, c.response(string(c.text), lp, finishReason(nil)))
+}
+
+// textStreamConsumer writes the text as server-sent events
+type textStreamConsumer struct {
+	eventStream
+	textCompletions
+	// echo is the prompt sent with the first event
+	echo string
+}
+
+func newTextStreamConsumer(w http.ResponseWriter, text textCompletions) (*textStreamConsumer, error) {
+	events, err := newEventStream(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &textStreamConsumer{
+		eventStream:     events,
+		textCompletions: text,
+	}, nil
+}
+
+func (c *textStreamConsumer) start() error {
+	c.open()
+	if len(c.echo) == 0 {
+		return nil
+	}
+	return c.write(c.response(c.echo, nil, nil))
+}
+
+func (c *textStreamConsumer) next(r domain.CompletionsResponse) error {
+	var lp *CompletionsLogprobs
+	if c.withLogprobs {
+		lp = c.textCompletions.logprobs(r.Logprobs)
+	}
+	return c.write(c.response(r.Content, lp, nil))
+}
+
+func (c *textStreamConsumer) finish(w http.ResponseWriter) {
+	if c.err != nil {
+		c.writeError(w, c.err)
+		return
+	}
+
+	if err := c.write(c.response("", nil, finishReason(nil))); err != nil {
+		return
+	}
+	c.done()
+}
@@ -0,0 +1,214 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// types of OpenAI compatible API, only the fields supported by the workers are declared
+
+type ChatMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+}
+
+type ToolCall struct {
+	// Index is set in stream chunks only
+	Index    *int                `json:"index,omitempty"`
+	ID       string              `json:"id"`
+	Type     string              `json:"type"`
+	Function domain.FunctionCall `json:"function"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type ChatCompletionsRequest struct {
+	Model          string          `json:"model"`
+	Messages       []ChatMessage   `json:"messages"`
+	Stream         bool            `json:"stream,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Tools          []domain.Tool   `json:"tools,omitempty"`
+	// ToolChoice is either string or object with the function name, only auto and none are supported,
+	// the object form is rejected with the name of the function
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+	// Grammar is GBNF grammar the output has to match, it is not a part of OpenAI API
+	Grammar     string `json:"grammar,omitempty"`
+	Logprobs    bool   `json:"logprobs,omitempty"`
+	TopLogprobs *int   `json:"top_logprobs,omitempty"`
+	// Adapter is LoRA adapter of the workers, it is not a part of OpenAI API
+	Adapter      string  `json:"adapter,omitempty"`
+	AdapterScale float32 `json:"adapter_scale,omitempty"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float32 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float32      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type ChatCompletionsChoice struct {
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+	Logprobs     *Logprobs    `json:"logprobs"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type ChatCompletionsResponse struct {
+	ID      string                  `json:"id"`
+	Object  string                  `json:"object"`
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []ChatCompletionsChoice `json:"choices"`
+}
+
+// CompletionsRequest is the legacy completions request, the prompt is used without the chat template
+type CompletionsRequest struct {
+	Model string `json:"model"`
+	// Prompt is a string or an array with a single string
+	Prompt json.RawMessage `json:"prompt"`
+	Stream bool            `json:"stream,omitempty"`
+	// Echo adds the prompt to the beginning of the text
+	Echo bool `json:"echo,omitempty"`
+	// Logprobs is the number of the most likely alternatives of every token
+	Logprobs     *int    `json:"logprobs,omitempty"`
+	Grammar      string  `json:"grammar,omitempty"`
+	Adapter      string  `json:"adapter,omitempty"`
+	AdapterScale float32 `json:"adapter_scale,omitempty"`
+}
+
+type CompletionsLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float32            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float32 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+type CompletionsChoice struct {
+	Index        int                  `json:"index"`
+	Text         string               `json:"text"`
+	Logprobs     *CompletionsLogprobs `json:"logprobs"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type CompletionsResponse struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []CompletionsChoice `json:"choices"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, errType string, err error) {
+	writeJSON(w, status, ErrorResponse{
+		Error: Error{
+			Message: err.Error(),
+			Type:    errType,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Printf("failed to write response, %s", err)
+	}
+}
+
+// eventStream writes the response as server-sent events
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func newEventStream(w http.ResponseWriter) (eventStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return eventStream{}, errors.New("streaming is not supported")
+	}
+	return eventStream{
+		w:       w,
+		flusher: flusher,
+	}, nil
+}
+
+func (s *eventStream) open() {
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+}
+
+func (s *eventStream) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// writeError sends the error as an event if the stream is started already
+func (s *eventStream) writeError(w http.ResponseWriter, err error) {
+	if !s.started {
+		writeError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+	s.write(ErrorResponse{Error: Error{Message: err.Error(), Type: "server_error"}})
+}
+
+func (s *eventStream) done() {
+	fmt.Fprint(s.w, "data: [DONE]\n\n")
+	s.flusher.Flush()
+}
@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/soulnvkz/log"
+	domain "github.com/soulnvkz/mq/domain"
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+// SwapModelRequest replaces the model of the worker, or of all workers if WorkerID is empty.
+// The draft model and the adapters are not loaded if they are not set
+type SwapModelRequest struct {
+	WorkerID     string `json:"worker_id,omitempty"`
+	Model        string `json:"model"`
+	DraftModel   string `json:"draft_model,omitempty"`
+	LoraAdapters string `json:"lora_adapters,omitempty"`
+}
+
+// AdminHandler controls the workers, every request has to have the admin token
+type AdminHandler struct {
+	token   string
+	control *mqc.MQControl
+	workers *mqc.Workers
+}
+
+func NewAdminHandler(token string, control *mqc.MQControl, workers *mqc.Workers) *AdminHandler {
+	return &AdminHandler{
+		token:   token,
+		control: control,
+		workers: workers,
+	}
+}
+
+// Register adds admin routes to the router
+func (h *AdminHandler) Register(router *http.ServeMux) {
+	router.Handle("POST /admin/workers/swap-model", h.authorized(h.swapModel))
+}
+
+func (h *AdminHandler) authorized(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte("Bearer " + h.token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("admin token is required"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// swapModel sends the swap command, the workers finish the current request and load the model.
+// The result is reported by the worker adverts, the failed worker rolls back to the previous model
+func (h *AdminHandler) swapModel(w http.ResponseWriter, r *http.Request) {
+	var body SwapModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(body.Model) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("model is required"))
+		return
+	}
+
+	if len(body.WorkerID) > 0 {
+		alive := slices.ContainsFunc(h.workers.List(), func(w mqc.Worker) bool {
+			return w.WorkerID == body.WorkerID
+		})
+		if !alive {
+			writeError(w, http.StatusNotFound, errors.New("worker not found"))
+			return
+		}
+	}
+
+	cmd := domain.ControlCommand{
+		Command:      domain.CommandSwapModel,
+		WorkerID:     body.WorkerID,
+		Model:        body.Model,
+		DraftModel:   body.DraftModel,
+		LoraAdapters: body.LoraAdapters,
+	}
+	if err := h.control.Send(r.Context(), cmd); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Info().Printf("swap model command is sent, worker %q, model %s", body.WorkerID, body.Model)
+
+	writeJSON(w, http.StatusAccepted, cmd)
+}
@@ -0,0 +1,235 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq/domain"
+	"github.com/soulnvkz/server/internal/chat"
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+// TurnRequest are the options of the regenerated or edited turn, Content is the edited message
+type TurnRequest struct {
+	Content        string                 `json:"content,omitempty"`
+	Prefill        string                 `json:"prefill,omitempty"`
+	ContextOptions *domain.ContextOptions `json:"context_options,omitempty"`
+	Adapter        string                 `json:"adapter,omitempty"`
+	AdapterScale   float32                `json:"adapter_scale,omitempty"`
+}
+
+// TurnResponse is the saved reply and the chat tree with the new branch active
+type TurnResponse struct {
+	NodeID  string           `json:"node_id"`
+	Status  string           `json:"status"`
+	Error   string           `json:"error,omitempty"`
+	History chat.ChatHistory `json:"history"`
+}
+
+// regenerate generates a new reply for the user message,
+// the previous replies stay in the chat as branches
+func (h *ChatsHandler) regenerate(w http.ResponseWriter, r *http.Request) {
+	c, n, body, ok := h.turnNode(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := c.HistoryBefore(n.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	h.complete(w, r, c, body, chat.Turn{
+		ParentID:  n.ID,
+		HistoryID: n.ParentID,
+		History:   history,
+		Content:   n.Message.Content,
+	})
+}
+
+// edit resends the edited user message from its place in the chat,
+// the original message and its continuation stay in the chat as a branch
+func (h *ChatsHandler) edit(w http.ResponseWriter, r *http.Request) {
+	c, n, body, ok := h.turnNode(w, r)
+	if !ok {
+		return
+	}
+	if len(strings.TrimSpace(body.Content)) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("content is required for completions"))
+		return
+	}
+
+	history, err := c.HistoryBefore(n.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	h.complete(w, r, c, body, chat.Turn{
+		ParentID:  n.ParentID,
+		User:      &domain.ChatMessage{Role: "user", Content: body.Content},
+		HistoryID: n.ParentID,
+		History:   history,
+		Content:   body.Content,
+	})
+}
+
+// turnNode resolves the chat and the user message of the path, the error is written if they are not found
+func (h *ChatsHandler) turnNode(w http.ResponseWriter, r *http.Request) (*chat.ChatContext, chat.ChatNode, TurnRequest, bool) {
+	var body TurnRequest
+
+	c, ok := h.chats.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, chat.ErrChatNotFound)
+		return nil, chat.ChatNode{}, body, false
+	}
+	n, ok := c.Node(r.PathValue("node"))
+	if !ok {
+		writeError(w, http.StatusNotFound, chat.ErrNodeNotFound)
+		return nil, chat.ChatNode{}, body, false
+	}
+	if n.Message.Role != "user" {
+		writeError(w, http.StatusBadRequest, errors.New("only user messages can be regenerated or edited"))
+		return nil, chat.ChatNode{}, body, false
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return nil, chat.ChatNode{}, body, false
+		}
+	}
+	return c, n, body, true
+}
+
+// complete requests the reply for the turn and waits for it, the reply is saved
+// with its status, so partial replies of cancelled and failed requests are kept.
+// The turn is rejected with conflict while the chat has an active stream
+func (h *ChatsHandler) complete(w http.ResponseWriter, r *http.Request, c *chat.ChatContext, body TurnRequest, t chat.Turn) {
+	end, err := h.streams.Start(c.ID)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	defer end()
+
+	t.Prefill = body.Prefill
+	req := domain.CompletionsRequest{
+		RequestID:    uuid.New().String(),
+		ChatID:       c.ID,
+		ChatMessages: t.History,
+		Content:      t.Content,
+		Prefill:      t.Prefill,
+		Adapter:      body.Adapter,
+		AdapterScale: body.AdapterScale,
+	}
+	if body.ContextOptions != nil {
+		o := *body.ContextOptions
+		if o.Strategy == domain.ContextSummarize {
+			o.Summary, o.Summarized = c.Summary(t.HistoryID)
+		}
+		req.Context = &o
+	}
+
+	q, err := h.mqcompletions.NewReplies(req.RequestID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.mqcompletions.RequestCompletions(r.Context(), q, req); err != nil {
+		if errors.Is(err, mqc.ErrUnknownAdapter) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, mqc.ErrNoWorkerQueue) {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	consumer := &turnConsumer{
+		requestID:     req.RequestID,
+		mqcompletions: h.mqcompletions,
+		chat:          c,
+		turn:          t,
+		// the reply starts with the prefill, the worker streams only the continuation
+		message: []byte(t.Prefill),
+		status:  chat.StatusCancelled,
+	}
+	if err := h.mqcompletions.ConsumeCompletions(r.Context(), q, consumer); err != nil {
+		log.Error().Printf("failed to start consume, %s", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	id, err := consumer.save()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := TurnResponse{
+		NodeID:  id,
+		Status:  consumer.status,
+		History: c.Tree(),
+	}
+	if consumer.err != nil {
+		resp.Error = consumer.err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// turnConsumer collects the reply of the turn
+type turnConsumer struct {
+	requestID     string
+	mqcompletions *mqc.MQCompletions
+	chat          *chat.ChatContext
+	turn          chat.Turn
+
+	message []byte
+	status  string
+	err     error
+}
+
+func (c *turnConsumer) OnDone() error {
+	log.Info().Printf("http client has gone, cancel %s", c.requestID)
+	return c.mqcompletions.CancelRequest(c.requestID)
+}
+
+func (c *turnConsumer) OnNext(r domain.CompletionsResponse) error {
+	switch r.ResType {
+	case domain.CompletionsNext:
+		c.message = append(c.message, r.Content...)
+	case domain.CompletionsContext:
+		if r.Context != nil && len(r.Context.Summary) > 0 {
+			err := c.chat.SetSummary(c.turn.HistoryID, r.Context.Summarized, r.Context.Summary)
+			if err != nil {
+				log.Error().Printf("failed to save chat summary, %s", err)
+			}
+		}
+	case domain.CompletionsEnd:
+		c.status = chat.StatusComplete
+		return io.EOF
+	case domain.CompletionsError:
+		c.status = chat.StatusFailed
+		c.err = errors.New(r.Content)
+		return io.EOF
+	case domain.CompletionsCancelled:
+		c.status = chat.StatusCancelled
+		return io.EOF
+	}
+	return nil
+}
+
+// save stores the turn in the chat with its status, returns ID of the assistant message
+func (c *turnConsumer) save() (string, error) {
+	return c.chat.SaveTurn(c.turn, string(c.message), c.status)
+}
@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/server/internal/chat"
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+type ChatsHandler struct {
+	chats chat.ChatStore
+	// streams are the active streams of the chats, the turns are rejected while the chat has one
+	streams       *chat.ChatStreams
+	mqcompletions *mqc.MQCompletions
+}
+
+func NewChatsHandler(chats chat.ChatStore, streams *chat.ChatStreams, mqcomp *mqc.MQCompletions) *ChatsHandler {
+	return &ChatsHandler{
+		chats:         chats,
+		streams:       streams,
+		mqcompletions: mqcomp,
+	}
+}
+
+// Register adds chats routes to the router
+func (h *ChatsHandler) Register(router *http.ServeMux) {
+	router.HandleFunc("GET /chats/{id}", h.history)
+	router.HandleFunc("POST /chats/{id}/nodes/{node}/select", h.selectBranch)
+	router.HandleFunc("POST /chats/{id}/nodes/{node}/regenerate", h.regenerate)
+	router.HandleFunc("POST /chats/{id}/nodes/{node}/edit", h.edit)
+	router.HandleFunc("POST /chats/{id}/prompt-preview", h.promptPreview)
+}
+
+// history responds with the chat tree and its active branch
+func (h *ChatsHandler) history(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.chats.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, chat.ErrChatNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.Tree())
+}
+
+// selectBranch makes the branch containing the node active
+func (h *ChatsHandler) selectBranch(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.chats.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, chat.ErrChatNotFound)
+		return
+	}
+
+	err := c.Select(r.PathValue("node"))
+	if errors.Is(err, chat.ErrNodeNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.Tree())
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Printf("failed to write response, %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// checkTimeout limits every health check
+const checkTimeout = 2 * time.Second
+
+// HealthCheck returns an error if the dependency of the server does not work
+type HealthCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthHandler serves the probes: /healthz fails if the server should be restarted,
+// /readyz fails if the server should not get the requests
+type HealthHandler struct {
+	live  []namedCheck
+	ready []namedCheck
+}
+
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{}
+}
+
+// Live adds the check to both probes
+func (h *HealthHandler) Live(name string, check HealthCheck) *HealthHandler {
+	h.live = append(h.live, namedCheck{name: name, check: check})
+	return h.Ready(name, check)
+}
+
+// Ready adds the check to the readiness probe
+func (h *HealthHandler) Ready(name string, check HealthCheck) *HealthHandler {
+	h.ready = append(h.ready, namedCheck{name: name, check: check})
+	return h
+}
+
+// Register adds health routes to the router
+func (h *HealthHandler) Register(router *http.ServeMux) {
+	router.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.probe(w, r, h.live)
+	})
+	router.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.probe(w, r, h.ready)
+	})
+}
+
+func (h *HealthHandler) probe(w http.ResponseWriter, r *http.Request, checks []namedCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	resp := healthResponse{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+	}
+	for _, c := range checks {
+		if err := c.check(ctx); err != nil {
+			resp.Status = "fail"
+			resp.Checks[c.name] = err.Error()
+			continue
+		}
+		resp.Checks[c.name] = "ok"
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
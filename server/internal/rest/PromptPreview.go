@@ -0,0 +1,172 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq/domain"
+	"github.com/soulnvkz/server/internal/chat"
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+// PromptPreviewRequest is the next chat message, without content
+// the prompt to regenerate the last reply is previewed
+type PromptPreviewRequest struct {
+	Content        string                 `json:"content,omitempty"`
+	Prefill        string                 `json:"prefill,omitempty"`
+	ContextOptions *domain.ContextOptions `json:"context_options,omitempty"`
+	Adapter        string                 `json:"adapter,omitempty"`
+	AdapterScale   float32                `json:"adapter_scale,omitempty"`
+}
+
+// PromptPreviewResponse is the dry run result with the chat messages which do not fit into the context
+type PromptPreviewResponse struct {
+	domain.PromptPreview
+	DroppedMessages []domain.ChatMessage `json:"dropped_messages"`
+}
+
+// previewRequest makes the worker request for the chat the same way the websocket does
+func previewRequest(c *chat.ChatContext, body PromptPreviewRequest) (domain.CompletionsRequest, error) {
+	req := domain.CompletionsRequest{
+		RequestID:    uuid.New().String(),
+		ChatID:       c.ID,
+		Prefill:      body.Prefill,
+		Preview:      true,
+		Adapter:      body.Adapter,
+		AdapterScale: body.AdapterScale,
+	}
+
+	historyID := c.Leaf()
+	if len(body.Content) > 0 {
+		req.ChatMessages = c.History()
+		req.Content = body.Content
+	} else {
+		user, err := c.LastUserTurn()
+		if err != nil {
+			return domain.CompletionsRequest{}, err
+		}
+		history, err := c.HistoryBefore(user.ID)
+		if err != nil {
+			return domain.CompletionsRequest{}, err
+		}
+		historyID = user.ParentID
+		req.ChatMessages = history
+		req.Content = user.Message.Content
+	}
+
+	if body.ContextOptions != nil {
+		o := *body.ContextOptions
+		if o.Strategy == domain.ContextSummarize {
+			o.Summary, o.Summarized = c.Summary(historyID)
+		}
+		req.Context = &o
+	}
+
+	return req, nil
+}
+
+// promptPreview is the dry run, it responds with the prompt the worker builds for the chat,
+// its length, the dropped history and the sampling settings. The reply is not generated
+func (h *ChatsHandler) promptPreview(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.chats.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("chat not found"))
+		return
+	}
+
+	var body PromptPreviewRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	req, err := previewRequest(c, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	q, err := h.mqcompletions.NewReplies(req.RequestID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := h.mqcompletions.RequestCompletions(r.Context(), q, req); err != nil {
+		if errors.Is(err, mqc.ErrUnknownAdapter) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if errors.Is(err, mqc.ErrNoWorkerQueue) {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	consumer := &previewConsumer{
+		requestID:     req.RequestID,
+		mqcompletions: h.mqcompletions,
+	}
+	if err := h.mqcompletions.ConsumeCompletions(r.Context(), q, consumer); err != nil {
+		log.Error().Printf("failed to start consume, %s", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if consumer.err != nil {
+		writeError(w, http.StatusInternalServerError, consumer.err)
+		return
+	}
+	resp := PromptPreviewResponse{
+		PromptPreview:   *consumer.preview,
+		DroppedMessages: make([]domain.ChatMessage, 0, len(consumer.preview.Dropped)),
+	}
+	for _, i := range consumer.preview.Dropped {
+		if i >= 0 && i < len(req.ChatMessages) {
+			resp.DroppedMessages = append(resp.DroppedMessages, req.ChatMessages[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// previewConsumer waits for the preview reply of the worker
+type previewConsumer struct {
+	requestID     string
+	mqcompletions *mqc.MQCompletions
+
+	preview *domain.PromptPreview
+	err     error
+}
+
+func (c *previewConsumer) OnDone() error {
+	c.err = errors.New("request is cancelled")
+	return c.mqcompletions.CancelRequest(c.requestID)
+}
+
+func (c *previewConsumer) OnNext(r domain.CompletionsResponse) error {
+	switch r.ResType {
+	case domain.CompletionsPreview:
+		c.preview = r.Preview
+		if c.preview == nil {
+			c.err = errors.New("worker does not support prompt preview")
+		}
+		return io.EOF
+	case domain.CompletionsError:
+		c.err = errors.New(r.Content)
+		return io.EOF
+	case domain.CompletionsCancelled:
+		c.err = errors.New("request is cancelled")
+		return io.EOF
+	case domain.CompletionsEnd:
+		c.err = errors.New("worker does not support prompt preview")
+		return io.EOF
+	}
+	return nil
+}
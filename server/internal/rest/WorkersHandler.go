@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"net/http"
+
+	mqc "github.com/soulnvkz/server/internal/mq"
+)
+
+type WorkersHandler struct {
+	workers *mqc.Workers
+}
+
+func NewWorkersHandler(workers *mqc.Workers) *WorkersHandler {
+	return &WorkersHandler{
+		workers: workers,
+	}
+}
+
+// Register adds workers routes to the router
+func (h *WorkersHandler) Register(router *http.ServeMux) {
+	router.HandleFunc("GET /workers", h.list)
+}
+
+// list responds with the alive workers, their models and adapters
+func (h *WorkersHandler) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.workers.List())
+}
@@ -18,6 +18,26 @@ import (
 type Message struct {
 	MessageType int    `json:"message_type"`
 	Content     string `json:"content,omitempty"`
+	ChatID      string `json:"chat_id,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+	NodeID      string `json:"node_id,omitempty"`
+	// Prefill is the beginning of the assistant reply the model has to continue
+	Prefill string `json:"prefill,omitempty"`
+	// ContextOptions selects the strategy to fit the chat history into the context window
+	ContextOptions *domain.ContextOptions `json:"context_options,omitempty"`
+	Context        *domain.ContextReport  `json:"context,omitempty"`
+	// Logprobs requests log-probabilities of the generated tokens with TopLogprobs alternatives
+	Logprobs      bool                  `json:"logprobs,omitempty"`
+	TopLogprobs   int                   `json:"top_logprobs,omitempty"`
+	TokenLogprobs []domain.TokenLogprob `json:"token_logprobs,omitempty"`
+	// Adapter selects LoRA adapter of the workers with AdapterScale
+	Adapter      string  `json:"adapter,omitempty"`
+	AdapterScale float32 `json:"adapter_scale,omitempty"`
+	// Index is the index of the response of the stream, it is sent with the start, the context and the chunks.
+	// The stream is resumed after the index the client has received, it is resumed from the beginning if it is -1
+	Index *int `json:"index,omitempty"`
+
+	History *chat.ChatHistory `json:"history,omitempty"`
 }
 
 const (
@@ -26,6 +46,13 @@ const (
 
 	CompletitionsMessage = 2
 	CancelMessage        = 3
+	NewChatMessage       = 4
+	RegenerateMessage    = 5
+	EditMessage          = 6
+	SwitchBranchMessage  = 7
+	HistoryMessage       = 8
+	ContinueMessage      = 9
+	ResumeMessage        = 10
 
 	CompletitionsStart = 2
 	CompletitionsNext  = 3
@@ -33,6 +60,12 @@ const (
 	CompletitionsQueue = 5
 
 	Error = 6
+
+	ChatCreated = 7
+	History     = 8
+
+	CompletitionsCancelled = 9
+	CompletitionsContext   = 10
 )
 
 type WSCompletions struct {
@@ -42,11 +75,22 @@ type WSCompletions struct {
 
 	pingTicker *time.Ticker
 
-	mu           *sync.Mutex
-	streamCancel *context.CancelFunc
+	// mu guards streams and defaultChatID, wmu serializes writes to the connection
+	mu  *sync.Mutex
+	wmu *sync.Mutex
+
+	// active streams of the connection by chat ID, they are started in chatStreams of the server,
+	// so every chat can have only one stream at a time
+	streams     map[string]context.CancelFunc
+	chatStreams *chat.ChatStreams
+	// defaultChatID is resolved through the store on every message, so the chat is not evicted while it is used
+	defaultChatID string
+	// closing is set on shutdown, new streams are not started then
+	closing bool
+	active  sync.WaitGroup
 
 	mqcompletions *mqc.MQCompletions
-	chat          *chat.ChatContext
+	chats         chat.ChatStore
 }
 
 const (
@@ -57,7 +101,8 @@ func NewWSCompletions(
 	ctx context.Context,
 	c *websocket.Conn,
 	mqcomp *mqc.MQCompletions,
-	chat *chat.ChatContext) *WSCompletions {
+	chats chat.ChatStore,
+	chatStreams *chat.ChatStreams) *WSCompletions {
 	nctx, cancel := context.WithCancel(ctx)
 
 	return &WSCompletions{
@@ -66,9 +111,11 @@ func NewWSCompletions(
 		cancel:        cancel,
 		pingTicker:    time.NewTicker(PING_DELAY),
 		mqcompletions: mqcomp,
-		chat:          chat,
+		chats:         chats,
 		mu:            &sync.Mutex{},
-		streamCancel:  nil,
+		wmu:           &sync.Mutex{},
+		streams:       make(map[string]context.CancelFunc),
+		chatStreams:   chatStreams,
 	}
 }
 
@@ -77,6 +124,35 @@ func (socket *WSCompletions) Close() {
 	socket.c.Close()
 }
 
+// Shutdown stops starting new streams and waits for the active ones until the context is done,
+// then the connection is closed with going away code. The rest of the streams are not cancelled,
+// the client resumes them from the other server
+func (socket *WSCompletions) Shutdown(ctx context.Context) {
+	socket.mu.Lock()
+	socket.closing = true
+	socket.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		socket.active.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Info().Printf("detaching active streams on shutdown")
+	}
+	socket.cancel()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	err := socket.c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err != nil {
+		log.Error().Printf("failed to close connection, %s", err)
+	}
+	socket.c.Close()
+}
+
 func (socket *WSCompletions) HandleMessages() {
 loop:
 	for {
@@ -97,6 +173,43 @@ loop:
 	}
 }
 
+// chat resolves the chat addressed by the message, the chats are created by NewChatMessage only.
+// Messages without chat ID are addressed to the default chat of the connection,
+// it is created with the first of them and again if it has expired. The error is written to the client.
+// Chat IDs are bearer secrets, the chat is served to anyone who has its ID, so they are sent to the owner only
+func (socket *WSCompletions) chat(message Message) (*chat.ChatContext, bool) {
+	if len(message.ChatID) > 0 {
+		c, ok := socket.chats.Get(message.ChatID)
+		if !ok {
+			socket.writeStreamError(message.ChatID, chat.ErrChatNotFound)
+		}
+		return c, ok
+	}
+
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	if len(socket.defaultChatID) > 0 {
+		if c, ok := socket.chats.Get(socket.defaultChatID); ok {
+			return c, true
+		}
+		log.Info().Printf("default chat %s has expired", socket.defaultChatID)
+	}
+	c := socket.chats.Create()
+	socket.defaultChatID = c.ID
+	return c, true
+}
+
+// chatID returns ID of the chat addressed by the message without creating the default chat
+func (socket *WSCompletions) chatID(message Message) string {
+	if len(message.ChatID) > 0 {
+		return message.ChatID
+	}
+
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	return socket.defaultChatID
+}
+
 func (socket *WSCompletions) handlePing() {
 	socket.pingTicker.Reset(PING_DELAY)
 	err := socket.writePong()
@@ -106,79 +219,301 @@ func (socket *WSCompletions) handlePing() {
 	}
 }
 
-func (socket *WSCompletions) handleStreamCancel() {
+func (socket *WSCompletions) handleNewChat() {
+	c := socket.chats.Create()
+	err := socket.writeChatCreated(c.ID)
+	if err != nil {
+		log.Error().Printf("writing message error: %s", err)
+		socket.cancel()
+	}
+}
+
+func (socket *WSCompletions) handleStreamCancel(message Message) {
+	chatID := socket.chatID(message)
+
 	socket.mu.Lock()
-	if socket.streamCancel != nil {
-		(*socket.streamCancel)()
-		socket.streamCancel = nil
-	} else {
-		socket.writeError(errors.New("no active completions"))
+	cancel, ok := socket.streams[chatID]
+	if ok {
+		cancel()
+		delete(socket.streams, chatID)
 	}
 	socket.mu.Unlock()
+
+	if !ok {
+		socket.writeStreamError(chatID, errors.New("no active completions"))
+	}
 }
 
 func (socket *WSCompletions) handleCompletions(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
 	if len(message.Content) == 0 {
-		log.Info().Println("content is required for completitions")
-		err := socket.writeError(errors.New("content is required for completitions"))
-		if err != nil {
-			socket.cancel()
-		}
+		socket.writeStreamError(c.ID, errors.New("content is required for completitions"))
+		return
+	}
+
+	leaf := c.Leaf()
+	socket.stream(c, message, chat.Turn{
+		ParentID:  leaf,
+		HistoryID: leaf,
+		User:      &domain.ChatMessage{Role: "user", Content: message.Content},
+		History:   c.History(),
+		Content:   message.Content,
+	})
+}
+
+// handleRegenerate generates a new reply for the last user message,
+// the previous reply stays in the chat as a branch
+func (socket *WSCompletions) handleRegenerate(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	user, err := c.LastUserTurn()
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
 		return
 	}
+	history, err := c.HistoryBefore(user.ID)
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+
+	socket.stream(c, message, chat.Turn{
+		ParentID:  user.ID,
+		HistoryID: user.ParentID,
+		History:   history,
+		Content:   user.Message.Content,
+	})
+}
+
+// handleEdit resends the edited user message from its place in the chat,
+// the original message and its continuation stay in the chat as a branch
+func (socket *WSCompletions) handleEdit(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	if len(message.Content) == 0 {
+		socket.writeStreamError(c.ID, errors.New("content is required for completitions"))
+		return
+	}
+
+	n, ok := c.Node(message.NodeID)
+	if !ok {
+		socket.writeStreamError(c.ID, chat.ErrNodeNotFound)
+		return
+	}
+	if n.Message.Role != "user" {
+		socket.writeStreamError(c.ID, errors.New("only user messages can be edited"))
+		return
+	}
+	history, err := c.HistoryBefore(n.ID)
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+
+	socket.stream(c, message, chat.Turn{
+		ParentID:  n.ParentID,
+		HistoryID: n.ParentID,
+		User:      &domain.ChatMessage{Role: "user", Content: message.Content},
+		History:   history,
+		Content:   message.Content,
+	})
+}
+
+// handleContinue asks the worker to keep generating the last assistant message,
+// it is used to finish partial replies of cancelled or failed streams
+func (socket *WSCompletions) handleContinue(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	n, err := c.LastAssistantTurn()
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+	history, err := c.HistoryBefore(n.ID)
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+
+	// the partial reply is marked incomplete, so the worker continues it verbatim
+	partial := n.Message
+	partial.Incomplete = true
+
+	socket.stream(c, message, chat.Turn{
+		ParentID:   n.ParentID,
+		HistoryID:  n.ID,
+		ContinueID: n.ID,
+		History:    append(history, partial),
+	})
+}
+
+func (socket *WSCompletions) handleSwitchBranch(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	socket.mu.Lock()
+	_, streaming := socket.streams[c.ID]
+	socket.mu.Unlock()
+	if streaming {
+		socket.writeStreamError(c.ID, errors.New("previous stream is not finished"))
+		return
+	}
+
+	if err := c.Select(message.NodeID); err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+	socket.handleHistory(message)
+}
+
+func (socket *WSCompletions) handleHistory(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	h := c.Tree()
+	err := socket.writeHistory(&h)
+	if err != nil {
+		log.Error().Printf("writing message error: %s", err)
+		socket.cancel()
+	}
+}
 
+// register adds the stream of the chat, every chat can have only one stream at a time
+// on the server, the rest turns of the chat are rejected while it is active.
+// The stream is not cancelled with the connection, it is detached and can be resumed then
+func (socket *WSCompletions) register(chatID string) (context.Context, func(), error) {
 	socket.mu.Lock()
-	if socket.streamCancel != nil {
+	defer socket.mu.Unlock()
+
+	if socket.closing {
+		return nil, nil, errors.New("server is shutting down")
+	}
+	end, err := socket.chatStreams.Start(chatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(socket.ctx))
+	socket.streams[chatID] = cancel
+	socket.active.Add(1)
+
+	return ctx, func() {
+		socket.mu.Lock()
+		delete(socket.streams, chatID)
 		socket.mu.Unlock()
-		log.Info().Println("previous stream is not finished")
-		err := socket.writeError(errors.New("previous stream is not finished"))
+		cancel()
+		end()
+		socket.active.Done()
+	}, nil
+}
+
+// handleResume replays the stream of the request after the index the client has received
+// and goes on with it. The stream can be started by any server
+func (socket *WSCompletions) handleResume(message Message) {
+	c, ok := socket.chat(message)
+	if !ok {
+		return
+	}
+
+	if len(message.RequestID) == 0 {
+		socket.writeStreamError(c.ID, errors.New("request id is required to resume"))
+		return
+	}
+
+	ctx, done, err := socket.register(c.ID)
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
+		return
+	}
+
+	index := -1
+	if message.Index != nil {
+		index = *message.Index
+	}
+
+	// the socket reads the next messages while the worker replays the stream
+	go func() {
+		defer done()
+
+		q, err := socket.mqcompletions.Resume(ctx, message.RequestID, index)
 		if err != nil {
-			socket.cancel()
+			socket.writeStreamError(c.ID, err)
+			return
 		}
+
+		consumer := NewWSResumeConsumer(message.RequestID, socket, c.ID)
+		err = socket.mqcompletions.ConsumeCompletions(ctx, q, consumer)
+		if err != nil {
+			log.Error().Printf("failed to start consume, %s", err)
+		}
+	}()
+}
+
+// stream requests completions for the turn, the request options are taken from the client message
+func (socket *WSCompletions) stream(c *chat.ChatContext, message Message, t chat.Turn) {
+	t.Prefill = message.Prefill
+
+	ctx, done, err := socket.register(c.ID)
+	if err != nil {
+		socket.writeStreamError(c.ID, err)
 		return
 	}
-	socket.mu.Unlock()
 
 	go func() {
-		socket.mu.Lock()
-		ctx, cancel := context.WithCancel(socket.ctx)
-		socket.streamCancel = &cancel
-		socket.mu.Unlock()
+		defer done()
 
-		defer func() {
-			socket.mu.Lock()
-			if socket.streamCancel != nil {
-				socket.streamCancel = nil
-			}
-			socket.mu.Unlock()
-		}()
+		request_id := uuid.New().String()
+		consumer := NewWSConsumer(request_id, socket, c, t)
 
-		q, err := socket.mqcompletions.NewCompletionsQueue()
+		err := socket.writeQueueCompletions(c.ID, request_id)
 		if err != nil {
-			log.Error().Printf("failed to declare queue, %s", err)
+			log.Error().Printf("failed to response, %s", err)
 			return
 		}
 
-		err = socket.writeQueueCompletions()
+		q, err := socket.mqcompletions.NewReplies(request_id)
 		if err != nil {
-			log.Error().Printf("failed to response, %s", err)
+			log.Error().Printf("failed to await replies, %s", err)
+			consumer.OnError(err)
 			return
 		}
 
-		request_id := uuid.New().String()
 		request := domain.CompletionsRequest{
 			RequestID:    request_id,
-			ChatMessages: socket.chat.Messages,
-			Content:      message.Content,
+			ChatID:       c.ID,
+			ChatMessages: t.History,
+			Content:      t.Content,
+			Prefill:      t.Prefill,
+			Context:      socket.contextOptions(c, message, t),
+			Logprobs:     message.Logprobs,
+			TopLogprobs:  message.TopLogprobs,
+			Adapter:      message.Adapter,
+			AdapterScale: message.AdapterScale,
 		}
 
 		err = socket.mqcompletions.RequestCompletions(ctx, q, request)
 		if err != nil {
 			log.Error().Printf("failed publish, %s", err)
+			consumer.OnError(err)
 			return
 		}
 
-		consumer := NewWSConsumer(request_id, socket, []byte(message.Content))
 		err = socket.mqcompletions.ConsumeCompletions(ctx, q, consumer)
 		if err != nil {
 			log.Error().Printf("failed to start consume, %s", err)
@@ -187,12 +522,25 @@ func (socket *WSCompletions) handleCompletions(message Message) {
 	}()
 }
 
+// contextOptions adds the stored chat summary to the client context options
+func (socket *WSCompletions) contextOptions(c *chat.ChatContext, message Message, t chat.Turn) *domain.ContextOptions {
+	if message.ContextOptions == nil {
+		return nil
+	}
+
+	o := *message.ContextOptions
+	if o.Strategy == domain.ContextSummarize {
+		o.Summary, o.Summarized = c.Summary(t.HistoryID)
+	}
+	return &o
+}
+
 func (socket *WSCompletions) handleMessage(buff []byte) {
 	var message Message
 	err := json.Unmarshal(buff, &message)
 	if err != nil {
 		log.Info().Printf("unssuported message")
-		err = socket.writeError(errors.New("unssuported message"))
+		err = socket.writeError("", errors.New("unssuported message"))
 		if err != nil {
 			socket.cancel()
 		}
@@ -203,12 +551,26 @@ func (socket *WSCompletions) handleMessage(buff []byte) {
 	case message.MessageType == PingMessage:
 		socket.handlePing()
 	case message.MessageType == CancelMessage:
-		socket.handleStreamCancel()
+		socket.handleStreamCancel(message)
 	case message.MessageType == CompletitionsMessage:
 		socket.handleCompletions(message)
+	case message.MessageType == NewChatMessage:
+		socket.handleNewChat()
+	case message.MessageType == RegenerateMessage:
+		socket.handleRegenerate(message)
+	case message.MessageType == EditMessage:
+		socket.handleEdit(message)
+	case message.MessageType == SwitchBranchMessage:
+		socket.handleSwitchBranch(message)
+	case message.MessageType == HistoryMessage:
+		socket.handleHistory(message)
+	case message.MessageType == ContinueMessage:
+		socket.handleContinue(message)
+	case message.MessageType == ResumeMessage:
+		socket.handleResume(message)
 	default:
 		log.Info().Printf("unssuported message")
-		err = socket.writeError(errors.New("unssuported message"))
+		err = socket.writeError(message.ChatID, errors.New("unssuported message"))
 		if err != nil {
 			socket.cancel()
 		}
@@ -216,11 +578,7 @@ func (socket *WSCompletions) handleMessage(buff []byte) {
 	}
 }
 
-func (socket *WSCompletions) writePong() error {
-	message := &Message{
-		MessageType: PongMessage,
-	}
-
+func (socket *WSCompletions) writeMessage(message *Message) error {
 	data, err := json.Marshal(message)
 	if err != nil {
 		log.Error().Printf("failed to marshal message, %s", err)
@@ -230,70 +588,107 @@ func (socket *WSCompletions) writePong() error {
 	return socket.writeNext(data)
 }
 
-func (socket *WSCompletions) writeCompletions(buff []byte) error {
-	message := &Message{
-		MessageType: CompletitionsNext,
-		Content:     string(buff),
-	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Error().Printf("failed to marshal message, %s", err)
-		return err
-	}
+func (socket *WSCompletions) writePong() error {
+	return socket.writeMessage(&Message{
+		MessageType: PongMessage,
+	})
+}
 
-	return socket.writeNext(data)
+func (socket *WSCompletions) writeChatCreated(chatID string) error {
+	return socket.writeMessage(&Message{
+		MessageType: ChatCreated,
+		ChatID:      chatID,
+	})
 }
 
-func (socket *WSCompletions) writeQueueCompletions() error {
-	message := &Message{
-		MessageType: CompletitionsQueue,
-	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Error().Printf("failed to marshal message, %s", err)
-		return err
-	}
+func (socket *WSCompletions) writeCompletions(chatID, requestID string, index int, buff []byte, logprobs []domain.TokenLogprob) error {
+	return socket.writeMessage(&Message{
+		MessageType:   CompletitionsNext,
+		Content:       string(buff),
+		ChatID:        chatID,
+		RequestID:     requestID,
+		TokenLogprobs: logprobs,
+		Index:         &index,
+	})
+}
 
-	return socket.writeNext(data)
+func (socket *WSCompletions) writeContextCompletions(chatID, requestID string, index int, r *domain.ContextReport) error {
+	return socket.writeMessage(&Message{
+		MessageType: CompletitionsContext,
+		ChatID:      chatID,
+		RequestID:   requestID,
+		Index:       &index,
+		Context:     r,
+	})
+}
+
+func (socket *WSCompletions) writeQueueCompletions(chatID, requestID string) error {
+	return socket.writeMessage(&Message{
+		MessageType: CompletitionsQueue,
+		ChatID:      chatID,
+		RequestID:   requestID,
+	})
 }
 
-func (socket *WSCompletions) writeStartCompletions() error {
-	message := &Message{
+func (socket *WSCompletions) writeStartCompletions(chatID, requestID string, index int) error {
+	return socket.writeMessage(&Message{
 		MessageType: CompletitionsStart,
-	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Error().Printf("failed to marshal message, %s", err)
-		return err
-	}
-	return socket.writeNext(data)
+		ChatID:      chatID,
+		RequestID:   requestID,
+		Index:       &index,
+	})
 }
 
-func (socket *WSCompletions) writeEndCompletions() error {
-	message := &Message{
+func (socket *WSCompletions) writeEndCompletions(chatID, requestID, nodeID string) error {
+	return socket.writeMessage(&Message{
 		MessageType: CompletitionsEnd,
-	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Error().Printf("failed to marshal message, %s", err)
-		return err
-	}
+		ChatID:      chatID,
+		RequestID:   requestID,
+		NodeID:      nodeID,
+	})
+}
 
-	return socket.writeNext(data)
+func (socket *WSCompletions) writeCancelledCompletions(chatID, requestID, nodeID string) error {
+	return socket.writeMessage(&Message{
+		MessageType: CompletitionsCancelled,
+		ChatID:      chatID,
+		RequestID:   requestID,
+		NodeID:      nodeID,
+	})
 }
 
-func (socket *WSCompletions) writeError(err error) error {
-	message := &Message{
+func (socket *WSCompletions) writeCompletionsError(chatID, requestID, nodeID string, err error) error {
+	return socket.writeMessage(&Message{
 		MessageType: Error,
 		Content:     err.Error(),
-	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Error().Printf("failed to marshal message, %s", err)
-		return err
-	}
+		ChatID:      chatID,
+		RequestID:   requestID,
+		NodeID:      nodeID,
+	})
+}
 
-	return socket.writeNext(data)
+func (socket *WSCompletions) writeHistory(h *chat.ChatHistory) error {
+	return socket.writeMessage(&Message{
+		MessageType: History,
+		ChatID:      h.ChatID,
+		History:     h,
+	})
+}
+
+func (socket *WSCompletions) writeError(chatID string, err error) error {
+	return socket.writeMessage(&Message{
+		MessageType: Error,
+		Content:     err.Error(),
+		ChatID:      chatID,
+	})
+}
+
+// writeStreamError reports the error to the client and closes the connection if it is broken
+func (socket *WSCompletions) writeStreamError(chatID string, err error) {
+	log.Info().Println(err)
+	if err := socket.writeError(chatID, err); err != nil {
+		socket.cancel()
+	}
 }
 
 func (socket *WSCompletions) readNext() []byte {
@@ -314,7 +709,7 @@ func (socket *WSCompletions) readNext() []byte {
 }
 
 func (socket *WSCompletions) writeNext(data []byte) error {
-	socket.mu.Lock()
-	defer socket.mu.Unlock()
+	socket.wmu.Lock()
+	defer socket.wmu.Unlock()
 	return socket.c.WriteMessage(websocket.TextMessage, data)
 }
@@ -1,60 +1,121 @@
 package ws
 
 import (
+	"errors"
 	"io"
 
 	"github.com/soulnvkz/log"
 	"github.com/soulnvkz/mq/domain"
+	"github.com/soulnvkz/server/internal/chat"
 )
 
 type WSConsumer struct {
 	requestID string
 	socket    *WSCompletions
+	chat      *chat.ChatContext
+	turn      chat.Turn
 	message   []byte
-	userm     []byte
+	saved     bool
+	// detached is set when the client is gone, the stream goes on and the turn is saved,
+	// so the client can resume it from any server
+	detached bool
 }
 
-func NewWSConsumer(reqID string, s *WSCompletions, userm []byte) *WSConsumer {
+func NewWSConsumer(reqID string, s *WSCompletions, c *chat.ChatContext, t chat.Turn) *WSConsumer {
 	return &WSConsumer{
 		requestID: reqID,
 		socket:    s,
-		userm:     userm,
-		message:   make([]byte, 0, 1024),
+		chat:      c,
+		turn:      t,
+		// the reply starts with the prefill, the worker streams only the continuation
+		message: append(make([]byte, 0, 1024), t.Prefill...),
+	}
+}
+
+// save stores the turn in the chat with its status, partial replies
+// of cancelled and failed streams are saved as well. Returns ID of the assistant message
+func (c *WSConsumer) save(status string) (string, error) {
+	if c.saved {
+		return "", errors.New("turn has saved already")
+	}
+	c.saved = true
+
+	return c.chat.SaveTurn(c.turn, string(c.message), status)
+}
+
+// write detaches the stream if the response is not written to the client
+func (c *WSConsumer) write(err error) {
+	if err != nil && !c.detached {
+		log.Info().Printf("%s, stream %s is detached", err, c.requestID)
+		c.detached = true
 	}
 }
 
 func (c *WSConsumer) OnDone() error {
 	log.Info().Printf("call OnDone, %s", c.requestID)
+	if !c.saved {
+		id, err := c.save(chat.StatusCancelled)
+		if err != nil {
+			log.Error().Printf("failed to save chat messages, %s", err)
+		} else {
+			// the socket can be closed already, so the result is not important
+			c.socket.writeCancelledCompletions(c.chat.ID, c.requestID, id)
+		}
+	}
+
 	if err := c.socket.mqcompletions.CancelRequest(c.requestID); err != nil {
 		return err
 	}
 	return nil
 }
 
+// OnError saves the turn as failed and reports the error to the client
+func (c *WSConsumer) OnError(err error) {
+	log.Error().Printf("completions %s failed, %s", c.requestID, err)
+	id, serr := c.save(chat.StatusFailed)
+	if serr != nil {
+		log.Error().Printf("failed to save chat messages, %s", serr)
+	}
+	c.socket.writeCompletionsError(c.chat.ID, c.requestID, id, err)
+}
+
 func (c *WSConsumer) OnNext(r domain.CompletionsResponse) error {
 	log.Info().Printf("call OnNext %s", r.RequestID)
 	switch {
 	case r.ResType == domain.CompletionsStart:
-		if err := c.socket.writeStartCompletions(); err != nil {
-			return err
-		}
+		c.write(c.socket.writeStartCompletions(c.chat.ID, c.requestID, r.Index))
 	case r.ResType == domain.CompletionsEnd:
-		c.socket.chat.Add(domain.ChatMessage{
-			Role:    "user",
-			Content: string(c.userm),
-		})
-		c.socket.chat.Add(domain.ChatMessage{
-			Role:    "assistant",
-			Content: string(c.message),
-		})
-		c.socket.writeEndCompletions()
+		id, err := c.save(chat.StatusComplete)
+		if err != nil {
+			log.Error().Printf("failed to save chat messages, %s", err)
+			c.socket.writeError(c.chat.ID, err)
+			return io.EOF
+		}
+		c.socket.writeEndCompletions(c.chat.ID, c.requestID, id)
 		return io.EOF
+	case r.ResType == domain.CompletionsError:
+		c.OnError(errors.New(r.Content))
+		return io.EOF
+	case r.ResType == domain.CompletionsCancelled:
+		// the request is cancelled by the other connection or before it is started
+		id, err := c.save(chat.StatusCancelled)
+		if err != nil {
+			log.Error().Printf("failed to save chat messages, %s", err)
+		}
+		c.socket.writeCancelledCompletions(c.chat.ID, c.requestID, id)
+		return io.EOF
+	case r.ResType == domain.CompletionsContext && r.Context != nil:
+		if len(r.Context.Summary) > 0 {
+			err := c.chat.SetSummary(c.turn.HistoryID, r.Context.Summarized, r.Context.Summary)
+			if err != nil {
+				log.Error().Printf("failed to save chat summary, %s", err)
+			}
+		}
+		c.write(c.socket.writeContextCompletions(c.chat.ID, c.requestID, r.Index, r.Context))
 	case r.ResType == domain.CompletionsNext:
 		buff := []byte(r.Content)
 		c.message = append(c.message, buff...)
-		if err := c.socket.writeCompletions(buff); err != nil {
-			return err
-		}
+		c.write(c.socket.writeCompletions(c.chat.ID, c.requestID, r.Index, buff, r.Logprobs))
 	default:
 		log.Info().Printf("unsuported completions response type, %v", r)
 	}
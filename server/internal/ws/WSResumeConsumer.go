@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"errors"
+	"io"
+
+	"github.com/soulnvkz/log"
+	"github.com/soulnvkz/mq/domain"
+)
+
+// WSResumeConsumer passes the resumed stream to the client. The turn is saved
+// by the server which has started the stream, so the resumed one is not saved
+type WSResumeConsumer struct {
+	requestID string
+	chatID    string
+	socket    *WSCompletions
+}
+
+func NewWSResumeConsumer(reqID string, s *WSCompletions, chatID string) *WSResumeConsumer {
+	return &WSResumeConsumer{
+		requestID: reqID,
+		chatID:    chatID,
+		socket:    s,
+	}
+}
+
+func (c *WSResumeConsumer) OnDone() error {
+	log.Info().Printf("call OnDone, resumed %s", c.requestID)
+	c.socket.writeCancelledCompletions(c.chatID, c.requestID, "")
+	return c.socket.mqcompletions.CancelRequest(c.requestID)
+}
+
+// OnNext stops the stream if the client is gone, the stream is not cancelled then
+// and can be resumed again
+func (c *WSResumeConsumer) OnNext(r domain.CompletionsResponse) error {
+	var err error
+	switch r.ResType {
+	case domain.CompletionsStart:
+		err = c.socket.writeStartCompletions(c.chatID, c.requestID, r.Index)
+	case domain.CompletionsContext:
+		if r.Context != nil {
+			err = c.socket.writeContextCompletions(c.chatID, c.requestID, r.Index, r.Context)
+		}
+	case domain.CompletionsNext:
+		err = c.socket.writeCompletions(c.chatID, c.requestID, r.Index, []byte(r.Content), r.Logprobs)
+	case domain.CompletionsEnd:
+		c.socket.writeEndCompletions(c.chatID, c.requestID, "")
+		return io.EOF
+	case domain.CompletionsError:
+		c.socket.writeCompletionsError(c.chatID, c.requestID, "", errors.New(r.Content))
+		return io.EOF
+	case domain.CompletionsCancelled:
+		c.socket.writeCancelledCompletions(c.chatID, c.requestID, "")
+		return io.EOF
+	default:
+		log.Info().Printf("unsuported completions response type, %v", r)
+	}
+
+	if err != nil {
+		log.Info().Printf("%s, resumed stream %s is detached", err, c.requestID)
+		return io.EOF
+	}
+	return nil
+}